@@ -0,0 +1,41 @@
+package log_v1
+
+import (
+	"fmt"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 存在しないオフセットを読み出そうとした際に返すエラー
+type ErrOffsetOutOfRange struct {
+	Offset uint64
+}
+
+// gRPCのステータスに変換する(grpcパッケージはGRPCStatusメソッドを持つエラーをそのままステータスとして返す)
+// HTTPの404のような定義外のコードはクライアントでUnknownとして扱われるため、gRPCのコードを使う
+func (e ErrOffsetOutOfRange) GRPCStatus() *status.Status {
+	st := status.New(
+		codes.OutOfRange,
+		fmt.Sprintf("offset out of range: %d", e.Offset),
+	)
+	msg := fmt.Sprintf(
+		"The requested offset is outside the log's range: %d",
+		e.Offset,
+	)
+	d := &errdetails.LocalizedMessage{
+		Locale:  "en-US",
+		Message: msg,
+	}
+	std, err := st.WithDetails(d)
+	if err != nil {
+		return st
+	}
+
+	return std
+}
+
+func (e ErrOffsetOutOfRange) Error() string {
+	return e.GRPCStatus().Err().Error()
+}
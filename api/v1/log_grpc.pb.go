@@ -26,6 +26,8 @@ type LogClient interface {
 	Consume(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (*ConsumeResponse, error)
 	ConsumeStream(ctx context.Context, in *ConsumeRequest, opts ...grpc.CallOption) (Log_ConsumeStreamClient, error)
 	ProduceStream(ctx context.Context, opts ...grpc.CallOption) (Log_ProduceStreamClient, error)
+	// クラスタのサーバーと、それぞれが保持しているログのオフセットの範囲を返す
+	GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error)
 }
 
 type logClient struct {
@@ -117,6 +119,15 @@ func (x *logProduceStreamClient) Recv() (*ProduceResponse, error) {
 	return m, nil
 }
 
+func (c *logClient) GetServers(ctx context.Context, in *GetServersRequest, opts ...grpc.CallOption) (*GetServersResponse, error) {
+	out := new(GetServersResponse)
+	err := c.cc.Invoke(ctx, "/log.v1.Log/GetServers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // LogServer is the server API for Log service.
 // All implementations must embed UnimplementedLogServer
 // for forward compatibility
@@ -125,6 +136,8 @@ type LogServer interface {
 	Consume(context.Context, *ConsumeRequest) (*ConsumeResponse, error)
 	ConsumeStream(*ConsumeRequest, Log_ConsumeStreamServer) error
 	ProduceStream(Log_ProduceStreamServer) error
+	// クラスタのサーバーと、それぞれが保持しているログのオフセットの範囲を返す
+	GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error)
 	mustEmbedUnimplementedLogServer()
 }
 
@@ -144,6 +157,9 @@ func (UnimplementedLogServer) ConsumeStream(*ConsumeRequest, Log_ConsumeStreamSe
 func (UnimplementedLogServer) ProduceStream(Log_ProduceStreamServer) error {
 	return status.Errorf(codes.Unimplemented, "method ProduceStream not implemented")
 }
+func (UnimplementedLogServer) GetServers(context.Context, *GetServersRequest) (*GetServersResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServers not implemented")
+}
 func (UnimplementedLogServer) mustEmbedUnimplementedLogServer() {}
 
 // UnsafeLogServer may be embedded to opt out of forward compatibility for this service.
@@ -240,6 +256,24 @@ func (x *logProduceStreamServer) Recv() (*ProduceRequest, error) {
 	return m, nil
 }
 
+func _Log_GetServers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetServersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LogServer).GetServers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/log.v1.Log/GetServers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LogServer).GetServers(ctx, req.(*GetServersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // Log_ServiceDesc is the grpc.ServiceDesc for Log service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -255,6 +289,10 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "Consume",
 			Handler:    _Log_Consume_Handler,
 		},
+		{
+			MethodName: "GetServers",
+			Handler:    _Log_GetServers_Handler,
+		},
 	},
 	Streams: []grpc.StreamDesc{
 		{
@@ -271,3 +309,184 @@ var Log_ServiceDesc = grpc.ServiceDesc{
 	},
 	Metadata: "api/v1/log.proto",
 }
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	ExportLog(ctx context.Context, opts ...grpc.CallOption) (Admin_ExportLogClient, error)
+	ImportLog(ctx context.Context, in *ImportLogRequest, opts ...grpc.CallOption) (Admin_ImportLogClient, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) ExportLog(ctx context.Context, opts ...grpc.CallOption) (Admin_ExportLogClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Admin_ServiceDesc.Streams[0], "/log.v1.Admin/ExportLog", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminExportLogClient{stream}
+	return x, nil
+}
+
+type Admin_ExportLogClient interface {
+	Send(*ExportLogRequest) error
+	Recv() (*ExportLogResponse, error)
+	grpc.ClientStream
+}
+
+type adminExportLogClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminExportLogClient) Send(m *ExportLogRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *adminExportLogClient) Recv() (*ExportLogResponse, error) {
+	m := new(ExportLogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *adminClient) ImportLog(ctx context.Context, in *ImportLogRequest, opts ...grpc.CallOption) (Admin_ImportLogClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Admin_ServiceDesc.Streams[1], "/log.v1.Admin/ImportLog", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &adminImportLogClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Admin_ImportLogClient interface {
+	Recv() (*ImportLogResponse, error)
+	grpc.ClientStream
+}
+
+type adminImportLogClient struct {
+	grpc.ClientStream
+}
+
+func (x *adminImportLogClient) Recv() (*ImportLogResponse, error) {
+	m := new(ImportLogResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	ExportLog(Admin_ExportLogServer) error
+	ImportLog(*ImportLogRequest, Admin_ImportLogServer) error
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) ExportLog(Admin_ExportLogServer) error {
+	return status.Errorf(codes.Unimplemented, "method ExportLog not implemented")
+}
+func (UnimplementedAdminServer) ImportLog(*ImportLogRequest, Admin_ImportLogServer) error {
+	return status.Errorf(codes.Unimplemented, "method ImportLog not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_ExportLog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(AdminServer).ExportLog(&adminExportLogServer{stream})
+}
+
+type Admin_ExportLogServer interface {
+	Send(*ExportLogResponse) error
+	Recv() (*ExportLogRequest, error)
+	grpc.ServerStream
+}
+
+type adminExportLogServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminExportLogServer) Send(m *ExportLogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *adminExportLogServer) Recv() (*ExportLogRequest, error) {
+	m := new(ExportLogRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _Admin_ImportLog_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ImportLogRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(AdminServer).ImportLog(m, &adminImportLogServer{stream})
+}
+
+type Admin_ImportLogServer interface {
+	Send(*ImportLogResponse) error
+	grpc.ServerStream
+}
+
+type adminImportLogServer struct {
+	grpc.ServerStream
+}
+
+func (x *adminImportLogServer) Send(m *ImportLogResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "log.v1.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "ExportLog",
+			Handler:       _Admin_ExportLog_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "ImportLog",
+			Handler:       _Admin_ImportLog_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/v1/log.proto",
+}
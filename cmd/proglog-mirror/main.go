@@ -0,0 +1,257 @@
+// あるproglogのクラスタのレコードを、別のクラスタに一方向にミラーし続けるプロセス
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/config"
+	"github.com/KeisukeYamane/proglog/internal/loadbalance"
+	"github.com/KeisukeYamane/proglog/internal/logging"
+	"github.com/KeisukeYamane/proglog/internal/mirror"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func main() {
+	// シグナルを受け取ったらミラーを止め、チェックポイントを閉じてから終了する
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := (&cli{}).command().ExecuteContext(ctx); err != nil {
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	source        string
+	target        string
+	sourceToken   string
+	targetToken   string
+	checkpointDir string
+	name          string
+	startOffset   uint64
+	matchValue    string
+	skipValue     string
+	matchHeaders  []string
+	logLevel      string
+
+	useTLS bool
+	tls    config.TLSConfig
+}
+
+func (c *cli) command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proglog-mirror",
+		Short: "Mirror records from one proglog cluster to another",
+		Long: `Consume records from the source cluster and produce them to the target
+cluster until interrupted.
+
+The source-to-target offset of every mirrored record is saved in the
+checkpoint log in --checkpoint-dir; use the translate command to turn a
+position committed on the source into one on the target. Mirrored records carry
+the mirror name and their source offset in the proglog-mirror and
+proglog-mirror-source-offset headers, which lets a restarted mirror find
+records written after its last checkpoint and resume without duplicates. If
+the target has already truncated the records after the last checkpoint, the
+mirror exits with an error instead of guessing where to resume.
+
+Records are filtered with --match-value, --skip-value and --match-header; a
+record is mirrored only if it passes all of them. Addresses may use
+proglog:///ADDR,ADDR... to discover a cluster from seed servers.`,
+		Args:         cobra.NoArgs,
+		RunE:         c.run,
+		SilenceUsage: true,
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&c.source, "source", "", "Address of the source cluster.")
+	flags.StringVar(&c.target, "target", "", "Address of the target cluster.")
+	flags.StringVar(&c.sourceToken, "source-token", os.Getenv("PROGLOG_MIRROR_SOURCE_TOKEN"), "Bearer token sent to the source cluster.")
+	flags.StringVar(&c.targetToken, "target-token", os.Getenv("PROGLOG_MIRROR_TARGET_TOKEN"), "Bearer token sent to the target cluster.")
+	flags.StringVar(&c.checkpointDir, "checkpoint-dir", "", "Directory of the checkpoint log of offset mappings.")
+	flags.StringVar(&c.name, "name", "mirror", "Name of this mirror, written to the headers of mirrored records.")
+	flags.Uint64Var(&c.startOffset, "start-offset", 0, "Source offset to start from when the checkpoint is empty.")
+	flags.StringVar(&c.matchValue, "match-value", "", "Mirror only records whose value matches this regular expression.")
+	flags.StringVar(&c.skipValue, "skip-value", "", "Do not mirror records whose value matches this regular expression.")
+	flags.StringArrayVar(&c.matchHeaders, "match-header", nil, "Mirror only records with this KEY=VALUE header. Repeatable.")
+	flags.StringVar(&c.logLevel, "log-level", "info", "Log level: debug, info, warn or error.")
+	flags.BoolVar(&c.useTLS, "tls", false, "Connect to both clusters with TLS using the system root CAs.")
+	flags.StringVar(&c.tls.CAFile, "tls-ca", "", "CA certificate used to verify the servers.")
+	flags.StringVar(&c.tls.CertFile, "tls-cert", "", "Client certificate presented to the servers.")
+	flags.StringVar(&c.tls.KeyFile, "tls-key", "", "Private key of the client certificate.")
+	for _, name := range []string{"source", "target", "checkpoint-dir"} {
+		cmd.MarkFlagRequired(name)
+	}
+
+	cmd.AddCommand(translateCommand())
+
+	return cmd
+}
+
+func (c *cli) run(cmd *cobra.Command, args []string) error {
+	filter, err := c.filter()
+	if err != nil {
+		return err
+	}
+	logger, err := logging.New(logging.Config{Level: c.logLevel})
+	if err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	defer logger.Sync()
+
+	source, closeSource, err := c.dial(c.source, c.sourceToken)
+	if err != nil {
+		return err
+	}
+	defer closeSource()
+	target, closeTarget, err := c.dial(c.target, c.targetToken)
+	if err != nil {
+		return err
+	}
+	defer closeTarget()
+
+	checkpoint, err := mirror.OpenCheckpoint(c.checkpointDir)
+	if err != nil {
+		return fmt.Errorf("checkpoint-dir: %w", err)
+	}
+	defer checkpoint.Close()
+
+	m := &mirror.Mirror{
+		Source:      source,
+		Target:      target,
+		Checkpoint:  checkpoint,
+		Name:        c.name,
+		Filter:      filter,
+		StartOffset: c.startOffset,
+		Logger:      logger,
+	}
+
+	return m.Run(cmd.Context())
+}
+
+// フィルターのフラグを全て満たすレコードだけを通す関数 フラグがない場合はnil
+func (c *cli) filter() (func(*api.Record) bool, error) {
+	var filters []func(*api.Record) bool
+
+	if c.matchValue != "" {
+		re, err := regexp.Compile(c.matchValue)
+		if err != nil {
+			return nil, fmt.Errorf("match-value: %w", err)
+		}
+		filters = append(filters, func(r *api.Record) bool { return re.Match(r.Value) })
+	}
+	if c.skipValue != "" {
+		re, err := regexp.Compile(c.skipValue)
+		if err != nil {
+			return nil, fmt.Errorf("skip-value: %w", err)
+		}
+		filters = append(filters, func(r *api.Record) bool { return !re.Match(r.Value) })
+	}
+	for _, h := range c.matchHeaders {
+		i := strings.Index(h, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("match-header %q: must be KEY=VALUE", h)
+		}
+		key, value := h[:i], h[i+1:]
+		filters = append(filters, func(r *api.Record) bool { return r.Headers[key] == value })
+	}
+
+	if len(filters) == 0 {
+		return nil, nil
+	}
+
+	return func(r *api.Record) bool {
+		for _, f := range filters {
+			if !f(r) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// クラスタに接続したクライアントを返す 呼び出し側で返り値の関数を呼び出して接続を閉じる
+func (c *cli) dial(addr, token string) (api.LogClient, func() error, error) {
+	creds := insecure.NewCredentials()
+	if c.useTLS || c.tls.CAFile != "" || c.tls.CertFile != "" || c.tls.KeyFile != "" {
+		tlsConfig, err := config.SetupTLSConfig(c.tls)
+		if err != nil {
+			return nil, nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(token)))
+	}
+	// proglog:///のアドレスでは、シードへの問い合わせにも同じ認証情報を使う
+	opts = append(opts, grpc.WithResolvers(&loadbalance.Builder{DialOptions: opts}))
+
+	cc, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("dial %s: %w", addr, err)
+	}
+
+	return api.NewLogClient(cc), cc.Close, nil
+}
+
+// 「authorization: Bearer <token>」をRPCごとに送信する
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+func translateCommand() *cobra.Command {
+	var checkpointDir string
+
+	cmd := &cobra.Command{
+		Use:   "translate SOURCE_OFFSET",
+		Short: "Print the target offset to resume from for a source offset",
+		Long: `Print the offset on the target cluster from which a consumer that would
+resume at SOURCE_OFFSET on the source cluster should resume instead.
+
+The checkpoint can be read while the mirror is running, but the newest
+mappings only become visible once the mirror flushes them.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			source, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				return fmt.Errorf("invalid offset %q: must be a non-negative integer", args[0])
+			}
+
+			checkpoint, err := mirror.OpenCheckpointReadOnly(checkpointDir)
+			if err != nil {
+				return fmt.Errorf("checkpoint-dir: %w", err)
+			}
+			defer checkpoint.Close()
+
+			target, err := checkpoint.Translate(source)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintln(cmd.OutOrStdout(), target)
+
+			return err
+		},
+	}
+	cmd.Flags().StringVar(&checkpointDir, "checkpoint-dir", "", "Directory of the checkpoint log of offset mappings.")
+	cmd.MarkFlagRequired("checkpoint-dir")
+
+	return cmd
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/KeisukeYamane/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+)
+
+// テスト用のサーバーを起動し、ログとアドレスを返す
+func setupServer(t *testing.T) (*log.Log, string) {
+	t.Helper()
+
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	gsrv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	t.Cleanup(func() {
+		gsrv.Stop()
+		clog.Close()
+	})
+
+	return clog, l.Addr().String()
+}
+
+// ctxがキャンセルされるまでコマンドを実行し、標準出力を返す
+func run(ctx context.Context, args ...string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := (&cli{}).command()
+	cmd.SetArgs(args)
+	cmd.SetOut(&stdout)
+	cmd.SetErr(io.Discard)
+	err := cmd.ExecuteContext(ctx)
+
+	return stdout.String(), err
+}
+
+func TestMirror(t *testing.T) {
+	sourceLog, source := setupServer(t)
+	targetLog, target := setupServer(t)
+	for _, record := range []*api.Record{
+		{Value: []byte("order 1"), Headers: map[string]string{"region": "us"}},
+		{Value: []byte("order 2"), Headers: map[string]string{"region": "eu"}},
+		{Value: []byte("debug"), Headers: map[string]string{"region": "us"}},
+		{Value: []byte("order 3"), Headers: map[string]string{"region": "us"}},
+	} {
+		_, err := sourceLog.Append(record)
+		require.NoError(t, err)
+	}
+	checkpointDir := t.TempDir()
+
+	args := []string{
+		"--source", source,
+		"--target", target,
+		"--checkpoint-dir", checkpointDir,
+		"--match-header", "region=us",
+		"--skip-value", "^debug$",
+		"--log-level", "error",
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		_, err := run(ctx, args...)
+		errc <- err
+	}()
+	require.Eventually(t, func() bool {
+		record, err := targetLog.Read(1)
+		return err == nil && string(record.Value) == "order 3"
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+	require.NoError(t, <-errc)
+
+	// 止めた時に最後の対応を保存していなくても、起動し直すと書き込み先から補い、同じレコードを書き込まない
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err := run(ctx, args...)
+	require.NoError(t, err)
+
+	record, err := targetLog.Read(0)
+	require.NoError(t, err)
+	require.Equal(t, "order 1", string(record.Value))
+	_, err = targetLog.Read(2)
+	require.Error(t, err)
+
+	for source, want := range map[string]string{
+		"0": "0\n",
+		"1": "1\n",
+		"3": "1\n",
+		"4": "2\n",
+	} {
+		out, err := run(context.Background(), "translate", "--checkpoint-dir", checkpointDir, source)
+		require.NoError(t, err)
+		require.Equal(t, want, out, "source offset %s", source)
+	}
+}
+
+func TestInvalidFlags(t *testing.T) {
+	_, err := run(context.Background())
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "required flag(s)")
+
+	_, err = run(context.Background(), "--source", "a:1", "--target", "b:1", "--checkpoint-dir", t.TempDir(), "--match-header", "region")
+	require.EqualError(t, err, `match-header "region": must be KEY=VALUE`)
+
+	_, err = run(context.Background(), "translate", "--checkpoint-dir", t.TempDir(), "x")
+	require.EqualError(t, err, `invalid offset "x": must be a non-negative integer`)
+}
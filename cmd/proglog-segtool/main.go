@@ -0,0 +1,243 @@
+// ディスク上のセグメントファイル(<base>.store と <base>.index)を調べ、修復するツール
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/spf13/cobra"
+)
+
+func main() {
+	if err := command().Execute(); err != nil {
+		os.Exit(1)
+	}
+}
+
+func command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proglog-segtool",
+		Short: "Inspect and repair proglog segment files offline",
+		Long: `Inspect and repair the <base>.store and <base>.index files in a proglog log
+directory without opening the Log.
+
+rebuild-index takes the directory's exclusive lock and refuses to run while an
+agent has the log open: a running agent keeps the index memory-mapped and would
+overwrite the rebuilt file.`,
+		SilenceUsage: true,
+	}
+	cmd.AddCommand(
+		listCommand(),
+		dumpCommand(),
+		verifyCommand(),
+		rebuildIndexCommand(),
+	)
+
+	return cmd
+}
+
+func listCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "list DIR",
+		Short: "List segments with their offsets and file sizes",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			segments, err := log.ListSegments(args[0])
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "BASE\tNEXT\tRECORDS\tSTORE BYTES\tINDEX BYTES")
+			for _, s := range segments {
+				fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n",
+					s.BaseOffset, s.NextOffset, s.Entries,
+					size(s.StorePath, s.StoreBytes), size(s.IndexPath, s.IndexBytes),
+				)
+			}
+
+			return w.Flush()
+		},
+	}
+}
+
+// ファイルがない場合はサイズの代わりにmissingと表示する
+func size(path string, n int64) string {
+	if path == "" {
+		return "missing"
+	}
+
+	return strconv.FormatInt(n, 10)
+}
+
+func dumpCommand() *cobra.Command {
+	var full bool
+
+	cmd := &cobra.Command{
+		Use:   "dump DIR BASE",
+		Short: "Print every record in a segment's store with its offset and position",
+		Long: `Print every frame in <BASE>.store in order with the record's offset, the
+frame's position in the store file, the record size and the value. Values are
+quoted and cut to 64 bytes unless --full is given.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			base, err := parseBase(args[1])
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 4, 2, ' ', 0)
+			fmt.Fprintln(w, "OFFSET\tPOSITION\tSIZE\tVALUE")
+			err = log.ScanStore(storePath(args[0], base), func(f log.Frame) error {
+				if f.Err != nil {
+					_, err := fmt.Fprintf(w, "?\t%d\t%d\t<undecodable: %v>\n", f.Position, f.Size, f.Err)
+					return err
+				}
+				value := f.Record.Value
+				if !full && len(value) > 64 {
+					value = value[:64]
+				}
+				_, err := fmt.Fprintf(w, "%d\t%d\t%d\t%q\n", f.Record.Offset, f.Position, f.Size, value)
+				return err
+			})
+			if flushErr := w.Flush(); err == nil {
+				err = flushErr
+			}
+
+			return err
+		},
+	}
+	cmd.Flags().BoolVar(&full, "full", false, "Print values without cutting them.")
+
+	return cmd
+}
+
+func verifyCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "verify DIR [BASE...]",
+		Short: "Check that every index entry points at a valid store frame",
+		Long: `Check that every index entry points at the start of a decodable store frame
+holding the expected offset, and that no store frame is left unindexed. Without
+BASE, every segment in DIR is checked. Exits non-zero if a problem is found.`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bases, err := segmentBases(args[0], args[1:])
+			if err != nil {
+				return err
+			}
+
+			total := 0
+			out := cmd.OutOrStdout()
+			for _, base := range bases {
+				problems, err := log.VerifySegment(args[0], base)
+				if err != nil {
+					return fmt.Errorf("segment %d: %w", base, err)
+				}
+				if len(problems) == 0 {
+					fmt.Fprintf(out, "segment %d: ok\n", base)
+					continue
+				}
+				for _, p := range problems {
+					fmt.Fprintf(out, "segment %d: %s\n", base, p)
+				}
+				total += len(problems)
+			}
+			if total > 0 {
+				return fmt.Errorf("found %d problems; run rebuild-index to repair an index", total)
+			}
+
+			return nil
+		},
+	}
+}
+
+func rebuildIndexCommand() *cobra.Command {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "rebuild-index DIR BASE",
+		Short: "Rebuild a missing or corrupt index from the store",
+		Long: `Rebuild <BASE>.index from the frames in <BASE>.store. A truncated frame at the
+end of the store is left out of the index. The index is only replaced when
+verify finds a problem, unless --force is given.`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir := args[0]
+			base, err := parseBase(args[1])
+			if err != nil {
+				return err
+			}
+
+			// 稼働中のエージェントが開いているディレクトリのインデックスは置き換えない
+			lock, err := log.LockDir(dir, true)
+			if err != nil {
+				return err
+			}
+			defer lock.Close()
+
+			if !force {
+				problems, err := log.VerifySegment(dir, base)
+				if err != nil {
+					return err
+				}
+				if len(problems) == 0 {
+					fmt.Fprintf(cmd.OutOrStdout(), "segment %d: index is consistent, nothing to do (use --force to rebuild anyway)\n", base)
+					return nil
+				}
+			}
+
+			n, err := log.RebuildIndex(dir, base)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "segment %d: rebuilt index with %d entries\n", base, n)
+
+			return nil
+		},
+	}
+	cmd.Flags().BoolVar(&force, "force", false, "Rebuild even if the index looks consistent.")
+
+	return cmd
+}
+
+// 引数で指定されたベースオフセット、指定がない場合はdir内の全てのセグメントのベースオフセットを返す
+func segmentBases(dir string, args []string) ([]uint64, error) {
+	var bases []uint64
+	if len(args) == 0 {
+		segments, err := log.ListSegments(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range segments {
+			bases = append(bases, s.BaseOffset)
+		}
+		return bases, nil
+	}
+
+	for _, arg := range args {
+		base, err := parseBase(arg)
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, base)
+	}
+
+	return bases, nil
+}
+
+func parseBase(s string) (uint64, error) {
+	base, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid base offset %q: must be a non-negative integer", s)
+	}
+
+	return base, nil
+}
+
+func storePath(dir string, base uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%d.store", base))
+}
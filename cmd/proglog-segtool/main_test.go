@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+func run(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	cmd := command()
+	cmd.SetArgs(args)
+	cmd.SetOut(&out)
+	cmd.SetErr(io.Discard)
+	err := cmd.Execute()
+
+	return out.String(), err
+}
+
+func TestSegtool(t *testing.T) {
+	dir := t.TempDir()
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 12 * 2
+	l, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	for _, v := range []string{"first", "second", "third"} {
+		_, err := l.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	out, err := run(t, "list", dir)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	require.Len(t, lines, 3)
+	require.Equal(t, []string{"0", "2", "2"}, strings.Fields(lines[1])[:3])
+	require.Equal(t, []string{"2", "3", "1"}, strings.Fields(lines[2])[:3])
+
+	out, err = run(t, "dump", dir, "0")
+	require.NoError(t, err)
+	require.Contains(t, out, `"first"`)
+	require.Contains(t, out, `"second"`)
+	require.Equal(t, "1", strings.Fields(strings.Split(out, "\n")[2])[0])
+
+	out, err = run(t, "verify", dir)
+	require.NoError(t, err)
+	require.Equal(t, "segment 0: ok\nsegment 2: ok\n", out)
+
+	out, err = run(t, "rebuild-index", dir, "0")
+	require.NoError(t, err)
+	require.Contains(t, out, "nothing to do")
+
+	// インデックスを失ったセグメントを検出し、ストアから作り直す
+	require.NoError(t, os.Remove(filepath.Join(dir, "2.index")))
+	out, err = run(t, "list", dir)
+	require.NoError(t, err)
+	require.Contains(t, out, "missing")
+
+	out, err = run(t, "verify", dir)
+	require.EqualError(t, err, "found 1 problems; run rebuild-index to repair an index")
+	require.Contains(t, out, "segment 2: index file is missing")
+
+	out, err = run(t, "rebuild-index", dir, "2")
+	require.NoError(t, err)
+	require.Equal(t, "segment 2: rebuilt index with 1 entries\n", out)
+
+	_, err = run(t, "verify", dir, "2")
+	require.NoError(t, err)
+
+	_, err = run(t, "dump", dir, "x")
+	require.EqualError(t, err, `invalid base offset "x": must be a non-negative integer`)
+}
+
+func TestRebuildIndexLocked(t *testing.T) {
+	dir := t.TempDir()
+	l, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = run(t, "rebuild-index", "--force", dir, "0")
+	require.ErrorIs(t, err, log.ErrLocked)
+}
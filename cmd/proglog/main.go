@@ -0,0 +1,176 @@
+// proglogのエージェント ログを開いてgRPCサーバーとHTTPサーバーを起動する
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/KeisukeYamane/proglog/internal/agent"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// 環境変数のプレフィックス data-dir は PROGLOG_DATA_DIR で上書きできる
+const envPrefix = "PROGLOG"
+
+func main() {
+	c := &cli{}
+	if err := c.command().Execute(); err != nil {
+		// エラーの内容はcobraが出力している
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	v   *viper.Viper
+	cfg agent.Config
+}
+
+func (c *cli) command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proglog",
+		Short: "Run a proglog agent",
+		Long: `Run a proglog agent serving the Log over gRPC and HTTP.
+
+Configuration is read, from lowest to highest precedence, from flag defaults,
+the file given by --config-file (YAML or TOML), PROGLOG_* environment
+variables (e.g. PROGLOG_DATA_DIR), and command-line flags.`,
+		PreRunE:      c.setupConfig,
+		RunE:         c.run,
+		SilenceUsage: true,
+	}
+	c.v = viper.New()
+	setupFlags(cmd.Flags())
+
+	return cmd
+}
+
+func setupFlags(flags *pflag.FlagSet) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+	dataDir := filepath.Join(os.TempDir(), "proglog")
+
+	flags.String("config-file", "", "Path to a YAML or TOML config file.")
+	flags.String("data-dir", dataDir, "Directory to store log data.")
+	flags.String("bind-addr", hostname+":8400", "Address to serve gRPC on.")
+	flags.String("advertise-addr", "", "Address other nodes and clients use to reach this node. Empty uses bind-addr.")
+	flags.String("http-addr", "", "Address to serve HTTP on. Empty shares the gRPC port.")
+
+	flags.Uint64("segment-max-store-bytes", 64<<20, "Maximum size of a segment's store file.")
+	flags.Uint64("segment-max-index-bytes", 1<<20, "Maximum size of a segment's index file.")
+	flags.Uint64("segment-initial-offset", 0, "Offset of the first record in a new log.")
+
+	flags.String("log-level", "info", "Log level: debug, info, warn or error.")
+	flags.Bool("log-development", false, "Write human-readable logs instead of JSON.")
+	flags.Int("log-sampling-initial", 100, "Log the first N identical entries per second.")
+	flags.Int("log-sampling-thereafter", 100, "Then log every Nth identical entry in that second.")
+
+	flags.String("auth-jwks-file", "", "JWKS file used to verify bearer tokens.")
+	flags.String("auth-key-file", "", "PEM public key or HMAC secret used to verify bearer tokens.")
+	flags.String("auth-api-key-file", "", "File of \"<key> <subject>\" lines accepted as bearer tokens.")
+	flags.String("auth-issuer", "", "Required JWT issuer.")
+	flags.String("auth-audience", "", "Required JWT audience.")
+
+	flags.Bool("enable-reflection", false, "Enable gRPC server reflection.")
+	flags.Duration("drain-timeout", 0, "How long to wait for in-flight RPCs on shutdown (0 means 10s).")
+
+	flags.String("primary-addr", "", "gRPC address of the only node accepting writes. Empty accepts writes here.")
+	flags.String("secondary-writes", "forward", "What a non-primary node does with writes: forward or redirect.")
+	flags.StringSlice("servers", nil, "Cluster servers as ID=ADDR, including this one, reported by GetServers.")
+	flags.Bool("enable-admin", false, "Serve the Admin service used to migrate the log to or from this node.")
+	flags.StringSlice("admin-subjects", nil, "Authenticated subjects allowed to call the Admin service.")
+}
+
+/*
+フラグ、環境変数、設定ファイルの順に優先して設定を読み込む
+設定ファイルに未知のキーがある場合は、書き間違いに気づけるようにエラーにする
+*/
+func (c *cli) setupConfig(cmd *cobra.Command, args []string) error {
+	v := c.v
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+	v.SetEnvPrefix(envPrefix)
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+
+	if file := v.GetString("config-file"); file != "" {
+		switch ext := strings.TrimPrefix(filepath.Ext(file), "."); ext {
+		case "yaml", "yml", "toml":
+		default:
+			return fmt.Errorf("config file %s: unsupported type %q (use .yaml, .yml or .toml)", file, ext)
+		}
+		v.SetConfigFile(file)
+		if err := v.ReadInConfig(); err != nil {
+			return fmt.Errorf("read config file %s: %w", file, err)
+		}
+		for _, key := range v.AllKeys() {
+			if cmd.Flags().Lookup(key) == nil {
+				return fmt.Errorf("unknown key %q in config file %s", key, file)
+			}
+		}
+	}
+
+	c.cfg.DataDir = v.GetString("data-dir")
+	c.cfg.BindAddr = v.GetString("bind-addr")
+	c.cfg.AdvertiseAddr = v.GetString("advertise-addr")
+	c.cfg.HTTPBindAddr = v.GetString("http-addr")
+
+	var err error
+	if c.cfg.Segment.MaxStoreBytes, err = getUint64(v, "segment-max-store-bytes"); err != nil {
+		return err
+	}
+	if c.cfg.Segment.MaxIndexBytes, err = getUint64(v, "segment-max-index-bytes"); err != nil {
+		return err
+	}
+	if c.cfg.Segment.InitialOffset, err = getUint64(v, "segment-initial-offset"); err != nil {
+		return err
+	}
+
+	c.cfg.Logging.Level = v.GetString("log-level")
+	c.cfg.Logging.Development = v.GetBool("log-development")
+	c.cfg.Logging.Sampling.Initial = v.GetInt("log-sampling-initial")
+	c.cfg.Logging.Sampling.Thereafter = v.GetInt("log-sampling-thereafter")
+
+	c.cfg.Auth.JWKSFile = v.GetString("auth-jwks-file")
+	c.cfg.Auth.KeyFile = v.GetString("auth-key-file")
+	c.cfg.Auth.APIKeyFile = v.GetString("auth-api-key-file")
+	c.cfg.Auth.Issuer = v.GetString("auth-issuer")
+	c.cfg.Auth.Audience = v.GetString("auth-audience")
+
+	c.cfg.EnableReflection = v.GetBool("enable-reflection")
+	c.cfg.DrainTimeout = v.GetDuration("drain-timeout")
+
+	c.cfg.PrimaryAddr = v.GetString("primary-addr")
+	c.cfg.SecondaryWrites = v.GetString("secondary-writes")
+	c.cfg.Servers = v.GetStringSlice("servers")
+	c.cfg.EnableAdmin = v.GetBool("enable-admin")
+	c.cfg.AdminSubjects = v.GetStringSlice("admin-subjects")
+
+	return c.cfg.Validate()
+}
+
+// viperのGetUint64は不正な値を0として扱うので、誤りを検知できるように自前で変換する
+func getUint64(v *viper.Viper, key string) (uint64, error) {
+	var n uint64
+	raw := fmt.Sprint(v.Get(key))
+	if _, err := fmt.Sscan(raw, &n); err != nil || fmt.Sprint(n) != raw {
+		return 0, fmt.Errorf("%s: %q is not a non-negative integer", key, raw)
+	}
+
+	return n, nil
+}
+
+func (c *cli) run(cmd *cobra.Command, args []string) error {
+	a, err := agent.New(c.cfg)
+	if err != nil {
+		return err
+	}
+
+	return a.Run()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/KeisukeYamane/proglog/internal/agent"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/require"
+)
+
+// エージェントを起動せずに、読み込んだ設定を返す
+func loadConfig(t *testing.T, args ...string) (agent.Config, error) {
+	t.Helper()
+
+	c := &cli{}
+	cmd := c.command()
+	cmd.RunE = func(*cobra.Command, []string) error { return nil }
+	cmd.SetArgs(args)
+	cmd.SetOut(os.Stderr)
+	cmd.SetErr(os.Stderr)
+	err := cmd.Execute()
+
+	return c.cfg, err
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+
+	return path
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	yaml := writeFile(t, "proglog.yaml", `
+data-dir: /from/file
+bind-addr: 127.0.0.1:9000
+http-addr: 127.0.0.1:9001
+segment-max-store-bytes: 2048
+log-level: warn
+drain-timeout: 3s
+`)
+
+	// 設定ファイルの値はデフォルト値より優先する
+	cfg, err := loadConfig(t, "--config-file", yaml)
+	require.NoError(t, err)
+	require.Equal(t, "/from/file", cfg.DataDir)
+	require.Equal(t, "127.0.0.1:9000", cfg.BindAddr)
+	require.Equal(t, "127.0.0.1:9001", cfg.HTTPBindAddr)
+	require.Equal(t, uint64(2048), cfg.Segment.MaxStoreBytes)
+	require.Equal(t, uint64(1<<20), cfg.Segment.MaxIndexBytes)
+	require.Equal(t, "warn", cfg.Logging.Level)
+	require.Equal(t, 3*time.Second, cfg.DrainTimeout)
+
+	// 環境変数は設定ファイルより優先する
+	t.Setenv("PROGLOG_DATA_DIR", "/from/env")
+	t.Setenv("PROGLOG_SEGMENT_MAX_STORE_BYTES", "4096")
+	cfg, err = loadConfig(t, "--config-file", yaml)
+	require.NoError(t, err)
+	require.Equal(t, "/from/env", cfg.DataDir)
+	require.Equal(t, uint64(4096), cfg.Segment.MaxStoreBytes)
+	require.Equal(t, "warn", cfg.Logging.Level)
+
+	// フラグは環境変数より優先する
+	cfg, err = loadConfig(t, "--config-file", yaml, "--data-dir", "/from/flag")
+	require.NoError(t, err)
+	require.Equal(t, "/from/flag", cfg.DataDir)
+	require.Equal(t, uint64(4096), cfg.Segment.MaxStoreBytes)
+}
+
+func TestConfigTOML(t *testing.T) {
+	toml := writeFile(t, "proglog.toml", `
+data-dir = "/from/toml"
+bind-addr = "127.0.0.1:9000"
+enable-reflection = true
+`)
+
+	cfg, err := loadConfig(t, "--config-file", toml)
+	require.NoError(t, err)
+	require.Equal(t, "/from/toml", cfg.DataDir)
+	require.True(t, cfg.EnableReflection)
+}
+
+func TestConfigErrors(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		"unknown key in config file": {
+			args: []string{"--config-file", writeFile(t, "typo.yaml", "data-dri: /tmp\n")},
+			want: `unknown key "data-dri"`,
+		},
+		"missing config file": {
+			args: []string{"--config-file", "/does/not/exist.yaml"},
+			want: "read config file /does/not/exist.yaml",
+		},
+		"unsupported config file type": {
+			args: []string{"--config-file", writeFile(t, "proglog.ini", "")},
+			want: `unsupported type "ini"`,
+		},
+		"invalid bind address": {
+			args: []string{"--bind-addr", "8400"},
+			want: `bind-addr "8400"`,
+		},
+		"invalid number in env": {
+			env:  map[string]string{"PROGLOG_SEGMENT_MAX_INDEX_BYTES": "1MB"},
+			want: `segment-max-index-bytes: "1MB" is not a non-negative integer`,
+		},
+		"index too small": {
+			args: []string{"--segment-max-index-bytes", "4"},
+			want: "segment-max-index-bytes must be at least 12",
+		},
+		"missing key file": {
+			args: []string{"--auth-key-file", "/does/not/exist.pem"},
+			want: "auth-key-file",
+		},
+		"unknown flag": {
+			args: []string{"--data-dri", "/tmp"},
+			want: "unknown flag: --data-dri",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			_, err := loadConfig(t, tc.args...)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.want)
+		})
+	}
+}
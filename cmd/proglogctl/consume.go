@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func (c *cli) consumeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "consume OFFSET",
+		Short: "Print the record at an offset",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			offset, err := parseOffset(args[0])
+			if err != nil {
+				return err
+			}
+
+			return c.consumeRange(cmd, offset, offset, true)
+		},
+	}
+}
+
+func (c *cli) rangeCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "range FROM [TO]",
+		Short: "Print the records from FROM to TO inclusive",
+		Long: `Print the records from FROM to TO inclusive. Without TO, print every record
+from FROM up to the end of the log and exit.`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := parseOffset(args[0])
+			if err != nil {
+				return err
+			}
+			if len(args) == 1 {
+				return c.consumeRange(cmd, from, ^uint64(0), false)
+			}
+
+			to, err := parseOffset(args[1])
+			if err != nil {
+				return err
+			}
+			if to < from {
+				return fmt.Errorf("TO (%d) is before FROM (%d)", to, from)
+			}
+
+			return c.consumeRange(cmd, from, to, true)
+		},
+	}
+}
+
+func (c *cli) tailCommand() *cobra.Command {
+	var (
+		from   uint64
+		follow bool
+	)
+
+	cmd := &cobra.Command{
+		Use:   "tail",
+		Short: "Print records from an offset, optionally following new ones",
+		Long: `Print records from --from up to the end of the log. With -f, keep the
+ConsumeStream open and print records as they are appended until interrupted.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if !follow {
+				return c.consumeRange(cmd, from, ^uint64(0), false)
+			}
+
+			return c.follow(cmd, from)
+		},
+	}
+	cmd.Flags().Uint64Var(&from, "from", 0, "Offset of the first record to print.")
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "Keep printing records as they are appended.")
+
+	return cmd
+}
+
+/*
+fromからtoまでのレコードをConsumeで一件ずつ読み出して出力する
+strictがfalseの場合は、ログの末尾(範囲外のオフセット)に達した時点で正常に終了する
+*/
+func (c *cli) consumeRange(cmd *cobra.Command, from, to uint64, strict bool) error {
+	p, err := newPrinter(cmd.OutOrStdout(), c.output)
+	if err != nil {
+		return err
+	}
+	client, closeConn, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	for offset := from; ; offset++ {
+		res, err := client.Consume(cmd.Context(), &api.ConsumeRequest{Offset: offset})
+		if err != nil {
+			if isOutOfRange(err) && !strict {
+				return nil
+			}
+			return describe(err, offset)
+		}
+		if err := p.record(res.Record); err != nil {
+			return err
+		}
+		if offset == to {
+			return nil
+		}
+	}
+}
+
+// ConsumeStreamで受け取ったレコードを、中断されるまで出力し続ける
+func (c *cli) follow(cmd *cobra.Command, from uint64) error {
+	p, err := newPrinter(cmd.OutOrStdout(), c.output)
+	if err != nil {
+		return err
+	}
+	client, closeConn, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	ctx := cmd.Context()
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: from})
+	if err != nil {
+		return describe(err, from)
+	}
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			// Ctrl-Cによる中断は正常終了として扱う
+			if ctx.Err() == context.Canceled {
+				return nil
+			}
+			return describe(err, from)
+		}
+		if err := p.record(res.Record); err != nil {
+			return err
+		}
+	}
+}
+
+func parseOffset(s string) (uint64, error) {
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid offset %q: must be a non-negative integer", s)
+	}
+
+	return offset, nil
+}
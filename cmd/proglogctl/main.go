@@ -0,0 +1,160 @@
+// proglogのコマンドラインクライアント レコードの書き込み、読み出し、追跡(tail -f)、クラスタの状態の表示と、ノード間のログの移行を行う
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/config"
+	"github.com/KeisukeYamane/proglog/internal/loadbalance"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+func main() {
+	// Ctrl-Cでtail -fなどを止められるように、シグナルを受け取ったらコンテキストをキャンセルする
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := newCLI().command().ExecuteContext(ctx); err != nil {
+		os.Exit(1)
+	}
+}
+
+type cli struct {
+	addr   string
+	token  string
+	output string
+
+	useTLS bool
+	tls    config.TLSConfig
+}
+
+func newCLI() *cli {
+	return &cli{}
+}
+
+func (c *cli) command() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "proglogctl",
+		Short: "Produce and consume records on a proglog server",
+		Long: `Produce and consume records on a proglog server over gRPC.
+
+The server address and bearer token default to the PROGLOGCTL_ADDR and
+PROGLOGCTL_TOKEN environment variables. Use proglog:///ADDR,ADDR... to
+discover the cluster from seed servers, send writes to the primary and spread
+reads across the other servers. TLS is used when --tls or any of the
+--tls-* flags is given; pass --tls-cert and --tls-key to present a client
+certificate.`,
+		SilenceUsage: true,
+	}
+
+	addr := os.Getenv("PROGLOGCTL_ADDR")
+	if addr == "" {
+		addr = "localhost:8400"
+	}
+
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&c.addr, "addr", addr, "Address of the proglog server.")
+	flags.StringVar(&c.token, "token", os.Getenv("PROGLOGCTL_TOKEN"), "Bearer token (JWT or API key) sent with each RPC.")
+	flags.StringVarP(&c.output, "output", "o", formatRaw, "Output format: raw, json or hex.")
+	flags.BoolVar(&c.useTLS, "tls", false, "Connect with TLS using the system root CAs.")
+	flags.StringVar(&c.tls.CAFile, "tls-ca", "", "CA certificate used to verify the server.")
+	flags.StringVar(&c.tls.CertFile, "tls-cert", "", "Client certificate presented to the server.")
+	flags.StringVar(&c.tls.KeyFile, "tls-key", "", "Private key of the client certificate.")
+	flags.StringVar(&c.tls.ServerAddress, "tls-server-name", "", "Server name to verify instead of the host in --addr.")
+
+	cmd.AddCommand(
+		c.produceCommand(),
+		c.consumeCommand(),
+		c.rangeCommand(),
+		c.tailCommand(),
+		c.serversCommand(),
+		c.importLogCommand(),
+	)
+
+	return cmd
+}
+
+// サーバーに接続したクライアントを返す 呼び出し側で返り値の関数を呼び出して接続を閉じる
+func (c *cli) client() (api.LogClient, func() error, error) {
+	cc, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return api.NewLogClient(cc), cc.Close, nil
+}
+
+// サーバーの管理用のクライアントを返す 呼び出し側で返り値の関数を呼び出して接続を閉じる
+func (c *cli) adminClient() (api.AdminClient, func() error, error) {
+	cc, err := c.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return api.NewAdminClient(cc), cc.Close, nil
+}
+
+func (c *cli) dial() (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if c.useTLS || c.tls.CAFile != "" || c.tls.CertFile != "" || c.tls.KeyFile != "" || c.tls.ServerAddress != "" {
+		tlsConfig, err := config.SetupTLSConfig(c.tls)
+		if err != nil {
+			return nil, err
+		}
+		creds = credentials.NewTLS(tlsConfig)
+	}
+
+	opts := []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	if c.token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(bearerToken(c.token)))
+	}
+
+	// proglog:///のアドレスでは、シードへの問い合わせにも同じ認証情報を使う
+	opts = append(opts, grpc.WithResolvers(&loadbalance.Builder{DialOptions: opts}))
+
+	cc, err := grpc.Dial(c.addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", c.addr, err)
+	}
+
+	return cc, nil
+}
+
+// 「authorization: Bearer <token>」をRPCごとに送信する
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// ローカルでの動作確認のために、TLSを使わない接続でも送信する
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
+// ログの範囲外のオフセットを読み出そうとした場合のエラーか
+func isOutOfRange(err error) bool {
+	return status.Code(err) == api.ErrOffsetOutOfRange{}.GRPCStatus().Code()
+}
+
+// ログの範囲外であることがわかるメッセージに置き換える
+func describe(err error, offset uint64) error {
+	if isOutOfRange(err) {
+		return fmt.Errorf("offset %d is out of range", offset)
+	}
+	if st, ok := status.FromError(err); ok && st.Code() != codes.Unknown {
+		return fmt.Errorf("%s: %s", st.Code(), st.Message())
+	}
+
+	return err
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/KeisukeYamane/proglog/internal/config"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/KeisukeYamane/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// テスト用のサーバーを起動し、アドレスを返す
+func setupServer(t *testing.T, opts ...grpc.ServerOption) string {
+	t.Helper()
+
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	gsrv, err := server.NewGRPCServer(&server.Config{
+		CommitLog:   clog,
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		EnableAdmin: true,
+	}, opts...)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	t.Cleanup(func() {
+		gsrv.Stop()
+		clog.Close()
+	})
+
+	return l.Addr().String()
+}
+
+// コマンドを実行し、標準出力を返す
+func run(t *testing.T, stdin string, args ...string) (string, error) {
+	t.Helper()
+
+	var stdout bytes.Buffer
+	cmd := newCLI().command()
+	cmd.SetArgs(args)
+	cmd.SetIn(strings.NewReader(stdin))
+	cmd.SetOut(&stdout)
+	cmd.SetErr(io.Discard)
+	err := cmd.Execute()
+
+	return stdout.String(), err
+}
+
+func TestProduceConsume(t *testing.T) {
+	addr := setupServer(t)
+
+	out, err := run(t, "first\nsecond\nthird", "--addr", addr, "produce")
+	require.NoError(t, err)
+	require.Equal(t, "0\n1\n2\n", out)
+
+	// 長さで区切った値は改行を含められる
+	var buf bytes.Buffer
+	for _, v := range []string{"multi\nline", "\x00\x01"} {
+		var n [binary.MaxVarintLen64]byte
+		buf.Write(n[:binary.PutUvarint(n[:], uint64(len(v)))])
+		buf.WriteString(v)
+	}
+	file := filepath.Join(t.TempDir(), "records.bin")
+	require.NoError(t, os.WriteFile(file, buf.Bytes(), 0600))
+	out, err = run(t, "", "--addr", addr, "produce", "-d", "length", "-o", "json", file)
+	require.NoError(t, err)
+	require.Equal(t, "{\"offset\":3}\n{\"offset\":4}\n", out)
+
+	out, err = run(t, "", "--addr", addr, "consume", "1")
+	require.NoError(t, err)
+	require.Equal(t, "second\n", out)
+
+	out, err = run(t, "", "--addr", addr, "consume", "4", "-o", "hex")
+	require.NoError(t, err)
+	require.Equal(t, "0001\n", out)
+
+	out, err = run(t, "", "--addr", addr, "range", "2", "3", "-o", "json")
+	require.NoError(t, err)
+	var records []jsonRecord
+	dec := json.NewDecoder(strings.NewReader(out))
+	for dec.More() {
+		var r jsonRecord
+		require.NoError(t, dec.Decode(&r))
+		records = append(records, r)
+	}
+	require.Equal(t, []jsonRecord{
+		{Offset: 2, Value: []byte("third")},
+		{Offset: 3, Value: []byte("multi\nline")},
+	}, records)
+
+	// TOを省略するとログの末尾まで出力する
+	out, err = run(t, "", "--addr", addr, "range", "3")
+	require.NoError(t, err)
+	require.Equal(t, "multi\nline\n\x00\x01\n", out)
+
+	out, err = run(t, "", "--addr", addr, "tail", "--from", "2", "-o", "hex")
+	require.NoError(t, err)
+	require.Equal(t, "7468697264\n6d756c74690a6c696e65\n0001\n", out)
+}
+
+func TestErrors(t *testing.T) {
+	addr := setupServer(t)
+
+	_, err := run(t, "", "--addr", addr, "consume", "0")
+	require.EqualError(t, err, "offset 0 is out of range")
+
+	_, err = run(t, "a\nb\n", "--addr", addr, "produce")
+	require.NoError(t, err)
+	_, err = run(t, "", "--addr", addr, "range", "0", "5")
+	require.EqualError(t, err, "offset 2 is out of range")
+
+	_, err = run(t, "", "--addr", addr, "consume", "abc")
+	require.EqualError(t, err, `invalid offset "abc": must be a non-negative integer`)
+
+	_, err = run(t, "", "--addr", addr, "consume", "0", "-o", "yaml")
+	require.EqualError(t, err, `unknown output format "yaml" (use raw, json or hex)`)
+
+	_, err = run(t, "\x05ab", "--addr", addr, "produce", "-d", "length")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "truncated record")
+}
+
+func TestTailFollow(t *testing.T) {
+	addr := setupServer(t)
+
+	_, err := run(t, "before\n", "--addr", addr, "produce")
+	require.NoError(t, err)
+
+	r, w := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		cmd := newCLI().command()
+		cmd.SetArgs([]string{"--addr", addr, "tail", "-f"})
+		cmd.SetOut(w)
+		cmd.SetErr(io.Discard)
+		done <- cmd.ExecuteContext(ctx)
+		w.Close()
+	}()
+
+	lines := bufio.NewScanner(r)
+	require.True(t, lines.Scan())
+	require.Equal(t, "before", lines.Text())
+
+	// 追跡を始めた後に書き込まれたレコードも出力する
+	_, err = run(t, "after\n", "--addr", addr, "produce")
+	require.NoError(t, err)
+	require.True(t, lines.Scan())
+	require.Equal(t, "after", lines.Text())
+
+	cancel()
+	go io.Copy(io.Discard, r)
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("tail -f did not stop on cancel")
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newCert(t, dir, "ca", nil, nil)
+	newCert(t, dir, "server", ca, caKey)
+	newCert(t, dir, "client", ca, caKey)
+
+	serverTLS, err := config.SetupTLSConfig(config.TLSConfig{
+		CertFile: filepath.Join(dir, "server.pem"),
+		KeyFile:  filepath.Join(dir, "server-key.pem"),
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		Server:   true,
+	})
+	require.NoError(t, err)
+	addr := setupServer(t, grpc.Creds(credentials.NewTLS(serverTLS)))
+
+	tlsArgs := []string{"--addr", addr, "--tls-ca", filepath.Join(dir, "ca.pem")}
+
+	// サーバーはクライアント証明書を要求する
+	_, err = run(t, "hello\n", append(tlsArgs, "produce")...)
+	require.Error(t, err)
+
+	clientArgs := append(tlsArgs,
+		"--tls-cert", filepath.Join(dir, "client.pem"),
+		"--tls-key", filepath.Join(dir, "client-key.pem"),
+	)
+	out, err := run(t, "hello\n", append(clientArgs, "produce")...)
+	require.NoError(t, err)
+	require.Equal(t, "0\n", out)
+
+	out, err = run(t, "", append(clientArgs, "consume", "0")...)
+	require.NoError(t, err)
+	require.Equal(t, "hello\n", out)
+}
+
+// parentがnilの場合は自己署名の認証局の証明書を作成する 証明書と鍵は<name>.pemと<name>-key.pemに書き込む
+func newCert(
+	t *testing.T,
+	dir, name string,
+	parent *x509.Certificate,
+	parentKey *ecdsa.PrivateKey,
+) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = tmpl, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	writePEM := func(file, typ string, b []byte) {
+		require.NoError(t, os.WriteFile(
+			filepath.Join(dir, file),
+			pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: b}),
+			0600,
+		))
+	}
+	writePEM(name+".pem", "CERTIFICATE", der)
+	writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+
+	return cert, key
+}
+
+func TestServers(t *testing.T) {
+	addr := setupServer(t)
+
+	_, err := run(t, "a\nb\n", "--addr", addr, "produce")
+	require.NoError(t, err)
+
+	// サーバーの一覧を設定していないサーバーは、自身だけを返す
+	out, err := run(t, "", "--addr", addr, "servers", "-o", "json")
+	require.NoError(t, err)
+	require.Equal(t, `{"id":"","rpc_addr":"","role":"primary","lowest_offset":0,"highest_offset":1}`+"\n", out)
+
+	// proglog:///のアドレスでは、シードから見つけたサーバーに接続する
+	out, err = run(t, "", "--addr", "proglog:///"+addr, "consume", "1")
+	require.NoError(t, err)
+	require.Equal(t, "b\n", out)
+
+	// 設定したサーバーを問い合わせ、応答しなかったサーバーは理由を表示する
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+	gsrv, err := server.NewGRPCServer(&server.Config{
+		CommitLog: clog,
+		Servers: &server.StaticServers{
+			Servers: []server.StaticServer{
+				{ID: "node-1", RPCAddr: addr},
+				{ID: "node-2", RPCAddr: down},
+			},
+			DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		},
+	})
+	require.NoError(t, err)
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	defer gsrv.Stop()
+
+	out, err = run(t, "", "--addr", l.Addr().String(), "servers")
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSuffix(out, "\n"), "\n")
+	require.Len(t, lines, 3)
+	require.Regexp(t, `^ID +ADDRESS +ROLE +LOWEST +HIGHEST +ERROR$`, lines[0])
+	require.Regexp(t, `^node-1 +`+addr+` +primary +0 +1 *$`, lines[1])
+	require.Regexp(t, `^node-2 +`+down+` +- +- +- +\S`, lines[2])
+}
+
+func TestImportLog(t *testing.T) {
+	source, target := setupServer(t), setupServer(t)
+
+	_, err := run(t, "a\nb\nc\n", "--addr", source, "produce")
+	require.NoError(t, err)
+
+	out, err := run(t, "", "--addr", target, "import-log", "--source", source, "--advertise-addr", target)
+	require.NoError(t, err)
+	require.Equal(t, "snapshot 0\ncatch_up 3\nhandover 3\ndone 3\n", out)
+
+	out, err = run(t, "", "--addr", target, "range", "0")
+	require.NoError(t, err)
+	require.Equal(t, "a\nb\nc\n", out)
+
+	// 移行元は書き込みを移行先に向け、移行先は書き込みを受け付ける
+	_, err = run(t, "d\n", "--addr", source, "produce")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), target)
+	out, err = run(t, "d\n", "--addr", target, "produce")
+	require.NoError(t, err)
+	require.Equal(t, "3\n", out)
+
+	// 空でないログには移行しない
+	_, err = run(t, "", "--addr", target, "import-log", "--source", source, "--advertise-addr", target)
+	require.ErrorContains(t, err, "FailedPrecondition")
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"io"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func (c *cli) importLogCommand() *cobra.Command {
+	var req api.ImportLogRequest
+
+	cmd := &cobra.Command{
+		Use:   "import-log",
+		Short: "Move the log of a running server to the server at --addr",
+		Long: `Copy the log of the server at --source to the server at --addr, whose log
+must be empty, and hand writes over to it.
+
+The source keeps accepting writes while its segments are copied and the
+records written meanwhile are caught up; writes pause only for the final
+records. Writes over HTTP are paused the same way. Afterwards the source
+forwards or redirects writes to the new server, and relays writes that other
+servers still forward to it until their --primary-addr points to the new
+server. Both servers remember the handover across restarts. Progress is
+printed as the phase and the next offset of the new log.
+Both servers must run with --enable-admin, and when they authenticate
+requests, the token's subject must be listed in their --admin-subjects.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPrinter(cmd.OutOrStdout(), c.output)
+			if err != nil {
+				return err
+			}
+			client, closeConn, err := c.adminClient()
+			if err != nil {
+				return err
+			}
+			defer closeConn()
+
+			stream, err := client.ImportLog(cmd.Context(), &req)
+			if err != nil {
+				return describe(err, 0)
+			}
+			for {
+				res, err := stream.Recv()
+				if err == io.EOF {
+					return nil
+				}
+				if err != nil {
+					return describe(err, 0)
+				}
+				if err := p.migration(res); err != nil {
+					return err
+				}
+			}
+		},
+	}
+	cmd.Flags().StringVar(&req.SourceAddr, "source", "", "Address of the server to move the log from.")
+	cmd.Flags().StringVar(&req.Addr, "advertise-addr", "", "Address the source sends writes to afterwards. Defaults to the --bind-addr of the server at --addr when it has a primary configured.")
+	cmd.MarkFlagRequired("source")
+
+	return cmd
+}
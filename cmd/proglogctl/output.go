@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+)
+
+const (
+	// レコードの値をそのまま出力し、改行で区切る
+	formatRaw = "raw"
+	// 1行に1つのJSONオブジェクトを出力する 値はHTTPのAPIと同じくbase64で表す
+	formatJSON = "json"
+	// レコードの値を16進数で出力し、改行で区切る(改行やバイナリを含む値の確認用)
+	formatHex = "hex"
+)
+
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+func newPrinter(w io.Writer, format string) (*printer, error) {
+	switch format {
+	case formatRaw, formatJSON, formatHex:
+	default:
+		return nil, fmt.Errorf("unknown output format %q (use raw, json or hex)", format)
+	}
+
+	return &printer{w: w, format: format}, nil
+}
+
+type jsonRecord struct {
+	Offset  uint64            `json:"offset"`
+	Value   []byte            `json:"value"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+func (p *printer) record(record *api.Record) error {
+	var err error
+	switch p.format {
+	case formatRaw:
+		if _, err = p.w.Write(record.Value); err == nil {
+			_, err = io.WriteString(p.w, "\n")
+		}
+	case formatJSON:
+		err = json.NewEncoder(p.w).Encode(jsonRecord{
+			Offset:  record.Offset,
+			Value:   record.Value,
+			Headers: record.Headers,
+		})
+	case formatHex:
+		_, err = fmt.Fprintln(p.w, hex.EncodeToString(record.Value))
+	}
+
+	return err
+}
+
+// 書き込んだレコードのオフセットを出力する
+func (p *printer) offset(offset uint64) error {
+	if p.format == formatJSON {
+		return json.NewEncoder(p.w).Encode(struct {
+			Offset uint64 `json:"offset"`
+		}{offset})
+	}
+	_, err := fmt.Fprintln(p.w, offset)
+
+	return err
+}
+
+type jsonServer struct {
+	ID            string `json:"id"`
+	RPCAddr       string `json:"rpc_addr"`
+	Role          string `json:"role"`
+	LowestOffset  uint64 `json:"lowest_offset"`
+	HighestOffset uint64 `json:"highest_offset"`
+	Error         string `json:"error,omitempty"`
+}
+
+// サーバーの一覧を表で出力する jsonの場合は1行に1サーバーを出力する
+func (p *printer) servers(servers []*api.Server) error {
+	if p.format == formatJSON {
+		enc := json.NewEncoder(p.w)
+		for _, s := range servers {
+			if err := enc.Encode(jsonServer{
+				ID:            s.Id,
+				RPCAddr:       s.RpcAddr,
+				Role:          roleName(s.Role),
+				LowestOffset:  s.LowestOffset,
+				HighestOffset: s.HighestOffset,
+				Error:         s.Error,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tADDRESS\tROLE\tLOWEST\tHIGHEST\tERROR")
+	for _, s := range servers {
+		if s.Error != "" {
+			fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t%s\n", s.Id, s.RpcAddr, s.Error)
+			continue
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t\n", s.Id, s.RpcAddr, roleName(s.Role), s.LowestOffset, s.HighestOffset)
+	}
+
+	return tw.Flush()
+}
+
+// ROLE_PRIMARYをprimaryのように表す
+func roleName(role api.Role) string {
+	return strings.ToLower(strings.TrimPrefix(role.String(), "ROLE_"))
+}
+
+// 移行の進み具合を1行ずつ出力する
+func (p *printer) migration(res *api.ImportLogResponse) error {
+	phase := strings.ToLower(strings.TrimPrefix(res.Phase.String(), "MIGRATION_PHASE_"))
+	if p.format == formatJSON {
+		return json.NewEncoder(p.w).Encode(struct {
+			Phase      string `json:"phase"`
+			NextOffset uint64 `json:"next_offset"`
+		}{phase, res.NextOffset})
+	}
+	_, err := fmt.Fprintf(p.w, "%s %d\n", phase, res.NextOffset)
+
+	return err
+}
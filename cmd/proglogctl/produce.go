@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/spf13/cobra"
+)
+
+const (
+	// 1行を1レコードとする(末尾の改行は含めない)
+	delimiterLine = "line"
+	// uvarintで表した長さに続く値を1レコードとする 改行やバイナリを含む値を書き込む場合に使う
+	delimiterLength = "length"
+)
+
+// 応答を待たずに送信できるレコードの数
+const maxInFlight = 128
+
+func (c *cli) produceCommand() *cobra.Command {
+	var delimiter string
+
+	cmd := &cobra.Command{
+		Use:   "produce [FILE...]",
+		Short: "Append records read from files or stdin and print their offsets",
+		Long: `Append records read from the given files, or stdin when no file or "-" is
+given, and print the offset of each record in order.
+
+With --delimiter=line (the default) every line is a record. With
+--delimiter=length every record is prefixed with its length as an unsigned
+varint, so values may contain newlines or arbitrary bytes.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var split func(*bufio.Reader) ([]byte, error)
+			switch delimiter {
+			case delimiterLine:
+				split = readLine
+			case delimiterLength:
+				split = readLengthDelimited
+			default:
+				return fmt.Errorf("unknown delimiter %q (use line or length)", delimiter)
+			}
+
+			if len(args) == 0 {
+				args = []string{"-"}
+			}
+
+			return c.produce(cmd, args, split)
+		},
+	}
+	cmd.Flags().StringVarP(&delimiter, "delimiter", "d", delimiterLine, "How records are separated: line or length.")
+
+	return cmd
+}
+
+/*
+ProduceStreamでレコードを書き込む
+送信と受信を別のゴルーチンで行い、応答を待たずにmaxInFlight件まで送信する
+サーバーは受信した順に書き込んで応答するので、出力するオフセットは入力の順と一致する
+*/
+func (c *cli) produce(cmd *cobra.Command, files []string, split func(*bufio.Reader) ([]byte, error)) error {
+	p, err := newPrinter(cmd.OutOrStdout(), c.output)
+	if err != nil {
+		return err
+	}
+	client, closeConn, err := c.client()
+	if err != nil {
+		return err
+	}
+	defer closeConn()
+
+	stream, err := client.ProduceStream(cmd.Context())
+	if err != nil {
+		return describe(err, 0)
+	}
+
+	pending := make(chan struct{}, maxInFlight)
+	sendErr := make(chan error, 1)
+	go func() {
+		defer close(pending)
+		sendErr <- c.readRecords(cmd, files, split, func(value []byte) error {
+			pending <- struct{}{}
+			return stream.Send(&api.ProduceRequest{Record: &api.Record{Value: value}})
+		})
+		stream.CloseSend()
+	}()
+
+	for range pending {
+		res, err := stream.Recv()
+		if err != nil {
+			// 送信側はサーバーがストリームを閉じるとエラーになるので、残りは読み捨てる
+			for range pending {
+			}
+			return describe(err, 0)
+		}
+		if err := p.offset(res.Offset); err != nil {
+			return err
+		}
+	}
+
+	return <-sendErr
+}
+
+func (c *cli) readRecords(
+	cmd *cobra.Command,
+	files []string,
+	split func(*bufio.Reader) ([]byte, error),
+	fn func([]byte) error,
+) error {
+	for _, name := range files {
+		var r io.Reader = cmd.InOrStdin()
+		if name != "-" {
+			f, err := os.Open(name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			r = f
+		}
+
+		br := bufio.NewReader(r)
+		for {
+			value, err := split(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			if err := fn(value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// 改行までを1レコードとして返す 最後の行に改行がなくても1レコードとする
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(line, []byte("\n")), nil
+}
+
+// 長さに続く値を1レコードとして返す
+func readLengthDelimited(r *bufio.Reader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		// 長さの途中で終わった場合は壊れた入力として扱う
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("truncated length prefix")
+		}
+		return nil, err
+	}
+
+	value := make([]byte, n)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, fmt.Errorf("truncated record: want %d bytes: %w", n, err)
+	}
+
+	return value, nil
+}
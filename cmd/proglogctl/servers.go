@@ -0,0 +1,35 @@
+package main
+
+import (
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/spf13/cobra"
+)
+
+func (c *cli) serversCommand() *cobra.Command {
+	return &cobra.Command{
+		Use:   "servers",
+		Short: "Print the servers in the cluster and the offsets each one holds",
+		Long: `Print every server the connected server knows about, with its role and the
+lowest and highest offsets of its log. Servers that did not answer are listed
+with the reason in the ERROR column.`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p, err := newPrinter(cmd.OutOrStdout(), c.output)
+			if err != nil {
+				return err
+			}
+			client, closeConn, err := c.client()
+			if err != nil {
+				return err
+			}
+			defer closeConn()
+
+			res, err := client.GetServers(cmd.Context(), &api.GetServersRequest{})
+			if err != nil {
+				return describe(err, 0)
+			}
+
+			return p.servers(res.Servers)
+		},
+	}
+}
@@ -0,0 +1,487 @@
+// ログとgRPC・HTTPサーバーを組み立てて、一つのプロセスとして動かす
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/KeisukeYamane/proglog/internal/auth"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/KeisukeYamane/proglog/internal/logging"
+	"github.com/KeisukeYamane/proglog/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/soheilhy/cmux"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+type Config struct {
+	// ログなどを保存するディレクトリ ログのセグメントは<DataDir>/log に、
+	// ログを移行した後のプライマリのアドレスは<DataDir>/handover に保存する
+	DataDir string
+	// gRPCサーバーのアドレス
+	BindAddr string
+	// 他のノードやクライアントがこのノードに接続するgRPCのアドレス 空の場合はBindAddr
+	// BindAddrが0.0.0.0:8400や:8400のようにホストを特定しない場合に指定する
+	AdvertiseAddr string
+	// HTTPサーバーのアドレス 空、もしくはBindAddrと同じ場合はgRPCと同じポートで受け付ける
+	HTTPBindAddr string
+
+	Segment struct {
+		MaxStoreBytes uint64
+		MaxIndexBytes uint64
+		InitialOffset uint64
+	}
+
+	Logging logging.Config
+	// いずれかの鍵ファイルが指定されている場合のみ認証を行う
+	Auth             auth.Config
+	EnableReflection bool
+	// 停止時に処理中のRPCの完了を待つ最大時間
+	DrainTimeout time.Duration
+
+	// 書き込みを受け付けるノード(プライマリ)のgRPCのアドレス 空の場合はこのノードが書き込みを受け付ける
+	// AdvertiseAddr(空の場合はBindAddr)が一致するノードがプライマリになるので、同じ書き方で指定する
+	PrimaryAddr string
+	// セカンダリが書き込みを受け取った時の動作 "forward"(空の場合も)はプライマリに転送し、
+	// "redirect"はUnavailableとプライマリのアドレスを返す
+	SecondaryWrites string
+	// GetServersが返すクラスタのサーバー 「ID=gRPCのアドレス」の形式で、このノードも含めて書く
+	// 空の場合はこのノードだけを返す
+	Servers []string
+	// trueの場合はログを移行するAdminサービスを公開する
+	EnableAdmin bool
+	// Adminサービスを呼び出せるサブジェクト 認証を行う場合はEnableAdminと合わせて指定する
+	AdminSubjects []string
+}
+
+// 設定の誤りを、どの設定が誤っているかがわかるメッセージで返す
+func (c Config) Validate() error {
+	var errs []string
+
+	if c.DataDir == "" {
+		errs = append(errs, "data-dir is required")
+	}
+	if _, _, err := net.SplitHostPort(c.BindAddr); err != nil {
+		errs = append(errs, fmt.Sprintf("bind-addr %q: %v", c.BindAddr, err))
+	}
+	if c.HTTPBindAddr != "" {
+		if _, _, err := net.SplitHostPort(c.HTTPBindAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("http-addr %q: %v", c.HTTPBindAddr, err))
+		}
+	}
+	if c.Segment.MaxStoreBytes == 0 {
+		errs = append(errs, "segment-max-store-bytes must be greater than 0")
+	}
+	// インデックスには少なくとも一つのエントリを書き込めないとセグメントが切り替わり続ける
+	if c.Segment.MaxIndexBytes < 12 {
+		errs = append(errs, "segment-max-index-bytes must be at least 12 (one index entry)")
+	}
+	if c.DrainTimeout < 0 {
+		errs = append(errs, "drain-timeout must not be negative")
+	}
+	if c.AdvertiseAddr != "" {
+		if _, _, err := net.SplitHostPort(c.AdvertiseAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("advertise-addr %q: %v", c.AdvertiseAddr, err))
+		}
+	}
+	if c.PrimaryAddr != "" {
+		if _, _, err := net.SplitHostPort(c.PrimaryAddr); err != nil {
+			errs = append(errs, fmt.Sprintf("primary-addr %q: %v", c.PrimaryAddr, err))
+		}
+		// ホストを特定しないアドレスはprimary-addrと一致しないので、プライマリになれなくなる
+		if c.AdvertiseAddr == "" && !specificAddr(c.BindAddr) {
+			errs = append(errs, fmt.Sprintf("advertise-addr is required with primary-addr when bind-addr %q does not name a host and port", c.BindAddr))
+		}
+	}
+	if _, err := c.writeMode(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := c.staticServers(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(c.AdminSubjects) > 0 && !c.EnableAdmin {
+		errs = append(errs, "admin-subjects requires enable-admin")
+	}
+	if c.EnableAdmin && c.authEnabled() && len(c.AdminSubjects) == 0 {
+		errs = append(errs, "admin-subjects is required with enable-admin when authentication is enabled")
+	}
+	for name, path := range map[string]string{
+		"auth-jwks-file":    c.Auth.JWKSFile,
+		"auth-key-file":     c.Auth.KeyFile,
+		"auth-api-key-file": c.Auth.APIKeyFile,
+	} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+	}
+
+	return nil
+}
+
+func (c Config) advertiseAddr() string {
+	if c.AdvertiseAddr != "" {
+		return c.AdvertiseAddr
+	}
+
+	return c.BindAddr
+}
+
+// 他のノードから接続できるアドレスとして使えるか
+func specificAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || host == "" || port == "0" {
+		return false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsUnspecified() {
+		return false
+	}
+
+	return true
+}
+
+func (c Config) authEnabled() bool {
+	return c.Auth.JWKSFile != "" || c.Auth.KeyFile != "" || c.Auth.APIKeyFile != ""
+}
+
+func (c Config) writeMode() (server.WriteMode, error) {
+	switch c.SecondaryWrites {
+	case "", "forward":
+		return server.ForwardWrites, nil
+	case "redirect":
+		return server.RedirectWrites, nil
+	}
+
+	return 0, fmt.Errorf("secondary-writes %q: must be forward or redirect", c.SecondaryWrites)
+}
+
+func (c Config) staticServers() ([]server.StaticServer, error) {
+	var servers []server.StaticServer
+	for _, s := range c.Servers {
+		i := strings.Index(s, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("servers %q: must be ID=ADDR", s)
+		}
+		addr := s[i+1:]
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("servers %q: %v", s, err)
+		}
+		servers = append(servers, server.StaticServer{ID: s[:i], RPCAddr: addr})
+	}
+
+	return servers, nil
+}
+
+// gRPCとHTTPを同じポートで受け付けるかどうか ポートが0の場合はそれぞれ別のポートを割り当てる
+func (c Config) sharedPort() bool {
+	if c.HTTPBindAddr == "" {
+		return true
+	}
+	_, port, _ := net.SplitHostPort(c.BindAddr)
+
+	return c.HTTPBindAddr == c.BindAddr && port != "0"
+}
+
+type Agent struct {
+	Config Config
+
+	logger *zap.Logger
+	log    *log.Log
+	server *server.Server
+
+	// 同じポートで受け付ける場合のみ使用する
+	mux    cmux.CMux
+	ln     net.Listener
+	grpcLn net.Listener
+	httpLn net.Listener
+}
+
+// 設定を検証し、ログを開いてサーバーを作成する 受け付けはRunかServeを呼び出すまで始めない
+func New(config Config) (*Agent, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	a := &Agent{
+		Config: config,
+	}
+
+	setup := []func() error{
+		a.setupLogger,
+		a.setupListeners,
+		a.setupServer,
+	}
+	for _, fn := range setup {
+		if err := fn(); err != nil {
+			a.closeListeners()
+			return nil, err
+		}
+	}
+
+	return a, nil
+}
+
+func (a *Agent) setupLogger() error {
+	logger, err := logging.New(a.Config.Logging)
+	if err != nil {
+		return fmt.Errorf("log-level: %w", err)
+	}
+	a.logger = logger
+
+	return nil
+}
+
+func (a *Agent) setupListeners() error {
+	ln, err := net.Listen("tcp", a.Config.BindAddr)
+	if err != nil {
+		return fmt.Errorf("bind-addr: %w", err)
+	}
+
+	if a.Config.sharedPort() {
+		// gRPCのリクエストはcontent-typeで見分け、それ以外はHTTPとして扱う
+		a.ln = ln
+		a.mux = cmux.New(ln)
+		a.grpcLn = newSubListener(a.mux.MatchWithWriters(
+			cmux.HTTP2MatchHeaderFieldSendSettings("content-type", "application/grpc"),
+		))
+		a.httpLn = newSubListener(a.mux.Match(cmux.Any()))
+		return nil
+	}
+
+	a.grpcLn = ln
+	a.httpLn, err = net.Listen("tcp", a.Config.HTTPBindAddr)
+	if err != nil {
+		return fmt.Errorf("http-addr: %w", err)
+	}
+
+	return nil
+}
+
+func (a *Agent) setupServer() error {
+	dir := filepath.Join(a.Config.DataDir, "log")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("data-dir: %w", err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	logConfig := log.Config{
+		Logger:     a.logger.Named("log"),
+		Registerer: registry,
+	}
+	logConfig.Segment.MaxStoreBytes = a.Config.Segment.MaxStoreBytes
+	logConfig.Segment.MaxIndexBytes = a.Config.Segment.MaxIndexBytes
+	logConfig.Segment.InitialOffset = a.Config.Segment.InitialOffset
+
+	var err error
+	a.log, err = log.NewLog(dir, logConfig)
+	if err != nil {
+		return fmt.Errorf("open log in %s: %w", dir, err)
+	}
+
+	serverConfig := &server.Config{
+		CommitLog:        a.log,
+		Logger:           a.logger,
+		Registerer:       registry,
+		EnableReflection: a.Config.EnableReflection,
+		// ImportLogで移行元にもトークンを引き継ぐので、トランスポートは認証しない
+		DialOptions:   []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		EnableAdmin:   a.Config.EnableAdmin,
+		AdminSubjects: a.Config.AdminSubjects,
+		HandoverFile:  filepath.Join(a.Config.DataDir, "handover"),
+	}
+	if a.Config.PrimaryAddr != "" {
+		// 検証済みなのでエラーにはならない 転送先のノードにもトークンを引き継ぐので、トランスポートは認証しない
+		mode, _ := a.Config.writeMode()
+		serverConfig.Primary = server.NewPrimary(
+			a.Config.advertiseAddr(),
+			a.Config.PrimaryAddr,
+			mode,
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+		)
+	}
+	if servers, _ := a.Config.staticServers(); len(servers) > 0 {
+		serverConfig.Servers = &server.StaticServers{
+			Servers:     servers,
+			DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+		}
+	}
+	httpConfig := &server.HTTPConfig{
+		CommitLog: a.log,
+		Gatherer:  registry,
+	}
+	if a.Config.authEnabled() {
+		authenticator, err := auth.New(a.Config.Auth)
+		if err != nil {
+			a.log.Close()
+			return err
+		}
+		serverConfig.Authenticator = authenticator
+		httpConfig.Authenticator = authenticator
+	}
+
+	a.server, err = server.NewServer(serverConfig)
+	if err != nil {
+		a.log.Close()
+		return err
+	}
+	// HTTPでの書き込みも、gRPCと同じくプライマリだけが受け付ける
+	httpConfig.Producer = a.server.Producer()
+	a.server.HTTP = server.NewHTTPServer(a.httpLn.Addr().String(), httpConfig)
+	a.server.DrainTimeout = a.Config.DrainTimeout
+
+	return nil
+}
+
+func (a *Agent) closeListeners() {
+	if a.ln != nil {
+		a.mux.Close()
+		a.ln.Close()
+	}
+	if a.grpcLn != nil {
+		a.grpcLn.Close()
+	}
+	if a.httpLn != nil {
+		a.httpLn.Close()
+	}
+}
+
+// gRPCサーバーの実際のアドレス(ポートに0を指定した場合に使用する)
+func (a *Agent) RPCAddr() string {
+	return a.grpcLn.Addr().String()
+}
+
+// HTTPサーバーの実際のアドレス 同じポートで受け付ける場合はRPCAddrと同じ
+func (a *Agent) HTTPAddr() string {
+	return a.httpLn.Addr().String()
+}
+
+// SIGTERMかSIGINTを受け取るまで受け付け、受け取ったらログをクローズして停止する
+func (a *Agent) Run() error {
+	return a.serve(func() error {
+		return a.server.Run(a.grpcLn, a.httpLn)
+	})
+}
+
+// Shutdownを呼び出すまで受け付ける
+func (a *Agent) Serve() error {
+	return a.serve(func() error {
+		return a.server.Serve(a.grpcLn, a.httpLn)
+	})
+}
+
+func (a *Agent) serve(fn func() error) error {
+	a.logger.Info(
+		"agent started",
+		zap.String("rpc_addr", a.RPCAddr()),
+		zap.String("http_addr", a.HTTPAddr()),
+		zap.String("data_dir", a.Config.DataDir),
+	)
+
+	if a.mux != nil {
+		go func() {
+			// 停止時に元のリスナーが閉じられるとエラーが返るので無視する
+			if err := a.mux.Serve(); err != nil && !isClosedConnError(err) {
+				a.logger.Error("cmux stopped", zap.Error(err))
+			}
+		}()
+	}
+
+	err := fn()
+	// 両方のサーバーが停止してから、共有しているリスナーを閉じる
+	a.closeListeners()
+	a.logger.Info("agent stopped", zap.Error(err))
+	a.logger.Sync()
+
+	return err
+}
+
+// 処理中のRPCの完了を待ってから停止し、ログをクローズする
+func (a *Agent) Shutdown() error {
+	return a.server.Shutdown(context.Background())
+}
+
+func isClosedConnError(err error) bool {
+	return errors.Is(err, net.ErrClosed) || strings.Contains(err.Error(), "use of closed network connection")
+}
+
+/*
+cmuxが返すリスナーのCloseは共有している元のリスナーを閉じてしまうので、
+gRPCサーバーの停止によってHTTPサーバーの受け付けまで止まる(HTTPサーバーが停止中と判断する前だとエラーになる)
+そこでCloseでは自身の受け付けだけを止め、元のリスナーは両方のサーバーが停止した後に閉じる
+*/
+type subListener struct {
+	net.Listener
+
+	accepted chan acceptResult
+	done     chan struct{}
+	once     sync.Once
+}
+
+type acceptResult struct {
+	conn net.Conn
+	err  error
+}
+
+func newSubListener(l net.Listener) *subListener {
+	s := &subListener{
+		Listener: l,
+		accepted: make(chan acceptResult),
+		done:     make(chan struct{}),
+	}
+	go s.pump()
+
+	return s
+}
+
+func (s *subListener) pump() {
+	for {
+		conn, err := s.Listener.Accept()
+		select {
+		case s.accepted <- acceptResult{conn, err}:
+		case <-s.done:
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *subListener) Accept() (net.Conn, error) {
+	select {
+	case r := <-s.accepted:
+		return r.conn, r.err
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *subListener) Close() error {
+	s.once.Do(func() { close(s.done) })
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+func TestAgent(t *testing.T) {
+	for scenario, httpAddr := range map[string]string{
+		"shared port":    "",
+		"separate ports": "127.0.0.1:0",
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			config := Config{
+				DataDir:      t.TempDir(),
+				BindAddr:     "127.0.0.1:0",
+				HTTPBindAddr: httpAddr,
+			}
+			config.Segment.MaxStoreBytes = 1024
+			config.Segment.MaxIndexBytes = 1024
+			config.Logging.Level = "error"
+
+			a, err := New(config)
+			require.NoError(t, err)
+			if httpAddr == "" {
+				require.Equal(t, a.RPCAddr(), a.HTTPAddr())
+			} else {
+				require.NotEqual(t, a.RPCAddr(), a.HTTPAddr())
+			}
+
+			errc := make(chan error, 1)
+			go func() {
+				errc <- a.Serve()
+			}()
+
+			// gRPCで書き込んだレコードをHTTPで読み出せる
+			cc, err := grpc.Dial(
+				a.RPCAddr(),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.NoError(t, err)
+			defer cc.Close()
+			client := api.NewLogClient(cc)
+
+			res, err := client.Produce(
+				context.Background(),
+				&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+				grpc.WaitForReady(true),
+			)
+			require.NoError(t, err)
+			require.Equal(t, uint64(0), res.Offset)
+
+			base := fmt.Sprintf("http://%s", a.HTTPAddr())
+			body, err := json.Marshal(map[string]uint64{"offset": 0})
+			require.NoError(t, err)
+			req, err := http.NewRequest(http.MethodGet, base+"/", bytes.NewReader(body))
+			require.NoError(t, err)
+			httpRes, err := http.DefaultClient.Do(req)
+			require.NoError(t, err)
+			var consumed struct {
+				Record struct {
+					Value  []byte `json:"value"`
+					Offset uint64 `json:"offset"`
+				} `json:"record"`
+			}
+			require.NoError(t, json.NewDecoder(httpRes.Body).Decode(&consumed))
+			httpRes.Body.Close()
+			require.Equal(t, http.StatusOK, httpRes.StatusCode)
+			require.Equal(t, []byte("hello world"), consumed.Record.Value)
+
+			// メトリクスも同じHTTPサーバーで公開する
+			httpRes, err = http.Get(base + "/metrics")
+			require.NoError(t, err)
+			metrics, err := io.ReadAll(httpRes.Body)
+			httpRes.Body.Close()
+			require.NoError(t, err)
+			require.Contains(t, string(metrics), "proglog_log_written_bytes_total")
+			require.Contains(t, string(metrics), "grpc_server_handled_total")
+
+			require.NoError(t, a.Shutdown())
+			require.NoError(t, <-errc)
+
+			// 同じデータディレクトリで起動し直すと、書き込んだレコードの続きから書き込む
+			a, err = New(config)
+			require.NoError(t, err)
+			defer a.Shutdown()
+			go a.Serve()
+
+			cc2, err := grpc.Dial(
+				a.RPCAddr(),
+				grpc.WithTransportCredentials(insecure.NewCredentials()),
+			)
+			require.NoError(t, err)
+			defer cc2.Close()
+			res, err = api.NewLogClient(cc2).Produce(
+				context.Background(),
+				&api.ProduceRequest{Record: &api.Record{Value: []byte("hello again")}},
+				grpc.WaitForReady(true),
+			)
+			require.NoError(t, err)
+			require.Equal(t, uint64(1), res.Offset)
+		})
+	}
+}
+
+func TestNewInvalidConfig(t *testing.T) {
+	_, err := New(Config{BindAddr: "127.0.0.1"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "data-dir is required")
+	require.Contains(t, err.Error(), `bind-addr "127.0.0.1"`)
+
+	_, err = New(Config{PrimaryAddr: "primary", SecondaryWrites: "proxy", Servers: []string{"127.0.0.1:8400"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `primary-addr "primary"`)
+	require.Contains(t, err.Error(), `secondary-writes "proxy": must be forward or redirect`)
+	require.Contains(t, err.Error(), `servers "127.0.0.1:8400": must be ID=ADDR`)
+
+	_, err = New(Config{AdminSubjects: []string{"admin"}})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "admin-subjects requires enable-admin")
+
+	_, err = New(Config{BindAddr: ":8400", PrimaryAddr: "10.0.0.1:8400"})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `advertise-addr is required with primary-addr when bind-addr ":8400"`)
+}
+
+// 全てのインターフェースで待ち受けても、AdvertiseAddrがPrimaryAddrと一致すればプライマリとして書き込む
+func TestAgentAdvertiseAddr(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	require.NoError(t, err)
+	require.NoError(t, ln.Close())
+	addr := net.JoinHostPort("127.0.0.1", port)
+
+	config := Config{
+		DataDir:       t.TempDir(),
+		BindAddr:      ":" + port,
+		AdvertiseAddr: addr,
+		PrimaryAddr:   addr,
+	}
+	config.Segment.MaxStoreBytes = 1024
+	config.Segment.MaxIndexBytes = 1024
+	config.Logging.Level = "error"
+
+	a, err := New(config)
+	require.NoError(t, err)
+	defer a.Shutdown()
+	go a.Serve()
+
+	cc, err := grpc.Dial(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	// プライマリでなければ自分自身に転送し、転送された書き込みとして拒否される
+	res, err := client.Produce(
+		context.Background(),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("hello world")}},
+		grpc.WaitForReady(true),
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+}
@@ -0,0 +1,192 @@
+// クライアント証明書を扱えないクライアントのために、ベアラートークンによる認証を提供する
+package auth
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	ErrMissingToken = errors.New("auth: missing token")
+	ErrInvalidToken = errors.New("auth: invalid token")
+	ErrTokenExpired = errors.New("auth: token expired")
+)
+
+// 認証に使用する鍵の設定 いずれか一つ以上を指定する
+type Config struct {
+	JWKSFile   string // JWKS形式の鍵セット kidでトークンの検証鍵を選択する
+	KeyFile    string // PEM形式のRSA公開鍵、もしくはHMACの共有鍵
+	APIKeyFile string // 「<APIキー> <サブジェクト>」を1行ずつ並べた静的APIキーの一覧
+	Issuer     string // 空でなければissクレームと一致することを要求する
+	Audience   string // 空でなければaudクレームに含まれていることを要求する
+}
+
+// トークンを検証し、認証されたサブジェクトを返す
+type Authenticator struct {
+	keys       map[string]interface{} // kid -> 検証鍵
+	defaultKey interface{}            // kidを持たないトークンの検証鍵
+	apiKeys    map[string]string      // APIキー -> サブジェクト
+	issuer     string
+	audience   string
+}
+
+func New(c Config) (*Authenticator, error) {
+	a := &Authenticator{
+		keys:     make(map[string]interface{}),
+		apiKeys:  make(map[string]string),
+		issuer:   c.Issuer,
+		audience: c.Audience,
+	}
+
+	if c.JWKSFile != "" {
+		keys, err := loadJWKS(c.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range keys {
+			a.keys[kid] = key
+		}
+		// 鍵が一つしかない場合はkidを持たないトークンもその鍵で検証する
+		if len(keys) == 1 {
+			for _, key := range keys {
+				a.defaultKey = key
+			}
+		}
+	}
+
+	if c.KeyFile != "" {
+		key, err := loadKey(c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.defaultKey = key
+	}
+
+	if c.APIKeyFile != "" {
+		apiKeys, err := loadAPIKeys(c.APIKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		a.apiKeys = apiKeys
+	}
+
+	if len(a.keys) == 0 && a.defaultKey == nil && len(a.apiKeys) == 0 {
+		return nil, errors.New("auth: no keys configured")
+	}
+
+	return a, nil
+}
+
+// トークンを検証し、サブジェクトを返す
+// 静的APIキーに一致しない場合はJWTとして検証する
+func (a *Authenticator) Authenticate(token string) (string, error) {
+	if token == "" {
+		return "", ErrMissingToken
+	}
+
+	if subject, ok := a.lookupAPIKey(token); ok {
+		return subject, nil
+	}
+
+	if len(a.keys) == 0 && a.defaultKey == nil {
+		return "", ErrInvalidToken
+	}
+
+	claims := &jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(
+		token,
+		claims,
+		a.keyFunc,
+		jwt.WithValidMethods([]string{
+			"HS256", "HS384", "HS512",
+			"RS256", "RS384", "RS512",
+		}),
+	)
+	if err != nil {
+		var ve *jwt.ValidationError
+		if errors.As(err, &ve) && ve.Errors&jwt.ValidationErrorExpired != 0 {
+			return "", ErrTokenExpired
+		}
+		return "", fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	// expがないトークンは無期限に使えてしまうので受け付けない
+	if claims.ExpiresAt == nil {
+		return "", fmt.Errorf("%w: missing expiration", ErrInvalidToken)
+	}
+
+	if a.issuer != "" && !claims.VerifyIssuer(a.issuer, true) {
+		return "", fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, claims.Issuer)
+	}
+	if a.audience != "" && !claims.VerifyAudience(a.audience, true) {
+		return "", fmt.Errorf("%w: unexpected audience", ErrInvalidToken)
+	}
+	if claims.Subject == "" {
+		return "", fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+
+	return claims.Subject, nil
+}
+
+// APIキーは総当たりで比較し、一致までの時間からキーを推測されないようにする
+func (a *Authenticator) lookupAPIKey(token string) (string, bool) {
+	var subject string
+	found := false
+	for key, sub := range a.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1 {
+			subject = sub
+			found = true
+		}
+	}
+
+	return subject, found
+}
+
+// トークンのヘッダーから検証鍵を選択する
+// 署名アルゴリズムと鍵の種類が一致しない場合は拒否する(公開鍵をHMACの鍵として使う攻撃を防ぐため)
+func (a *Authenticator) keyFunc(t *jwt.Token) (interface{}, error) {
+	key := a.defaultKey
+	if kid, ok := t.Header["kid"].(string); ok && kid != "" {
+		k, ok := a.keys[kid]
+		if !ok {
+			return nil, fmt.Errorf("unknown key id %q", kid)
+		}
+		key = k
+	}
+	if key == nil {
+		return nil, errors.New("no key for token")
+	}
+
+	switch t.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if _, ok := key.([]byte); !ok {
+			return nil, fmt.Errorf("key does not match signing method %s", t.Method.Alg())
+		}
+	case *jwt.SigningMethodRSA:
+		if _, ok := key.(*rsa.PublicKey); !ok {
+			return nil, fmt.Errorf("key does not match signing method %s", t.Method.Alg())
+		}
+	default:
+		return nil, fmt.Errorf("unsupported signing method %s", t.Method.Alg())
+	}
+
+	return key, nil
+}
+
+type subjectContextKey struct{}
+
+// 認証されたサブジェクトをコンテキストに保持する
+func NewContext(ctx context.Context, subject string) context.Context {
+	return context.WithValue(ctx, subjectContextKey{}, subject)
+}
+
+// コンテキストから認証されたサブジェクトを取り出す 認証されていない場合は空文字を返す
+func Subject(ctx context.Context) string {
+	subject, _ := ctx.Value(subjectContextKey{}).(string)
+	return subject
+}
@@ -0,0 +1,181 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/require"
+)
+
+var secret = []byte("test-secret")
+
+func sign(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.RegisteredClaims) string {
+	t.Helper()
+
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	s, err := token.SignedString(key)
+	require.NoError(t, err)
+
+	return s
+}
+
+func writeFile(t *testing.T, dir, name string, b []byte) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+
+	return path
+}
+
+func TestAuthenticateHMACKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(Config{KeyFile: writeFile(t, dir, "secret", secret)})
+	require.NoError(t, err)
+
+	token := sign(t, jwt.SigningMethodHS256, secret, "", jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	subject, err := a.Authenticate(token)
+	require.NoError(t, err)
+	require.Equal(t, "alice", subject)
+
+	// 有効期限切れ
+	token = sign(t, jwt.SigningMethodHS256, secret, "", jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour)),
+	})
+	_, err = a.Authenticate(token)
+	require.Equal(t, ErrTokenExpired, err)
+
+	// 異なる鍵で署名されている
+	token = sign(t, jwt.SigningMethodHS256, []byte("other"), "", jwt.RegisteredClaims{
+		Subject:   "alice",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	_, err = a.Authenticate(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// 有効期限がない
+	token = sign(t, jwt.SigningMethodHS256, secret, "", jwt.RegisteredClaims{Subject: "alice"})
+	_, err = a.Authenticate(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// サブジェクトがない
+	token = sign(t, jwt.SigningMethodHS256, secret, "", jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	_, err = a.Authenticate(token)
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = a.Authenticate("not.a.token")
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = a.Authenticate("")
+	require.Equal(t, ErrMissingToken, err)
+}
+
+func TestAuthenticateRSA(t *testing.T) {
+	dir := t.TempDir()
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	set := map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "rsa-1",
+			"n":   base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(priv.E)).Bytes()),
+		}, {
+			"kty": "oct",
+			"kid": "hmac-1",
+			"k":   base64.RawURLEncoding.EncodeToString(secret),
+		}},
+	}
+	b, err := json.Marshal(set)
+	require.NoError(t, err)
+
+	a, err := New(Config{
+		JWKSFile: writeFile(t, dir, "jwks.json", b),
+		Issuer:   "proglog",
+	})
+	require.NoError(t, err)
+
+	claims := jwt.RegisteredClaims{
+		Subject:   "bob",
+		Issuer:    "proglog",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}
+	subject, err := a.Authenticate(sign(t, jwt.SigningMethodRS256, priv, "rsa-1", claims))
+	require.NoError(t, err)
+	require.Equal(t, "bob", subject)
+
+	subject, err = a.Authenticate(sign(t, jwt.SigningMethodHS256, secret, "hmac-1", claims))
+	require.NoError(t, err)
+	require.Equal(t, "bob", subject)
+
+	// 存在しないkid
+	_, err = a.Authenticate(sign(t, jwt.SigningMethodRS256, priv, "rsa-2", claims))
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// 鍵の種類と署名アルゴリズムが一致しない
+	_, err = a.Authenticate(sign(t, jwt.SigningMethodHS256, secret, "rsa-1", claims))
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// 発行者が異なる
+	claims.Issuer = "someone-else"
+	_, err = a.Authenticate(sign(t, jwt.SigningMethodRS256, priv, "rsa-1", claims))
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	// PEM形式の公開鍵ファイル
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pemFile := writeFile(t, dir, "key.pem", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	a, err = New(Config{KeyFile: pemFile})
+	require.NoError(t, err)
+	subject, err = a.Authenticate(sign(t, jwt.SigningMethodRS256, priv, "", jwt.RegisteredClaims{
+		Subject:   "carol",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}))
+	require.NoError(t, err)
+	require.Equal(t, "carol", subject)
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	dir := t.TempDir()
+	a, err := New(Config{APIKeyFile: writeFile(t, dir, "keys", []byte("# on-call\nkey-1 dave\n\nkey-2 erin\n"))})
+	require.NoError(t, err)
+
+	subject, err := a.Authenticate("key-2")
+	require.NoError(t, err)
+	require.Equal(t, "erin", subject)
+
+	_, err = a.Authenticate("key-3")
+	require.ErrorIs(t, err, ErrInvalidToken)
+
+	_, err = New(Config{APIKeyFile: writeFile(t, dir, "bad", []byte("key-1\n"))})
+	require.Error(t, err)
+	_, err = New(Config{})
+	require.Error(t, err)
+}
+
+func TestSubjectContext(t *testing.T) {
+	ctx := context.Background()
+	require.Equal(t, "", Subject(ctx))
+	require.Equal(t, "alice", Subject(NewContext(ctx, "alice")))
+}
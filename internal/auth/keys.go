@@ -0,0 +1,128 @@
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWKSの鍵 RSA(n, e)とHMAC(k)のみサポートする
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	K   string `json:"k"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// JWKSファイルを読み込み、kidごとの検証鍵を返す
+func loadJWKS(path string) (map[string]interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set jwks
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, fmt.Errorf("auth: parse jwks %s: %w", path, err)
+	}
+
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, k := range set.Keys {
+		var key interface{}
+		switch k.Kty {
+		case "RSA":
+			key, err = k.rsaPublicKey()
+		case "oct":
+			key, err = base64.RawURLEncoding.DecodeString(k.K)
+		default:
+			err = fmt.Errorf("unsupported key type %q", k.Kty)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("auth: jwks key %q: %w", k.Kid, err)
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("auth: jwks %s has no keys", path)
+	}
+
+	return keys, nil
+}
+
+func (k jwk) rsaPublicKey() (*rsa.PublicKey, error) {
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rsa.PublicKey{
+		N: new(big.Int).SetBytes(n),
+		E: int(new(big.Int).SetBytes(e).Int64()),
+	}, nil
+}
+
+// 鍵ファイルを読み込む PEM形式であればRSA公開鍵、それ以外はHMACの共有鍵として扱う
+func loadKey(path string) (interface{}, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if block, _ := pem.Decode(b); block != nil {
+		key, err := jwt.ParseRSAPublicKeyFromPEM(b)
+		if err != nil {
+			return nil, fmt.Errorf("auth: parse key %s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	secret := bytes.TrimSpace(b)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("auth: key file %s is empty", path)
+	}
+
+	return secret, nil
+}
+
+// 静的APIキーの一覧を読み込む 空行と#から始まる行は無視する
+func loadAPIKeys(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("auth: %s:%d: want \"<key> <subject>\"", path, line)
+		}
+		keys[fields[0]] = fields[1]
+	}
+
+	return keys, scanner.Err()
+}
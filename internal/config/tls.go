@@ -0,0 +1,63 @@
+// TLSの設定など、サーバーとクライアントで共有する設定
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// 相手の証明書を検証する認証局の証明書 空の場合はシステムの認証局を使用する
+	CAFile string
+	// クライアントが検証するサーバー名 空の場合は接続先のホスト名を使用する
+	ServerAddress string
+	// trueの場合はサーバー用の設定を作成し、クライアント証明書を要求する
+	Server bool
+}
+
+/*
+証明書と認証局からtls.Configを作成する
+① CertFileとKeyFileが指定されていれば、自身の証明書として提示する(クライアントの場合はクライアント証明書)
+② CAFileが指定されていれば、相手の証明書をその認証局で検証する サーバーの場合は、CAFileで検証できるクライアント証明書を必須にする
+*/
+func SetupTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, fmt.Errorf("tls: both cert file and key file are required")
+		}
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: load key pair: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if cfg.CAFile != "" {
+		b, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("tls: read CA file: %w", err)
+		}
+		ca := x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("tls: failed to parse root certificate: %q", cfg.CAFile)
+		}
+
+		if cfg.Server {
+			tlsConfig.ClientCAs = ca
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			tlsConfig.RootCAs = ca
+		}
+	}
+	tlsConfig.ServerName = cfg.ServerAddress
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	notPEM := filepath.Join(dir, "ca.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("not a certificate"), 0600))
+
+	for scenario, cfg := range map[string]TLSConfig{
+		"cert without key": {CertFile: "client.pem"},
+		"missing key pair": {CertFile: "client.pem", KeyFile: "client-key.pem"},
+		"missing CA file":  {CAFile: filepath.Join(dir, "missing.pem")},
+		"invalid CA file":  {CAFile: notPEM},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			_, err := SetupTLSConfig(cfg)
+			require.Error(t, err)
+		})
+	}
+}
+
+func TestSetupTLSConfigServerName(t *testing.T) {
+	c, err := SetupTLSConfig(TLSConfig{ServerAddress: "proglog.example"})
+	require.NoError(t, err)
+	require.Equal(t, "proglog.example", c.ServerName)
+	require.Equal(t, tls.NoClientCert, c.ClientAuth)
+	require.Nil(t, c.RootCAs)
+}
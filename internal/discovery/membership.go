@@ -0,0 +1,187 @@
+// ゴシッププロトコル(Serf)によるサービスディスカバリ クラスタに参加しているノードを互いに知らせ合う
+package discovery
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/hashicorp/serf/serf"
+	"go.uber.org/zap"
+)
+
+// 他のノードのRPCのアドレスを知らせるタグの名前
+const rpcAddrTag = "rpc_addr"
+
+/*
+Serfを使ってクラスタのメンバーシップを管理する
+他のノードがクラスタに参加・離脱すると、Handlerにそのノードの名前とRPCのアドレスを知らせる
+自身の参加・離脱は知らせない
+*/
+type Membership struct {
+	Config
+	handler Handler
+	serf    *serf.Serf
+	events  chan serf.Event
+	logger  *zap.Logger
+}
+
+type Config struct {
+	// クラスタ内で一意なノードの名前 省略した場合はホスト名
+	NodeName string
+	// ゴシップに使うアドレス("127.0.0.1:8401"など) 他のノードからこのアドレスに接続できる必要がある
+	BindAddr string
+	// 他のノードに知らせるタグ RPCのアドレスはrpc_addrに入れる(RPCAddrを参照)
+	Tags map[string]string
+	// 参加する時に接続する既存のノードのゴシップのアドレス 空の場合は新しいクラスタを作る
+	StartJoinAddrs []string
+	// 構造化ログの出力先 nilの場合は何も出力しない
+	Logger *zap.Logger
+}
+
+// 他のノードのRPCのアドレスを、タグに入れて知らせる
+func (c *Config) RPCAddr(addr string) {
+	if c.Tags == nil {
+		c.Tags = map[string]string{}
+	}
+	c.Tags[rpcAddrTag] = addr
+}
+
+/*
+メンバーシップの変化を受け取るインターフェイス
+レプリケーションを行うコンポーネントが実装し、参加したノードからの複製を開始・停止する
+*/
+type Handler interface {
+	Join(name, addr string) error
+	Leave(name string) error
+}
+
+func New(handler Handler, config Config) (*Membership, error) {
+	if config.Tags[rpcAddrTag] == "" {
+		return nil, errors.New("discovery: the rpc_addr tag is required (see Config.RPCAddr)")
+	}
+
+	logger := config.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	c := &Membership{
+		Config:  config,
+		handler: handler,
+		logger:  logger.Named("membership"),
+	}
+	if err := c.setupSerf(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (m *Membership) setupSerf() error {
+	host, port, err := net.SplitHostPort(m.BindAddr)
+	if err != nil {
+		return fmt.Errorf("discovery: invalid bind address %q: %w", m.BindAddr, err)
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("discovery: invalid bind address %q: %w", m.BindAddr, err)
+	}
+
+	/*
+		① MemberlistConfig.BindAddr/BindPortでゴシップを受け付ける
+		② EventChでメンバーの参加・離脱・障害などのイベントを受け取る
+		③ Tagsで他のノードに自身のRPCのアドレスを知らせる
+	*/
+	config := serf.DefaultConfig()
+	config.Init()
+	config.MemberlistConfig.BindAddr = host
+	config.MemberlistConfig.BindPort = p
+	config.MemberlistConfig.Logger = zap.NewStdLog(m.logger.Named("memberlist"))
+	config.Logger = zap.NewStdLog(m.logger.Named("serf"))
+	m.events = make(chan serf.Event)
+	config.EventCh = m.events
+	config.Tags = m.Tags
+	if m.NodeName != "" {
+		config.NodeName = m.NodeName
+	}
+	m.NodeName = config.NodeName
+
+	if m.serf, err = serf.Create(config); err != nil {
+		return err
+	}
+	go m.eventHandler()
+
+	// 既存のクラスタに参加する ignoreOldがtrueなので、参加する前のユーザーイベントは受け取らない
+	if len(m.StartJoinAddrs) > 0 {
+		if _, err := m.serf.Join(m.StartJoinAddrs, true); err != nil {
+			m.serf.Shutdown()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Serfのイベントを読み出し、他のノードの参加・離脱をHandlerに知らせる
+func (m *Membership) eventHandler() {
+	for e := range m.events {
+		switch e.EventType() {
+		case serf.EventMemberJoin:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					continue
+				}
+				m.handleJoin(member)
+			}
+		case serf.EventMemberLeave, serf.EventMemberFailed:
+			for _, member := range e.(serf.MemberEvent).Members {
+				if m.isLocal(member) {
+					// 自身が離脱した場合はイベントの処理を終える
+					return
+				}
+				m.handleLeave(member)
+			}
+		}
+	}
+}
+
+func (m *Membership) handleJoin(member serf.Member) {
+	if err := m.handler.Join(member.Name, member.Tags[rpcAddrTag]); err != nil {
+		m.logError(err, "failed to join", member)
+	}
+}
+
+func (m *Membership) handleLeave(member serf.Member) {
+	if err := m.handler.Leave(member.Name); err != nil {
+		m.logError(err, "failed to leave", member)
+	}
+}
+
+func (m *Membership) isLocal(member serf.Member) bool {
+	return m.serf.LocalMember().Name == member.Name
+}
+
+// 現時点のクラスタのメンバー(自身と、離脱したり障害が起きたりしたノードも含む)
+func (m *Membership) Members() []serf.Member {
+	return m.serf.Members()
+}
+
+// クラスタから離脱する 他のノードのHandler.Leaveが呼び出される
+func (m *Membership) Leave() error {
+	if err := m.serf.Leave(); err != nil {
+		return err
+	}
+
+	return m.serf.Shutdown()
+}
+
+func (m *Membership) logError(err error, msg string, member serf.Member) {
+	m.logger.Error(
+		msg,
+		zap.Error(err),
+		zap.String("name", member.Name),
+		zap.String("rpc_addr", member.Tags[rpcAddrTag]),
+	)
+}
@@ -0,0 +1,131 @@
+package discovery
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/serf/serf"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMembership(t *testing.T) {
+	m, handler := setupMember(t, nil)
+	m, _ = setupMember(t, m)
+	m, _ = setupMember(t, m)
+
+	// 最初のノードに、後から参加した2つのノードが知らされる
+	require.Eventually(t, func() bool {
+		return handler.joinCount() == 2 &&
+			len(m[0].Members()) == 3 &&
+			handler.leaveCount() == 0
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, m[1].Tags[rpcAddrTag], handler.addr(m[1].NodeName))
+
+	require.NoError(t, m[2].Leave())
+
+	require.Eventually(t, func() bool {
+		return handler.joinCount() == 2 &&
+			len(m[0].Members()) == 3 &&
+			status(m[0], "2") == serf.StatusLeft &&
+			handler.leaveCount() == 1
+	}, 3*time.Second, 250*time.Millisecond)
+	require.Equal(t, []string{"2"}, handler.leaves)
+}
+
+func TestMembershipRequiresRPCAddr(t *testing.T) {
+	_, err := New(&handler{}, Config{NodeName: "0", BindAddr: freeAddr(t)})
+	require.Error(t, err)
+}
+
+// mから見たnameのメンバーの状態
+func status(m *Membership, name string) serf.MemberStatus {
+	for _, member := range m.Members() {
+		if member.Name == name {
+			return member.Status
+		}
+	}
+	return serf.StatusNone
+}
+
+// 既存のメンバーに参加する新たなメンバーを作成する 最初のメンバーだけがハンドラーの呼び出しを記録する
+func setupMember(t *testing.T, members []*Membership) ([]*Membership, *handler) {
+	t.Helper()
+
+	id := len(members)
+	c := Config{
+		NodeName: fmt.Sprintf("%d", id),
+		BindAddr: freeAddr(t),
+	}
+	c.RPCAddr(freeAddr(t))
+
+	h := &handler{}
+	if len(members) == 0 {
+		h.joins = map[string]string{}
+	} else {
+		c.StartJoinAddrs = []string{members[0].BindAddr}
+	}
+
+	m, err := New(h, c)
+	require.NoError(t, err)
+	t.Cleanup(func() { m.Leave() })
+
+	return append(members, m), h
+}
+
+// ループバックの空いているポートのアドレスを返す
+func freeAddr(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	return ln.Addr().String()
+}
+
+type handler struct {
+	mu     sync.Mutex
+	joins  map[string]string
+	leaves []string
+}
+
+func (h *handler) Join(name, addr string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.joins != nil {
+		h.joins[name] = addr
+	}
+	return nil
+}
+
+func (h *handler) Leave(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.joins != nil {
+		h.leaves = append(h.leaves, name)
+	}
+	return nil
+}
+
+func (h *handler) joinCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.joins)
+}
+
+func (h *handler) leaveCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.leaves)
+}
+
+func (h *handler) addr(name string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.joins[name]
+}
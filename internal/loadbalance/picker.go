@@ -0,0 +1,85 @@
+package loadbalance
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+)
+
+func init() {
+	balancer.Register(base.NewBalancerBuilder(Name, &pickerBuilder{}, base.Config{}))
+}
+
+var _ base.PickerBuilder = (*pickerBuilder)(nil)
+
+type pickerBuilder struct{}
+
+// 接続できたサーバーを役割で分けたPickerを作る 接続できたサーバーが変わるたびに作り直される
+func (b *pickerBuilder) Build(info base.PickerBuildInfo) balancer.Picker {
+	p := &Picker{}
+	for sc, scInfo := range info.ReadySCs {
+		// 切り替えの途中で複数のサーバーがプライマリを名乗っている場合は、そのうちの1つに書き込む
+		if RoleOf(scInfo.Address) == api.Role_ROLE_PRIMARY && p.primary == nil {
+			p.primary = sc
+			continue
+		}
+		p.secondaries = append(p.secondaries, sc)
+	}
+
+	return p
+}
+
+var _ balancer.Picker = (*Picker)(nil)
+
+/*
+RPCごとに送信先のサーバーを選ぶ
+① Produce・ProduceStreamは書き込みを受け付けるサーバー(プライマリ)に送る
+プライマリに接続できていない場合は、次のPickerができるまで待たせる
+② それ以外(Consumeなど)はプライマリ以外のサーバーに順番に送り、プライマリの負荷を減らす
+プライマリ以外のサーバーがない場合と、WithPrimaryのコンテキストのRPCはプライマリに送る
+*/
+type Picker struct {
+	primary     balancer.SubConn
+	secondaries []balancer.SubConn
+	current     uint64
+}
+
+func (p *Picker) Pick(info balancer.PickInfo) (balancer.PickResult, error) {
+	var result balancer.PickResult
+	if strings.Contains(info.FullMethodName, "Produce") || len(p.secondaries) == 0 || toPrimary(info.Ctx) {
+		result.SubConn = p.primary
+	} else {
+		result.SubConn = p.nextSecondary()
+	}
+	if result.SubConn == nil {
+		return result, balancer.ErrNoSubConnAvailable
+	}
+
+	return result, nil
+}
+
+func (p *Picker) nextSecondary() balancer.SubConn {
+	cur := atomic.AddUint64(&p.current, 1)
+
+	return p.secondaries[cur%uint64(len(p.secondaries))]
+}
+
+type primaryKey struct{}
+
+// ctxで送る読み出しもプライマリに送らせる 書き込んだ直後のレコードを読み出す必要がある場合に使う
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func toPrimary(ctx context.Context) bool {
+	if ctx == nil {
+		return false
+	}
+	v, _ := ctx.Value(primaryKey{}).(bool)
+
+	return v
+}
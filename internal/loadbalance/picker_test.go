@@ -0,0 +1,162 @@
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/balancer"
+	"google.golang.org/grpc/balancer/base"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+)
+
+func TestPickerNoSubConnAvailable(t *testing.T) {
+	picker := (&pickerBuilder{}).Build(base.PickerBuildInfo{})
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/Consume",
+	} {
+		_, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+		require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	}
+}
+
+func TestPickerProducesToPrimary(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_ROLE_PRIMARY, api.Role_ROLE_SECONDARY, api.Role_ROLE_SECONDARY)
+	for _, method := range []string{
+		"/log.v1.Log/Produce",
+		"/log.v1.Log/ProduceStream",
+	} {
+		for i := 0; i < 5; i++ {
+			res, err := picker.Pick(balancer.PickInfo{FullMethodName: method})
+			require.NoError(t, err)
+			require.Equal(t, subConns[0], res.SubConn)
+		}
+	}
+}
+
+func TestPickerConsumesFromSecondaries(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_ROLE_PRIMARY, api.Role_ROLE_SECONDARY, api.Role_ROLE_SECONDARY)
+	picked := map[balancer.SubConn]int{}
+	for i := 0; i < 6; i++ {
+		res, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"})
+		require.NoError(t, err)
+		picked[res.SubConn]++
+	}
+	require.Equal(t, map[balancer.SubConn]int{subConns[1]: 3, subConns[2]: 3}, picked)
+
+	// プライマリしかない場合はプライマリから読み出す
+	picker, subConns = setupPicker(api.Role_ROLE_PRIMARY)
+	res, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/ConsumeStream"})
+	require.NoError(t, err)
+	require.Equal(t, subConns[0], res.SubConn)
+
+	// プライマリがない場合は、書き込みだけ待たせる
+	picker, _ = setupPicker(api.Role_ROLE_SECONDARY)
+	_, err = picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Produce"})
+	require.Equal(t, balancer.ErrNoSubConnAvailable, err)
+	_, err = picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume"})
+	require.NoError(t, err)
+}
+
+func TestPickerConsumesFromPrimaryWithPrimary(t *testing.T) {
+	picker, subConns := setupPicker(api.Role_ROLE_PRIMARY, api.Role_ROLE_SECONDARY, api.Role_ROLE_SECONDARY)
+	ctx := WithPrimary(context.Background())
+	for i := 0; i < 5; i++ {
+		res, err := picker.Pick(balancer.PickInfo{FullMethodName: "/log.v1.Log/Consume", Ctx: ctx})
+		require.NoError(t, err)
+		require.Equal(t, subConns[0], res.SubConn)
+	}
+}
+
+// rolesの役割を持つサーバーに接続できた状態のPickerを作る
+func setupPicker(roles ...api.Role) (balancer.Picker, []*subConn) {
+	var subConns []*subConn
+	buildInfo := base.PickerBuildInfo{ReadySCs: map[balancer.SubConn]base.SubConnInfo{}}
+	for i, role := range roles {
+		sc := &subConn{}
+		addr := resolver.Address{
+			Addr:       fmt.Sprintf("node-%d", i),
+			Attributes: attributes.New(roleKey{}, role),
+		}
+		sc.UpdateAddresses([]resolver.Address{addr})
+		buildInfo.ReadySCs[sc] = base.SubConnInfo{Address: addr}
+		subConns = append(subConns, sc)
+	}
+
+	return (&pickerBuilder{}).Build(buildInfo), subConns
+}
+
+// balancer.SubConnを実装する
+type subConn struct {
+	addrs []resolver.Address
+}
+
+func (s *subConn) UpdateAddresses(addrs []resolver.Address) {
+	s.addrs = addrs
+}
+
+func (s *subConn) Connect() {}
+
+/*
+proglog:///で接続したクライアントの振り分けを、実際のサーバーで確かめる
+プライマリ以外は書き込みを拒否するので、Produceが成功すればプライマリに送られている
+読み出しはサーバーごとに異なる値を書き込んでおき、どのサーバーから読み出したかを値で見分ける
+*/
+func TestRouting(t *testing.T) {
+	servers := setupServers(t, 3, nil)
+	for i, s := range servers[1:] {
+		_, err := s.log.Append(&api.Record{Value: []byte(fmt.Sprintf("secondary %d", i+1))})
+		require.NoError(t, err)
+	}
+
+	cc, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", Name, servers[1].addr),
+		grpc.WithResolvers(&Builder{RefreshInterval: 20 * time.Millisecond}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("primary")}})
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+	require.Equal(t, uint64(2), highestOffset(t, servers[0]))
+
+	// 最初の読み出しの前に全てのサーバーに接続しているとは限らないので、両方から読み出すまで繰り返す
+	consumed := map[string]int{}
+	require.Eventually(t, func() bool {
+		res, err := client.Consume(ctx, &api.ConsumeRequest{Offset: 0})
+		require.NoError(t, err)
+		consumed[string(res.Record.Value)]++
+		return consumed["secondary 1"] > 0 && consumed["secondary 2"] > 0
+	}, 3*time.Second, time.Millisecond)
+	require.NotContains(t, consumed, "primary")
+
+	// プライマリを切り替えると、リゾルバーが問い合わせ直した後は新しいプライマリに書き込む
+	setPrimary(servers, servers[2].addr)
+	require.Eventually(t, func() bool {
+		_, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("new primary")}})
+		return err == nil
+	}, 3*time.Second, 10*time.Millisecond)
+	require.Equal(t, uint64(1), highestOffset(t, servers[2]))
+	require.Equal(t, uint64(2), highestOffset(t, servers[0]))
+}
+
+func highestOffset(t *testing.T, s *testServer) uint64 {
+	t.Helper()
+
+	off, err := s.log.HighestOffset()
+	require.NoError(t, err)
+	return off
+}
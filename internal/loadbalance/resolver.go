@@ -0,0 +1,245 @@
+// クライアント側でproglogのクラスタのサーバーを見つけ、RPCを振り分ける
+package loadbalance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/attributes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+)
+
+// リゾルバーのスキームとロードバランサーの名前
+const Name = "proglog"
+
+func init() {
+	resolver.Register(&Builder{})
+}
+
+var _ resolver.Builder = (*Builder)(nil)
+
+/*
+proglog:///<シードのアドレス>,<シードのアドレス>... のターゲットを、クラスタのサーバーのアドレスに解決する
+① シードのサーバー(前回見つけたサーバーも)に順にGetServersで問い合わせ、最初に応答したサーバーの一覧をアドレスにする
+状態を取得できなかったサーバーは含めない アドレスの属性にサーバーの役割を持たせ、Pickerが振り分けに使う
+② RefreshIntervalごと(と接続に失敗してgRPCがResolveNowを呼んだ時)に問い合わせ直し、サーバーの増減や役割の変化を反映する
+③ サービス設定でPickerを使うロードバランサー(proglog)を指定する
+
+init()で既定の設定のBuilderを登録している 設定を変える場合はgrpc.WithResolversで渡す
+リゾルバーにはgrpc.Dialのトランスポートの認証情報しか渡されず、RPCごとの認証情報(ベアラートークン)は引き継げない
+サーバーが認証を要求する場合、既定のBuilderではGetServersがUnauthenticatedで失敗するので、
+grpc.WithPerRPCCredentialsを含めたDialOptionsを設定したBuilderをgrpc.WithResolversで渡す
+*/
+type Builder struct {
+	// シードに問い合わせる時の接続オプション 空の場合はgrpc.Dialに渡したトランスポートの認証情報だけを使う
+	// サーバーが認証を要求する場合はgrpc.WithPerRPCCredentialsを含める
+	DialOptions []grpc.DialOption
+	// サーバーの一覧を問い合わせ直す間隔 0の場合は10秒
+	RefreshInterval time.Duration
+	// 問い合わせの最大時間 0の場合は3秒
+	Timeout time.Duration
+	// 構造化ログの出力先 nilの場合は何も出力しない
+	Logger *zap.Logger
+}
+
+func (b *Builder) Scheme() string {
+	return Name
+}
+
+func (b *Builder) Build(
+	target resolver.Target,
+	cc resolver.ClientConn,
+	opts resolver.BuildOptions,
+) (resolver.Resolver, error) {
+	var seeds []string
+	for _, seed := range strings.Split(target.Endpoint, ",") {
+		if seed = strings.TrimSpace(seed); seed != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	if len(seeds) == 0 {
+		return nil, fmt.Errorf("loadbalance: no seed addresses in %s:///%s", Name, target.Endpoint)
+	}
+
+	r := &proglogResolver{
+		cc:              cc,
+		seeds:           seeds,
+		dialOpts:        b.DialOptions,
+		refreshInterval: b.RefreshInterval,
+		timeout:         b.Timeout,
+		logger:          b.Logger,
+		resolveNow:      make(chan struct{}, 1),
+		close:           make(chan struct{}),
+	}
+	if len(r.dialOpts) == 0 {
+		creds := opts.DialCreds
+		if creds == nil {
+			creds = insecure.NewCredentials()
+		}
+		r.dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(creds)}
+	}
+	if r.refreshInterval == 0 {
+		r.refreshInterval = 10 * time.Second
+	}
+	if r.timeout == 0 {
+		r.timeout = 3 * time.Second
+	}
+	if r.logger == nil {
+		r.logger = zap.NewNop()
+	}
+	r.logger = r.logger.Named("resolver")
+	r.serviceConfig = cc.ParseServiceConfig(fmt.Sprintf(`{"loadBalancingConfig":[{%q:{}}]}`, Name))
+
+	// 最初の解決はgrpc.Dialの中で行い、最初のRPCからサーバーを選べるようにする
+	r.resolve()
+	r.wg.Add(1)
+	go r.refreshLoop()
+
+	return r, nil
+}
+
+// アドレスの属性でサーバーの役割(api.Role)を持たせる時のキー
+type roleKey struct{}
+
+// アドレスのサーバーの役割 リゾルバーが設定していない場合はROLE_UNKNOWN
+func RoleOf(addr resolver.Address) api.Role {
+	role, _ := addr.Attributes.Value(roleKey{}).(api.Role)
+	return role
+}
+
+var _ resolver.Resolver = (*proglogResolver)(nil)
+
+type proglogResolver struct {
+	cc              resolver.ClientConn
+	seeds           []string
+	dialOpts        []grpc.DialOption
+	refreshInterval time.Duration
+	timeout         time.Duration
+	logger          *zap.Logger
+	serviceConfig   *serviceconfig.ParseResult
+
+	// 前回見つけたサーバーのアドレス シードが全て停止していても、これらに問い合わせられる
+	mu    sync.Mutex
+	known []string
+
+	resolveNow chan struct{}
+	close      chan struct{}
+	wg         sync.WaitGroup
+}
+
+// 次の問い合わせを待たずに問い合わせ直す
+func (r *proglogResolver) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case r.resolveNow <- struct{}{}:
+	default:
+	}
+}
+
+func (r *proglogResolver) Close() {
+	close(r.close)
+	r.wg.Wait()
+}
+
+func (r *proglogResolver) refreshLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.refreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		case <-r.resolveNow:
+		}
+		r.resolve()
+	}
+}
+
+// シードと前回見つけたサーバーに順に問い合わせ、最初に応答したサーバーの一覧でアドレスを更新する
+func (r *proglogResolver) resolve() {
+	r.mu.Lock()
+	candidates := append(append([]string{}, r.seeds...), r.known...)
+	r.mu.Unlock()
+
+	var (
+		addrs []resolver.Address
+		err   error
+	)
+	tried := map[string]bool{}
+	for _, candidate := range candidates {
+		if tried[candidate] {
+			continue
+		}
+		tried[candidate] = true
+
+		if addrs, err = r.getServers(candidate); err == nil {
+			break
+		}
+		r.logger.Debug("failed to get servers", zap.String("addr", candidate), zap.Error(err))
+	}
+	if err != nil {
+		r.logger.Warn("failed to resolve servers", zap.Error(err))
+		r.cc.ReportError(err)
+		return
+	}
+
+	r.mu.Lock()
+	r.known = r.known[:0]
+	for _, addr := range addrs {
+		r.known = append(r.known, addr.Addr)
+	}
+	r.mu.Unlock()
+
+	if err := r.cc.UpdateState(resolver.State{
+		Addresses:     addrs,
+		ServiceConfig: r.serviceConfig,
+	}); err != nil {
+		r.logger.Debug("failed to update state", zap.Error(err))
+	}
+}
+
+// addrのサーバーにGetServersで問い合わせる アドレスを設定していないサーバー(一覧を持たないサーバー自身)はaddrとする
+func (r *proglogResolver) getServers(addr string) ([]resolver.Address, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	cc, err := grpc.DialContext(ctx, addr, r.dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+
+	res, err := api.NewLogClient(cc).GetServers(ctx, &api.GetServersRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []resolver.Address
+	for _, server := range res.Servers {
+		if server.Error != "" {
+			continue
+		}
+		rpcAddr := server.RpcAddr
+		if rpcAddr == "" {
+			rpcAddr = addr
+		}
+		addrs = append(addrs, resolver.Address{
+			Addr:       rpcAddr,
+			Attributes: attributes.New(roleKey{}, server.Role),
+		})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("loadbalance: %s returned no available servers", addr)
+	}
+
+	return addrs, nil
+}
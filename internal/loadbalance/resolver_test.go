@@ -0,0 +1,224 @@
+package loadbalance
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/KeisukeYamane/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/serviceconfig"
+	"google.golang.org/grpc/status"
+)
+
+type testServer struct {
+	addr    string
+	log     *log.Log
+	primary *server.Primary
+	grpc    *grpc.Server
+}
+
+/*
+それぞれのログを持つnodeCount個のサーバーを起動する 最初のサーバーをプライマリにし、
+GetServersは全てのサーバーを返す プライマリ以外は書き込みを拒否するので、振り分けを誤るとProduceが失敗する
+authenticatorがnilでなければ、サーバーは認証を要求する
+*/
+func setupServers(t *testing.T, nodeCount int, authenticator server.Authenticator) []*testServer {
+	t.Helper()
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	source := &server.StaticServers{DialOptions: dialOpts}
+
+	var (
+		servers   []*testServer
+		listeners []net.Listener
+	)
+	for i := 0; i < nodeCount; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+		source.Servers = append(source.Servers, server.StaticServer{
+			ID:      fmt.Sprintf("node-%d", i),
+			RPCAddr: l.Addr().String(),
+		})
+	}
+
+	for _, l := range listeners {
+		clog, err := log.NewLog(t.TempDir(), log.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { clog.Close() })
+
+		primary := server.NewPrimary(l.Addr().String(), listeners[0].Addr().String(), server.RedirectWrites)
+		gsrv, err := server.NewGRPCServer(&server.Config{
+			CommitLog:     clog,
+			Authenticator: authenticator,
+			Primary:       primary,
+			Servers:       source,
+		})
+		require.NoError(t, err)
+		go gsrv.Serve(l)
+		t.Cleanup(gsrv.Stop)
+
+		servers = append(servers, &testServer{
+			addr:    l.Addr().String(),
+			log:     clog,
+			primary: primary,
+			grpc:    gsrv,
+		})
+	}
+
+	return servers
+}
+
+// 全てのサーバーのプライマリを切り替える
+func setPrimary(servers []*testServer, addr string) {
+	for _, s := range servers {
+		s.primary.SetAddr(addr)
+	}
+}
+
+func TestResolver(t *testing.T) {
+	servers := setupServers(t, 3, nil)
+
+	conn := &clientConn{}
+	r, err := (&Builder{RefreshInterval: 20 * time.Millisecond}).Build(
+		resolver.Target{Endpoint: servers[1].addr},
+		conn,
+		resolver.BuildOptions{},
+	)
+	require.NoError(t, err)
+	defer r.Close()
+
+	// シードが返したサーバーの一覧を、役割の属性を付けたアドレスにする
+	require.Equal(t, map[string]api.Role{
+		servers[0].addr: api.Role_ROLE_PRIMARY,
+		servers[1].addr: api.Role_ROLE_SECONDARY,
+		servers[2].addr: api.Role_ROLE_SECONDARY,
+	}, conn.roles())
+	require.NotNil(t, conn.state().ServiceConfig)
+
+	// プライマリを切り替えると、次の問い合わせで役割が変わる
+	setPrimary(servers, servers[2].addr)
+	require.Eventually(t, func() bool {
+		return conn.roles()[servers[2].addr] == api.Role_ROLE_PRIMARY
+	}, time.Second, 10*time.Millisecond)
+
+	// シードが停止しても、前回見つけたサーバーに問い合わせる 停止したサーバーは一覧から外れる
+	servers[1].grpc.Stop()
+	require.Eventually(t, func() bool {
+		_, ok := conn.roles()[servers[1].addr]
+		return !ok && len(conn.roles()) == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestResolverAuthentication(t *testing.T) {
+	servers := setupServers(t, 1, testToken("secret"))
+
+	// 既定のBuilderはトランスポートの認証情報しか使わないので、問い合わせが認証で失敗する
+	conn := &clientConn{}
+	r, err := (&Builder{}).Build(
+		resolver.Target{Endpoint: servers[0].addr},
+		conn,
+		resolver.BuildOptions{DialCreds: insecure.NewCredentials()},
+	)
+	require.NoError(t, err)
+	r.Close()
+	require.Empty(t, conn.state().Addresses)
+	require.Equal(t, codes.Unauthenticated, status.Code(conn.err()))
+
+	// DialOptionsでトークンを渡せば解決できる
+	conn = &clientConn{}
+	r, err = (&Builder{DialOptions: []grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithPerRPCCredentials(testToken("secret")),
+	}}).Build(resolver.Target{Endpoint: servers[0].addr}, conn, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+	require.NoError(t, conn.err())
+	require.Equal(t, map[string]api.Role{servers[0].addr: api.Role_ROLE_PRIMARY}, conn.roles())
+}
+
+// 自身と一致するトークンだけを受け付けるAuthenticator 「authorization: Bearer <token>」としても送信する
+type testToken string
+
+func (t testToken) Authenticate(token string) (string, error) {
+	if token != string(t) {
+		return "", errors.New("invalid token")
+	}
+	return "client", nil
+}
+
+func (t testToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+func (t testToken) RequireTransportSecurity() bool {
+	return false
+}
+
+func TestResolverNoSeeds(t *testing.T) {
+	_, err := (&Builder{}).Build(resolver.Target{Endpoint: " , "}, &clientConn{}, resolver.BuildOptions{})
+	require.Error(t, err)
+}
+
+// リゾルバーが更新した状態を記録するresolver.ClientConn
+type clientConn struct {
+	resolver.ClientConn
+
+	mu sync.Mutex
+	s  resolver.State
+	e  error
+}
+
+func (c *clientConn) UpdateState(state resolver.State) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.s = state
+	return nil
+}
+
+func (c *clientConn) ReportError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.e = err
+}
+
+func (c *clientConn) ParseServiceConfig(config string) *serviceconfig.ParseResult {
+	return &serviceconfig.ParseResult{}
+}
+
+func (c *clientConn) state() resolver.State {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.s
+}
+
+// 最後に報告された解決の失敗
+func (c *clientConn) err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.e
+}
+
+// アドレスから役割へのマップ
+func (c *clientConn) roles() map[string]api.Role {
+	roles := map[string]api.Role{}
+	for _, addr := range c.state().Addresses {
+		roles[addr.Addr] = RoleOf(addr)
+	}
+	return roles
+}
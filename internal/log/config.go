@@ -1,5 +1,14 @@
 package log
 
+import (
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
 // ログの設定を一元的に管理する
 
 // structの入れ子にすることでConfig.Segment.MaxindexBytesのようにアクセスが可能
@@ -9,4 +18,50 @@ type Config struct {
 		MaxIndexBytes uint64
 		InitialOffset uint64
 	}
+	// 構造化ログの出力先 nilの場合は何も出力しない
+	// 書き込みのたびに出力されるログがあるので、サンプリングを設定したロガーを渡すこと(internal/loggingを参照)
+	Logger *zap.Logger
+	// メトリクスの登録先 nilの場合は登録しない
+	Registerer prometheus.Registerer
+	// 書き込み・読み出し・セグメントの切り替えのスパンの作成元 nilの場合はスパンを作成しない
+	TracerProvider trace.TracerProvider
+	// trueの場合はディレクトリの共有ロックを取得し、ファイルを一切変更せずに開く(ツールやバックアップ用)
+	// 書き込むログと同時には開けず、AppendやTruncateなどはErrReadOnlyを返す
+	ReadOnly bool
+	// OpenReadOnlyで開いたログが、書き込み中のディレクトリを確認する間隔 0の場合は250ミリ秒
+	FollowInterval time.Duration
+	// 書き込むログが、アクティブセグメントのバッファをファイルに書き出す間隔 0の場合は100ミリ秒
+	// 書き込みが少なくても、OpenReadOnlyで開いたログからレコードがこの間隔で見えるようになる
+	FlushInterval time.Duration
+
+	// 書き込みが終わった古いセグメントの移動先 Storeがnilの場合は移さない(tier.goを参照)
+	Tier struct {
+		Store SegmentStore
+		// アップロードしたセグメントのファイルを、最後に書き込まれて(読み出すために取得されて)からローカルに残しておく期間
+		HotWindow time.Duration
+		// アップロードとファイルの削除を行う間隔 0の場合は1分
+		Interval time.Duration
+	}
+
+	// DistributedLogの設定(distributed.goを参照) Logだけを使う場合は設定しなくてよい
+	Raft struct {
+		// LocalID(クラスタ内で一意なID)と、0以外を設定したタイムアウトなどを使う それ以外はraft.DefaultConfigの値になる
+		raft.Config
+		// 他のノードとの通信に使う 必須
+		StreamLayer *StreamLayer
+		// trueの場合、Raftの状態がなければ自身だけのクラスタを作る 最初のノードだけをtrueにする
+		Bootstrap bool
+	}
+
+	// OpenReadOnlyで開いた場合はtrue ロックを取得せず、書き込み中のファイルを追いかける
+	follow bool
+}
+
+// nilの場合でもそのまま使えるロガーを返す
+func (c Config) logger() *zap.Logger {
+	if c.Logger == nil {
+		return zap.NewNop()
+	}
+
+	return c.Logger
 }
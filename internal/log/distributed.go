@@ -0,0 +1,538 @@
+package log
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Raftで合意を取りながら複製するログ
+リーダーへの書き込みはRaftのログに追加され、過半数のノードに複製(コミット)されてから各ノードのFSMが自身のログに書き込む
+そのため全てのノードで同じレコードが同じオフセットに書き込まれ、Replicatorのように複製が循環したりオフセットがずれたりしない
+
+ディレクトリの構成
+  - dataDir/log: FSMが書き込むログ(Readで読み出す)
+  - dataDir/raft/log: Raftのエントリ(logStore)
+  - dataDir/raft: Raftの状態(raft.db)とスナップショット
+*/
+type DistributedLog struct {
+	config Config
+	log    *Log
+	raft   *raft.Raft
+	// Raftのエントリを保存する
+	logStore *logStore
+	// Raftの状態(現在の任期や投票先)を保存する
+	stableStore *raftboltdb.BoltStore
+}
+
+func NewDistributedLog(dataDir string, config Config) (*DistributedLog, error) {
+	l := &DistributedLog{
+		config: config,
+	}
+	if err := l.setupLog(dataDir); err != nil {
+		return nil, err
+	}
+	if err := l.setupRaft(dataDir); err != nil {
+		l.log.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *DistributedLog) setupLog(dataDir string) error {
+	logDir := filepath.Join(dataDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+
+	var err error
+	l.log, err = NewLog(logDir, l.config)
+	return err
+}
+
+/*
+Raftのインスタンスを作成する
+① FSM: コミットされたエントリをログに書き込む
+② ログストア・安定ストア: Raftのエントリをセグメントに保存し(logstore.goを参照)、現在の任期・投票先をraft.dbに保存する
+③ スナップショットストア: FSMのスナップショットを保存し、遅れたノードや新しいノードに送る
+④ トランスポート: StreamLayerを使って他のノードと通信する
+*/
+func (l *DistributedLog) setupRaft(dataDir string) error {
+	raftDir := filepath.Join(dataDir, "raft")
+	if err := os.MkdirAll(raftDir, 0755); err != nil {
+		return err
+	}
+
+	if l.config.Raft.StreamLayer == nil {
+		return fmt.Errorf("log: Config.Raft.StreamLayer is required")
+	}
+
+	fsm, err := newFSM(l.log)
+	if err != nil {
+		return err
+	}
+
+	logDir := filepath.Join(raftDir, "log")
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		return err
+	}
+	// メトリクスとConfig.Tier.StoreはFSMのログのものなので、Raftのエントリには使わない
+	logConfig := l.config
+	logConfig.Registerer = nil
+	logConfig.Tier.Store = nil
+	if l.logStore, err = newLogStore(logDir, logConfig); err != nil {
+		return err
+	}
+
+	l.stableStore, err = raftboltdb.NewBoltStore(filepath.Join(raftDir, "raft.db"))
+	if err != nil {
+		l.logStore.Close()
+		return err
+	}
+
+	logOutput := zap.NewStdLog(l.config.logger().Named("raft")).Writer()
+
+	// スナップショットは最新の1つだけを残す
+	snapshotStore, err := raft.NewFileSnapshotStore(raftDir, 1, logOutput)
+	if err != nil {
+		l.closeStores()
+		return err
+	}
+
+	maxPool := 5
+	timeout := 10 * time.Second
+	transport := raft.NewNetworkTransport(l.config.Raft.StreamLayer, maxPool, timeout, logOutput)
+
+	config := raft.DefaultConfig()
+	config.LocalID = l.config.Raft.LocalID
+	config.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Output: logOutput,
+		Level:  hclog.Info,
+	})
+	if l.config.Raft.HeartbeatTimeout != 0 {
+		config.HeartbeatTimeout = l.config.Raft.HeartbeatTimeout
+	}
+	if l.config.Raft.ElectionTimeout != 0 {
+		config.ElectionTimeout = l.config.Raft.ElectionTimeout
+	}
+	if l.config.Raft.LeaderLeaseTimeout != 0 {
+		config.LeaderLeaseTimeout = l.config.Raft.LeaderLeaseTimeout
+	}
+	if l.config.Raft.CommitTimeout != 0 {
+		config.CommitTimeout = l.config.Raft.CommitTimeout
+	}
+	if l.config.Raft.SnapshotThreshold != 0 {
+		config.SnapshotThreshold = l.config.Raft.SnapshotThreshold
+	}
+
+	l.raft, err = raft.NewRaft(config, fsm, l.logStore, l.stableStore, snapshotStore, transport)
+	if err != nil {
+		l.closeStores()
+		return err
+	}
+
+	// 最初のノードだけが自身を唯一の投票者としてクラスタを作る 他のノードはリーダーのJoinで追加される
+	hasState, err := raft.HasExistingState(l.logStore, l.stableStore, snapshotStore)
+	if err != nil {
+		return err
+	}
+	if l.config.Raft.Bootstrap && !hasState {
+		config := raft.Configuration{
+			Servers: []raft.Server{{
+				ID:      config.LocalID,
+				Address: transport.LocalAddr(),
+			}},
+		}
+		err = l.raft.BootstrapCluster(config).Error()
+	}
+
+	return err
+}
+
+/*
+レコードをRaftのログに追加し、過半数のノードにコミットされてリーダーのFSMが書き込んでから、そのオフセットを返す
+リーダー以外のノードで呼び出した場合はraft.ErrNotLeaderを返す
+*/
+func (l *DistributedLog) Append(record *api.Record) (uint64, error) {
+	res, err := l.apply(AppendRequestType, &api.ProduceRequest{Record: record})
+	if err != nil {
+		return 0, err
+	}
+
+	return res.(*api.ProduceResponse).Offset, nil
+}
+
+// リクエストの種類を1バイト目に書き、続けてリクエストをマーシャルしたものをRaftのログに追加する
+func (l *DistributedLog) apply(reqType RequestType, req proto.Message) (interface{}, error) {
+	var buf bytes.Buffer
+	if _, err := buf.Write([]byte{byte(reqType)}); err != nil {
+		return nil, err
+	}
+	b, err := proto.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := buf.Write(b); err != nil {
+		return nil, err
+	}
+
+	timeout := 10 * time.Second
+	future := l.raft.Apply(buf.Bytes(), timeout)
+	if future.Error() != nil {
+		return nil, future.Error()
+	}
+
+	// FSMのApplyが返したエラーはfuture.Errorではなく、レスポンスとして返る
+	res := future.Response()
+	if err, ok := res.(error); ok {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+/*
+このノードのログからレコードを読み出す
+フォロワーではコミット済みでもまだFSMが書き込んでいないレコードは読み出せない(緩やかな一貫性)
+*/
+func (l *DistributedLog) Read(offset uint64) (*api.Record, error) {
+	return l.log.Read(offset)
+}
+
+/*
+ノードをクラスタに投票者として追加する リーダーで呼び出す必要がある
+discovery.Handlerを実装しているので、Membershipに渡すとクラスタに参加したノードを追加する
+同じIDかアドレスで異なるノードが登録されている場合は、それを削除してから追加する
+*/
+func (l *DistributedLog) Join(id, addr string) error {
+	configFuture := l.raft.GetConfiguration()
+	if err := configFuture.Error(); err != nil {
+		return err
+	}
+
+	serverID := raft.ServerID(id)
+	serverAddr := raft.ServerAddress(addr)
+	for _, srv := range configFuture.Configuration().Servers {
+		if srv.ID == serverID || srv.Address == serverAddr {
+			if srv.ID == serverID && srv.Address == serverAddr {
+				// 既に参加している
+				return nil
+			}
+			if err := l.raft.RemoveServer(srv.ID, 0, 0).Error(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return l.raft.AddVoter(serverID, serverAddr, 0, 0).Error()
+}
+
+// ノードをクラスタから削除する リーダーで呼び出す必要がある
+func (l *DistributedLog) Leave(id string) error {
+	return l.raft.RemoveServer(raft.ServerID(id), 0, 0).Error()
+}
+
+// クラスタのリーダーが選出されるまで待つ timeoutを過ぎた場合はエラーを返す
+func (l *DistributedLog) WaitForLeader(timeout time.Duration) error {
+	timeoutc := time.After(timeout)
+	ticker := time.NewTicker(time.Second / 10)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-timeoutc:
+			return fmt.Errorf("log: timed out waiting for a leader")
+		case <-ticker.C:
+			if l.raft.Leader() != "" {
+				return nil
+			}
+		}
+	}
+}
+
+// Raftを停止してから、Raftのストアとログを閉じる
+func (l *DistributedLog) Close() error {
+	if err := l.raft.Shutdown().Error(); err != nil {
+		return err
+	}
+	if err := l.closeStores(); err != nil {
+		return err
+	}
+
+	return l.log.Close()
+}
+
+func (l *DistributedLog) closeStores() error {
+	if err := l.logStore.Close(); err != nil {
+		return err
+	}
+
+	return l.stableStore.Close()
+}
+
+// Raftのログに追加するリクエストの種類
+type RequestType uint8
+
+const (
+	AppendRequestType RequestType = 0
+)
+
+var _ raft.FSM = (*fsm)(nil)
+
+/*
+コミットされたRaftのエントリをログに書き込む有限状態機械
+再起動するとRaftはコミット済みのエントリを(スナップショットがあればその後から)もう一度適用するので、
+レコードに書き込んだエントリのインデックス(RaftIndex)を入れておき、ログの末尾のレコードのインデックス以下のエントリは書き込まない
+*/
+type fsm struct {
+	log *Log
+	// ログに書き込んだ最後のエントリのインデックス
+	applied uint64
+}
+
+func newFSM(log *Log) (*fsm, error) {
+	f := &fsm{log: log}
+	if err := f.loadApplied(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ログの末尾のレコードから、書き込んだ最後のエントリのインデックスを求める 空のログの場合は0
+func (f *fsm) loadApplied() error {
+	f.applied = 0
+	off, err := f.log.HighestOffset()
+	if err != nil {
+		return err
+	}
+	record, err := f.log.Read(off)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	f.applied = record.RaftIndex
+
+	return nil
+}
+
+func (f *fsm) Apply(record *raft.Log) interface{} {
+	buf := record.Data
+	reqType := RequestType(buf[0])
+	switch reqType {
+	case AppendRequestType:
+		return f.applyAppend(record.Index, buf[1:])
+	}
+
+	return fmt.Errorf("log: unknown request type %d", reqType)
+}
+
+func (f *fsm) applyAppend(index uint64, b []byte) interface{} {
+	// 再起動する前に書き込んだエントリ 応答を待っているAppendはないので何も返さない
+	if index <= f.applied {
+		return nil
+	}
+
+	var req api.ProduceRequest
+	if err := proto.Unmarshal(b, &req); err != nil {
+		return err
+	}
+	req.Record.RaftIndex = index
+	offset, err := f.log.Append(req.Record)
+	if err != nil {
+		return err
+	}
+	f.applied = index
+
+	return &api.ProduceResponse{Offset: offset}
+}
+
+/*
+ログ全体を読み出すReaderをスナップショットにする 書き込みはPersistでシンクにコピーする時に行う
+RaftはApplyと同時にSnapshotを呼び出さないので、Readerを作成した時点のログがこのスナップショットのエントリまでの状態になる
+(Readerはその時点の大きさまでしか読み出さないので、Persistの間にApplyが書き込んだレコードは含まない)
+*/
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	r := f.log.Reader()
+
+	return &snapshot{reader: r}, nil
+}
+
+/*
+スナップショットからログを作り直す
+スナップショットはストアと同じ形式(長さ8バイトとレコード)なので、1件ずつ読み出して書き込む
+① 同じオフセットに同じエントリのレコードがある間は、既に書き込んでいるので読み飛ばす(再起動した時など)
+② 最初のレコードが異なる場合は、そのオフセットから始まるように、書き込む前にログを作り直す
+③ 途中から異なる場合は、そのオフセットより後ろを取り除いてから書き込む
+書き込んだ後は、ログの末尾のレコードからRaftが次に適用するエントリを判断する
+*/
+func (f *fsm) Restore(r io.ReadCloser) error {
+	defer r.Close()
+
+	b := make([]byte, lenWidth)
+	var buf bytes.Buffer
+	matching := true
+	for i := 0; ; i++ {
+		_, err := io.ReadFull(r, b)
+		if err == io.EOF {
+			if i == 0 {
+				// 空のスナップショットの場合は、空のログにする
+				if err := f.log.Reset(); err != nil {
+					return err
+				}
+			}
+			return f.loadApplied()
+		}
+		if err != nil {
+			return err
+		}
+
+		size := int64(enc.Uint64(b))
+		if _, err = io.CopyN(&buf, r, size); err != nil {
+			return err
+		}
+
+		record := &api.Record{}
+		if err = proto.Unmarshal(buf.Bytes(), record); err != nil {
+			return err
+		}
+
+		buf.Reset()
+
+		if matching {
+			if f.hasRecord(record) {
+				continue
+			}
+			matching = false
+			if i == 0 {
+				f.log.Config.Segment.InitialOffset = record.Offset
+				err = f.log.Reset()
+			} else {
+				err = f.log.TruncateAfter(record.Offset - 1)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		if _, err = f.log.Append(record); err != nil {
+			return err
+		}
+	}
+}
+
+// ログのrecordのオフセットに、同じエントリから書き込んだレコードがあるか
+func (f *fsm) hasRecord(record *api.Record) bool {
+	if record.RaftIndex == 0 {
+		return false
+	}
+	got, err := f.log.Read(record.Offset)
+
+	return err == nil && got.RaftIndex == record.RaftIndex
+}
+
+var _ raft.FSMSnapshot = (*snapshot)(nil)
+
+type snapshot struct {
+	reader io.Reader
+}
+
+func (s *snapshot) Persist(sink raft.SnapshotSink) error {
+	if _, err := io.Copy(sink, s.reader); err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *snapshot) Release() {}
+
+var _ raft.StreamLayer = (*StreamLayer)(nil)
+
+/*
+Raftのノード間の通信に使うコネクションを作る
+RPCのサーバーとポートを共有できるように、接続した直後に1バイト(RaftRPC)を送ってRaftの接続であることを示す
+(受け付ける側はcmuxなどでこの1バイトを見て振り分ける)
+TLSの設定がある場合は、その1バイトの後でTLSのハンドシェイクを行う
+*/
+type StreamLayer struct {
+	ln              net.Listener
+	serverTLSConfig *tls.Config
+	peerTLSConfig   *tls.Config
+}
+
+// Raftの接続であることを示す1バイト目
+const RaftRPC = 1
+
+func NewStreamLayer(ln net.Listener, serverTLSConfig, peerTLSConfig *tls.Config) *StreamLayer {
+	return &StreamLayer{
+		ln:              ln,
+		serverTLSConfig: serverTLSConfig,
+		peerTLSConfig:   peerTLSConfig,
+	}
+}
+
+func (s *StreamLayer) Dial(addr raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.Dial("tcp", string(addr))
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = conn.Write([]byte{byte(RaftRPC)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if s.peerTLSConfig != nil {
+		conn = tls.Client(conn, s.peerTLSConfig)
+	}
+
+	return conn, nil
+}
+
+func (s *StreamLayer) Accept() (net.Conn, error) {
+	conn, err := s.ln.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 1)
+	if _, err = conn.Read(b); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !bytes.Equal([]byte{byte(RaftRPC)}, b) {
+		conn.Close()
+		return nil, fmt.Errorf("log: not a raft rpc")
+	}
+	if s.serverTLSConfig != nil {
+		return tls.Server(conn, s.serverTLSConfig), nil
+	}
+
+	return conn, nil
+}
+
+func (s *StreamLayer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *StreamLayer) Addr() net.Addr {
+	return s.ln.Addr()
+}
@@ -0,0 +1,317 @@
+package log
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+// ループバックで通信するnodeCount個のノードのクラスタを作る 最初のノードがリーダーになる
+func newTestCluster(t *testing.T, nodeCount int) []*DistributedLog {
+	t.Helper()
+
+	var logs []*DistributedLog
+	for i := 0; i < nodeCount; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		config := Config{}
+		config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+		config.Raft.LocalID = raft.ServerID(fmt.Sprintf("%d", i))
+		config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+		config.Raft.ElectionTimeout = 50 * time.Millisecond
+		config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+		config.Raft.CommitTimeout = 5 * time.Millisecond
+		config.Raft.Bootstrap = i == 0
+
+		l, err := NewDistributedLog(t.TempDir(), config)
+		require.NoError(t, err)
+		t.Cleanup(func() { l.Close() })
+
+		if i == 0 {
+			require.NoError(t, l.WaitForLeader(3*time.Second))
+		} else {
+			require.NoError(t, logs[0].Join(fmt.Sprintf("%d", i), ln.Addr().String()))
+		}
+		logs = append(logs, l)
+	}
+
+	return logs
+}
+
+func TestDistributedLog(t *testing.T) {
+	logs := newTestCluster(t, 3)
+
+	// リーダーへの書き込みは、全てのノードで同じオフセットに書き込まれる
+	records := []*api.Record{
+		{Value: []byte("first")},
+		{Value: []byte("second")},
+	}
+	for _, record := range records {
+		off, err := logs[0].Append(record)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			for _, l := range logs {
+				got, err := l.Read(off)
+				if err != nil || string(got.Value) != string(record.Value) || got.Offset != off {
+					return false
+				}
+			}
+			return true
+		}, 500*time.Millisecond, 50*time.Millisecond)
+	}
+
+	// フォロワーには書き込めない
+	_, err := logs[1].Append(&api.Record{Value: []byte("follower")})
+	require.ErrorIs(t, err, raft.ErrNotLeader)
+
+	// クラスタから削除したノードには複製されない
+	require.NoError(t, logs[0].Leave("1"))
+	time.Sleep(50 * time.Millisecond)
+
+	off, err := logs[0].Append(&api.Record{Value: []byte("third")})
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+
+	record, err := logs[1].Read(off)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.Nil(t, record)
+
+	require.Eventually(t, func() bool {
+		record, err := logs[2].Read(off)
+		return err == nil && string(record.Value) == "third" && record.Offset == off
+	}, 500*time.Millisecond, 50*time.Millisecond)
+}
+
+// リーダーに書き込めても、過半数のノードに複製できなければAppendは成功しない
+func TestDistributedLogQuorum(t *testing.T) {
+	logs := newTestCluster(t, 3)
+
+	_, err := logs[0].Append(&api.Record{Value: []byte("committed")})
+	require.NoError(t, err)
+
+	require.NoError(t, logs[1].Close())
+	require.NoError(t, logs[2].Close())
+
+	res, err := logs[0].apply(AppendRequestType, &api.ProduceRequest{Record: &api.Record{Value: []byte("lost")}})
+	require.Error(t, err)
+	require.Nil(t, res)
+	_, err = logs[0].Read(1)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// 新しく参加したノードは、スナップショットからログを作り直してから続きを複製する
+func TestDistributedLogSnapshot(t *testing.T) {
+	logs := newTestCluster(t, 1)
+
+	for i := 0; i < 3; i++ {
+		_, err := logs[0].Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	// スナップショットに含めたエントリを全て削除し、フォロワーにはスナップショットを送らせる
+	require.NoError(t, logs[0].raft.ReloadConfig(raft.ReloadableConfig{
+		TrailingLogs:      0,
+		SnapshotInterval:  time.Hour,
+		SnapshotThreshold: 8192,
+	}))
+	require.NoError(t, logs[0].raft.Snapshot().Error())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "1"
+	follower, err := NewDistributedLog(t.TempDir(), config)
+	require.NoError(t, err)
+	defer follower.Close()
+	require.NoError(t, logs[0].Join("1", ln.Addr().String()))
+
+	_, err = logs[0].Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(3)
+		return err == nil && string(record.Value) == "record 3"
+	}, 3*time.Second, 50*time.Millisecond)
+	for i := uint64(0); i < 3; i++ {
+		record, err := follower.Read(i)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", i), string(record.Value))
+	}
+}
+
+// dirで単一ノードのクラスタを開き、リーダーになるまで待つ 開き直す時は同じアドレスで待ち受ける
+func openSingleNode(t *testing.T, dir, addr string) *DistributedLog {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	config := Config{}
+	config.Raft.StreamLayer = NewStreamLayer(ln, nil, nil)
+	config.Raft.LocalID = "0"
+	config.Raft.HeartbeatTimeout = 50 * time.Millisecond
+	config.Raft.ElectionTimeout = 50 * time.Millisecond
+	config.Raft.LeaderLeaseTimeout = 50 * time.Millisecond
+	config.Raft.CommitTimeout = 5 * time.Millisecond
+	config.Raft.Bootstrap = true
+
+	l, err := NewDistributedLog(dir, config)
+	require.NoError(t, err)
+	require.NoError(t, l.WaitForLeader(3*time.Second))
+
+	return l
+}
+
+func distributedValues(t *testing.T, l *DistributedLog) []string {
+	t.Helper()
+
+	var values []string
+	for off := uint64(0); ; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return values
+		}
+		require.NoError(t, err)
+		values = append(values, string(record.Value))
+	}
+}
+
+// 開き直すとRaftはコミット済みのエントリを適用し直すが、書き込み済みのレコードは二度書き込まない
+func TestDistributedLogReopen(t *testing.T) {
+	dir := t.TempDir()
+	l := openSingleNode(t, dir, "127.0.0.1:0")
+	addr := l.config.Raft.StreamLayer.Addr().String()
+	for i := 0; i < 3; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, l.Close())
+
+	// スナップショットがない場合は、全てのエントリが適用し直される
+	l = openSingleNode(t, dir, addr)
+	off, err := l.Append(&api.Record{Value: []byte("record 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.Equal(t, []string{"record 0", "record 1", "record 2", "record 3"}, distributedValues(t, l))
+
+	// スナップショットがある場合は、スナップショットから復元してからその後のエントリが適用し直される
+	require.NoError(t, l.raft.Snapshot().Error())
+	_, err = l.Append(&api.Record{Value: []byte("record 4")})
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	l = openSingleNode(t, dir, addr)
+	defer l.Close()
+	off, err = l.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	require.Equal(t, []string{"record 0", "record 1", "record 2", "record 3", "record 4", "record 5"}, distributedValues(t, l))
+}
+
+// テスト用のメモリ上のSnapshotSink
+type memSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *memSink) ID() string    { return "mem" }
+func (s *memSink) Cancel() error { s.canceled = true; return nil }
+func (s *memSink) Close() error  { return nil }
+
+// Persistでコピーしている間に書き込まれたレコードは、スナップショットに含まれない
+func TestFSMSnapshotConsistent(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	f := &fsm{log: l}
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	// アクティブセグメントへの書き込みと、新しいセグメントへの書き込み
+	for i := 5; i < 8; i++ {
+		_, err := l.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var sink memSink
+	require.NoError(t, snap.Persist(&sink))
+	require.False(t, sink.canceled)
+
+	restored, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, (&fsm{log: restored}).Restore(io.NopCloser(&sink.Buffer)))
+
+	for off := uint64(0); off < 5; off++ {
+		record, err := restored.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+	}
+	// Raftがスナップショットの後のエントリを適用すると、同じオフセットに書き込まれる
+	off, err := restored.Append(&api.Record{Value: []byte("record 5")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+}
+
+// Raftのエントリと同じ形式で、レコードを追加するエントリを作る
+func appendEntry(t *testing.T, index uint64, value string) *raft.Log {
+	t.Helper()
+
+	b, err := proto.Marshal(&api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+	require.NoError(t, err)
+
+	return &raft.Log{Index: index, Type: raft.LogCommand, Data: append([]byte{byte(AppendRequestType)}, b...)}
+}
+
+// 先頭を切り詰めたログをスナップショットで作り直した場合も、その後のエントリを適用し直す
+func TestFSMRestoreAfterTruncate(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	l, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer l.Close()
+	f, err := newFSM(l)
+	require.NoError(t, err)
+
+	entries := []*raft.Log{}
+	for i := uint64(1); i <= 5; i++ {
+		entries = append(entries, appendEntry(t, i, fmt.Sprintf("record %d", i-1)))
+	}
+	for _, e := range entries[:3] {
+		require.IsType(t, &api.ProduceResponse{}, f.Apply(e))
+	}
+	snap, err := f.Snapshot()
+	require.NoError(t, err)
+	var sink memSink
+	require.NoError(t, snap.Persist(&sink))
+	for _, e := range entries[3:] {
+		require.IsType(t, &api.ProduceResponse{}, f.Apply(e))
+	}
+	require.NoError(t, l.Truncate(2))
+
+	// 再起動した時と同じく、スナップショットから復元してからその後のエントリを適用する
+	require.NoError(t, f.Restore(io.NopCloser(&sink.Buffer)))
+	for _, e := range entries[3:] {
+		f.Apply(e)
+	}
+	res := f.Apply(appendEntry(t, 6, "record 5"))
+	require.Equal(t, uint64(5), res.(*api.ProduceResponse).Offset)
+	for off := uint64(0); off < 6; off++ {
+		record, err := l.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("record %d", off), string(record.Value))
+		require.Equal(t, off+1, record.RaftIndex)
+	}
+}
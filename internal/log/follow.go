@@ -0,0 +1,230 @@
+package log
+
+import (
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+他のプロセスが書き込んでいるディレクトリを読み出すためのログ(フォロワー)
+Config.ReadOnlyで開くログとは次の点が異なる
+① ディレクトリのロックを取得しないので、書き込むログと同時に開ける
+② 書き込むログはインデックスを最大サイズまで広げてメモリにマップしているので、インデックスを作り直さずに、
+ストアに書き込み済みのフレームを指しているエントリだけを読み込む
+③ 一定の間隔でディレクトリを確認し、追加されたレコードとセグメント、Truncateで削除されたセグメントを反映する
+書き込むログはストアへの書き込みをバッファに溜めているので、レコードが見えるのはバッファがファイルに書き出されてからになる
+(書き込むログのConfig.FlushIntervalごと、バッファが一杯になった時、セグメントが切り替わった時、そのセグメントを読み出した時、クローズした時)
+*/
+
+const (
+	defaultFollowInterval = 250 * time.Millisecond
+	// 書き込むログがバッファを書き出す間隔の既定値 フォロワーが確認する間隔より短くして、書き込みが少なくても遅れないようにする
+	defaultFlushInterval = 100 * time.Millisecond
+)
+
+// アクティブセグメントのバッファをファイルに書き出し、フォロワーから見えるようにする
+func (l *Log) flush() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return ErrNotReady
+	}
+
+	return l.activeSegment.store.flush()
+}
+
+/*
+書き込み中のディレクトリをファイルを一切変更せずに開き、変更を追いかける
+AppendやTruncateなどはErrReadOnlyを返す セグメントの設定は使用しないので、c.Segmentは空でよい
+*/
+func OpenReadOnly(dir string, c Config) (*Log, error) {
+	c.ReadOnly = true
+	c.follow = true
+	if c.FollowInterval == 0 {
+		c.FollowInterval = defaultFollowInterval
+	}
+
+	return NewLog(dir, c)
+}
+
+/*
+OpenReadOnlyで開いたログに、ディレクトリの変更を反映する
+一定の間隔で自動的に呼び出されるので、すぐに反映したい場合にだけ呼び出せばよい それ以外のログでは何もしない
+① TruncateやTruncateAfterで削除されたセグメントを閉じる
+② 各セグメントに追加されたレコードを読み込む(切り替わる前のセグメントにも、書き出されていないレコードが残っている場合がある)
+TruncateAfterで切り詰められて小さくなったストアは、取り除かれたレコードを忘れてから読み込む
+(確認するまでの間に元の大きさまで書き込まれた場合は気づけないので、TruncateAfterを使うログを追いかける場合は注意する)
+③ 新しく作成されたセグメントを開き、アクティブセグメントにする
+*/
+func (l *Log) Refresh() error {
+	if !l.Config.follow {
+		return nil
+	}
+
+	// ディレクトリの読み出しには時間がかかるので、ロックを取得する前に行う
+	disk, err := l.discoverSegments()
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.ready {
+		return ErrNotReady
+	}
+	// Resetの途中などでセグメントが一つもない場合は、次の確認まで今の状態のままにする
+	if len(disk) == 0 {
+		return nil
+	}
+
+	present := make(map[uint64]bool, len(disk))
+	for _, base := range disk {
+		present[base] = true
+	}
+
+	var segments []*segment
+	for _, s := range l.segments {
+		if !present[s.baseOffset] {
+			s.Close()
+			l.Config.logger().Info("segment removed", zap.Uint64("base_offset", s.baseOffset))
+			continue
+		}
+		segments = append(segments, s)
+	}
+	l.segments = segments
+	if len(segments) > 0 {
+		l.activeSegment = segments[len(segments)-1]
+	}
+
+	for _, s := range segments {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+	}
+
+	for _, base := range disk {
+		if len(l.segments) > 0 && base <= l.segments[len(l.segments)-1].baseOffset {
+			continue
+		}
+		if err := l.newSegment(base); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+フォロワーのセグメントに、インデックスとストアに追加されたレコードを読み込む
+書き込むログはストア(バッファ)->インデックスの順に書き込むので、インデックスのエントリが
+まだファイルに書き出されていないフレームを指している場合がある
+読み込んだ最後のフレームの直後から、フレームが隙間なく続いていてストアに全て書き出されているエントリだけを読み込む
+*/
+func (s *segment) refresh() error {
+	fi, err := s.store.File.Stat()
+	if err != nil {
+		return err
+	}
+	size := uint64(fi.Size())
+	s.store.size = size
+	// 書き出されたフレームは全て読み込み済み
+	if size == s.followed {
+		return nil
+	}
+	if size < s.followed {
+		s.forget(size)
+	}
+
+	b, err := readFileFrom(strings.TrimSuffix(s.store.Name(), storeExt)+indexExt, int64(s.index.size))
+	if err != nil {
+		return err
+	}
+
+	var (
+		entries = s.index.mmap[:s.index.size:s.index.size]
+		lenBuf  = make([]byte, lenWidth)
+	)
+	for i := 0; i+entWidth <= len(b); i += entWidth {
+		off := enc.Uint32(b[i : i+offWidth])
+		pos := enc.Uint64(b[i+offWidth : i+entWidth])
+		// 未使用領域(ゼロ)や食い違ったエントリで止める
+		if off != uint32(len(entries)/entWidth) || pos != s.followed || pos+lenWidth > size {
+			break
+		}
+		if _, err := s.store.File.ReadAt(lenBuf, int64(pos)); err != nil {
+			return err
+		}
+		end := pos + lenWidth + enc.Uint64(lenBuf)
+		if end > size {
+			break
+		}
+
+		entries = append(entries, b[i:i+entWidth]...)
+		s.followed = end
+	}
+
+	s.index = newReadOnlyIndex(entries)
+	s.nextOffset = s.baseOffset + uint64(len(entries)/entWidth)
+
+	return nil
+}
+
+/*
+TruncateAfterでストアがsizeまで切り詰められたので、sizeより後ろのフレームを指すエントリを取り除く
+エントリのフレームは隙間なく続いているので、次のエントリの位置がそのフレームの終わりになる
+*/
+func (s *segment) forget(size uint64) {
+	entries := s.index.mmap[:s.index.size]
+	keep, end := 0, uint64(0)
+	for i := 0; i+entWidth <= len(entries); i += entWidth {
+		if pos := enc.Uint64(entries[i+offWidth : i+entWidth]); pos >= size {
+			break
+		}
+		next := s.followed
+		if i+2*entWidth <= len(entries) {
+			next = enc.Uint64(entries[i+entWidth+offWidth : i+2*entWidth])
+		}
+		if next > size {
+			break
+		}
+		keep, end = i+entWidth, next
+	}
+
+	s.index = newReadOnlyIndex(append([]byte(nil), entries[:keep]...))
+	s.nextOffset = s.baseOffset + uint64(keep/entWidth)
+	s.followed = end
+}
+
+// ファイルのoffset以降を読み出す ファイルがない場合は空を返す
+func readFileFrom(path string, offset int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if fi.Size() <= offset {
+		return nil, nil
+	}
+
+	b := make([]byte, fi.Size()-offset)
+	n, err := f.ReadAt(b, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	return b[:n], nil
+}
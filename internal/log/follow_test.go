@@ -0,0 +1,148 @@
+package log
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	// バッファに残っているレコードが見えないことを確認するので、一定の間隔では書き出させない
+	c := Config{FlushInterval: time.Hour}
+	c.Segment.MaxIndexBytes = entWidth * 3
+
+	writer, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer writer.Close()
+
+	append := func(n int) uint64 {
+		var off uint64
+		for i := 0; i < n; i++ {
+			off, err = writer.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		// 書き込むログはストアへの書き込みをバッファに溜めているので、読み出してファイルに書き出させる
+		_, err = writer.Read(off)
+		require.NoError(t, err)
+		return off
+	}
+	append(2)
+
+	// 書き込むログがロックを保持していても開ける
+	before := dirState(t, dir)
+	follower, err := OpenReadOnly(dir, Config{FollowInterval: time.Hour})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	for off := uint64(0); off < 2; off++ {
+		record, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	_, err = follower.Read(2)
+	require.Error(t, err)
+
+	// 最大サイズまで広げられたインデックスを切り詰めたり作り直したりしない
+	require.NoError(t, follower.Refresh())
+	require.Equal(t, before, dirState(t, dir))
+	require.Equal(t, int64(c.Segment.MaxIndexBytes), before["0.index"])
+
+	// バッファに残っているレコードは見えない
+	_, err = writer.Append(&api.Record{Value: []byte("buffered")})
+	require.NoError(t, err)
+	require.NoError(t, follower.Refresh())
+	_, err = follower.Read(2)
+	require.Error(t, err)
+
+	// 新しいセグメントに追加されたレコードも読み込む
+	last := append(5)
+	require.NoError(t, follower.Refresh())
+	for off := uint64(0); off <= last; off++ {
+		record, err := follower.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := follower.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, last, off)
+
+	// Truncateで削除されたセグメントを閉じる
+	require.NoError(t, writer.Truncate(2))
+	require.NoError(t, follower.Refresh())
+	off, err = follower.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	_, err = follower.Read(0)
+	require.Error(t, err)
+
+	// TruncateAfterで取り除かれたレコードを忘れ、その後に書き込まれたレコードを読み込む
+	require.NoError(t, writer.TruncateAfter(4))
+	require.NoError(t, follower.Refresh())
+	off, err = follower.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	_, err = follower.Read(5)
+	require.Error(t, err)
+	off, err = writer.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+	_, err = writer.Read(off)
+	require.NoError(t, err)
+	require.NoError(t, follower.Refresh())
+	record, err := follower.Read(5)
+	require.NoError(t, err)
+	require.Equal(t, "replaced", string(record.Value))
+	require.Equal(t, ErrReadOnly, follower.TruncateAfter(0))
+
+	_, err = follower.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, follower.Truncate(0))
+	require.Equal(t, ErrReadOnly, follower.Remove())
+	require.Equal(t, ErrReadOnly, follower.Reset())
+}
+
+func TestOpenReadOnlyPolls(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+
+	follower, err := OpenReadOnly(dir, Config{FollowInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer follower.Close()
+
+	off, err := writer.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	// クローズするとバッファが書き出され、インデックスが実際のサイズに切り詰められる
+	require.NoError(t, writer.Close())
+
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(off)
+		return err == nil && string(record.Value) == "hello world"
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = OpenReadOnly(t.TempDir(), Config{})
+	require.Error(t, err)
+}
+
+// 書き込みが少なくても、書き込むログがバッファを一定の間隔で書き出すので、フォロワーが追いつく
+func TestOpenReadOnlyFlushed(t *testing.T) {
+	dir := t.TempDir()
+	writer, err := NewLog(dir, Config{FlushInterval: 10 * time.Millisecond})
+	require.NoError(t, err)
+	defer writer.Close()
+
+	c := Config{FollowInterval: 50 * time.Millisecond}
+	follower, err := OpenReadOnly(dir, c)
+	require.NoError(t, err)
+	defer follower.Close()
+
+	off, err := writer.Append(&api.Record{Value: []byte("small")})
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		record, err := follower.Read(off)
+		return err == nil && string(record.Value) == "small"
+	}, c.FollowInterval+writer.Config.FlushInterval+50*time.Millisecond, time.Millisecond)
+}
@@ -34,6 +34,8 @@ type index struct {
 	mmap gommap.MMap
 	// sizeはインデックスのサイズであり、同時に次にインデックスに追加されるエントリをどこに書き込むかを表している(ストアでも同じような処理を書いた)
 	size uint64
+	// 読み取り専用の場合はファイルをメモリにマップせず、読み出した内容をmmapに保持する
+	readOnly bool
 }
 
 // Config = 指定されたファイルからindexを作成する
@@ -49,10 +51,15 @@ func newIndex(f *os.File, c Config) (*index, error) {
 
 	// ファイルの現在のサイズを保存することで、インデックスエントリを追加する際に、インデックスファイル内のデータ量を管理することができる
 	idx.size = uint64(fi.Size())
+	// MaxIndexBytesを小さくした後に開いたインデックスは、既存のエントリを切り詰めずにそのサイズのまま扱う(一杯なので書き込まない)
+	max := c.Segment.MaxIndexBytes
+	if idx.size > max {
+		max = idx.size
+	}
 	// Truncate → 指定したファイルのファイルサイズを指定したサイズにする
 	if err := os.Truncate(
 		// ファイルをメモリへマップする前に、ファイルを最大のインデックスサイズまで大きくする(一度メモリに配置してしまうとファイルサイズを変更できないため)
-		f.Name(), int64(c.Segment.MaxIndexBytes),
+		f.Name(), int64(max),
 	); err != nil {
 		return nil, err
 	}
@@ -72,12 +79,28 @@ func newIndex(f *os.File, c Config) (*index, error) {
 	return idx, err
 }
 
+/*
+読み取り専用のインデックスを作成する
+newIndexのようにファイルを最大サイズまで広げるとファイルを変更してしまうので、エントリをメモリに読み込んで保持する
+*/
+func newReadOnlyIndex(entries []byte) *index {
+	return &index{
+		mmap:     gommap.MMap(entries),
+		size:     uint64(len(entries)),
+		readOnly: true,
+	}
+}
+
 // インデックスのファイルパスを返す
 func (i *index) Name() string {
 	return i.file.Name()
 }
 
 func (i *index) Close() error {
+	if i.readOnly {
+		return nil
+	}
+
 	/*
 	 メモリ領域に配置されたファイルの変更をデバイスにフラッシュする。
 	 このメソッドを呼び出さない場合、領域がアンマップされる前に変更がフラッシュされる保証はない。
@@ -134,7 +157,7 @@ func (i *index) Read(in int64) (out uint32, pos uint64, err error) {
 }
 
 func (i *index) Write(off uint32, pos uint64) error {
-	if i.isMaxed() {
+	if i.readOnly || i.isMaxed() {
 		return io.EOF
 	}
 
@@ -146,6 +169,18 @@ func (i *index) Write(off uint32, pos uint64) error {
 	return nil
 }
 
+// 先頭からentries個のエントリだけを残す 取り除いたエントリの領域はゼロで埋める(Closeで切り詰める)
+func (i *index) truncate(entries uint64) {
+	size := entries * entWidth
+	if size >= i.size {
+		return
+	}
+	for p := size; p < i.size; p++ {
+		i.mmap[p] = 0
+	}
+	i.size = size
+}
+
 // 書き込む領域があるかどうか確認する
 // TODO: 動かして内部の動きを確認すること
 func (i *index) isMaxed() bool {
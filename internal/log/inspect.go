@@ -0,0 +1,380 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+/*
+Logを開かずに、ディスク上のセグメントファイルを読み出して調べるための関数
+稼働中のLogはインデックスファイルを最大サイズまで広げてメモリにマップしているので、
+ここではファイルをそのまま読み出し、インデックスの未使用領域(ゼロで埋まった末尾)を取り除いて扱う
+*/
+
+const (
+	storeExt = ".store"
+	indexExt = ".index"
+)
+
+// ストアファイルの末尾のフレームが途中で終わっている(書き込み中にプロセスが停止した場合など)
+var ErrTruncatedFrame = errors.New("log: truncated store frame")
+
+func segmentPath(dir string, baseOffset uint64, ext string) string {
+	return filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ext))
+}
+
+// ディスク上のセグメントの情報
+type SegmentInfo struct {
+	BaseOffset uint64
+	// インデックスのエントリから求めた、次に書き込まれるレコードのオフセット
+	NextOffset uint64
+	// ファイルが存在しない場合は空
+	StorePath  string
+	IndexPath  string
+	StoreBytes int64
+	IndexBytes int64
+	// インデックスの有効なエントリ数
+	Entries uint64
+}
+
+// dir内のセグメントをベースオフセットの昇順に返す ストアかインデックスの一方しかないセグメントも含める
+func ListSegments(dir string) ([]SegmentInfo, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := map[uint64]*SegmentInfo{}
+	for _, e := range entries {
+		ext := filepath.Ext(e.Name())
+		if e.IsDir() || (ext != storeExt && ext != indexExt) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(e.Name(), ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		s, ok := segments[base]
+		if !ok {
+			s = &SegmentInfo{BaseOffset: base, NextOffset: base}
+			segments[base] = s
+		}
+		path := filepath.Join(dir, e.Name())
+		if ext == storeExt {
+			s.StorePath, s.StoreBytes = path, fi.Size()
+			continue
+		}
+
+		s.IndexPath, s.IndexBytes = path, fi.Size()
+		ents, err := readIndexFile(path)
+		if err != nil {
+			return nil, err
+		}
+		s.Entries = uint64(len(ents))
+		s.NextOffset = base + s.Entries
+	}
+
+	infos := make([]SegmentInfo, 0, len(segments))
+	for _, s := range segments {
+		infos = append(infos, *s)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].BaseOffset < infos[j].BaseOffset
+	})
+
+	return infos, nil
+}
+
+// ストアファイル内のレコード一件分(長さ+レコード)
+type Frame struct {
+	// ストアファイル内の位置(長さの先頭)
+	Position uint64
+	// 長さを除いたレコードのバイト数
+	Size uint64
+	// レコードとして読み出せなかった場合はnilで、Errに理由が入る
+	Record *api.Record
+	Err    error
+}
+
+/*
+ストアファイルのフレームを先頭から順に読み出してfnを呼び出す
+末尾のフレームが途中で終わっている場合はErrTruncatedFrameを返す
+*/
+func ScanStore(path string, fn func(Frame) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	_, err = scanFrames(f, uint64(fi.Size()), func(pos, size uint64) error {
+		frame := Frame{Position: pos, Size: size}
+		p := make([]byte, size)
+		if _, err := f.ReadAt(p, int64(pos+lenWidth)); err != nil {
+			return err
+		}
+		record := &api.Record{}
+		if frame.Err = proto.Unmarshal(p, record); frame.Err == nil {
+			frame.Record = record
+		}
+
+		return fn(frame)
+	})
+
+	return err
+}
+
+/*
+ストアのフレームの位置と長さを順にfnに渡し、最後の完全なフレームの終わりの位置を返す
+レコードの中身は読み出さないので、インデックスの再構築のように位置だけが必要な場合に使う
+*/
+func scanFrames(r io.ReaderAt, size uint64, fn func(pos, size uint64) error) (uint64, error) {
+	var (
+		pos    uint64
+		lenBuf = make([]byte, lenWidth)
+	)
+	for pos < size {
+		if size-pos < lenWidth {
+			return pos, fmt.Errorf("%w: %d bytes at position %d", ErrTruncatedFrame, size-pos, pos)
+		}
+		if _, err := r.ReadAt(lenBuf, int64(pos)); err != nil {
+			return pos, err
+		}
+		n := enc.Uint64(lenBuf)
+		if n > size-pos-lenWidth {
+			return pos, fmt.Errorf(
+				"%w: record at position %d needs %d bytes, %d remain",
+				ErrTruncatedFrame, pos, n, size-pos-lenWidth,
+			)
+		}
+		if err := fn(pos, n); err != nil {
+			return pos, err
+		}
+		pos += lenWidth + n
+	}
+
+	return pos, nil
+}
+
+// インデックスの一件分のエントリ
+type indexEntry struct {
+	off uint32 // ベースオフセットからの相対オフセット
+	pos uint64
+}
+
+// インデックスファイルを読み出し、末尾の未使用領域を除いたエントリを返す
+func readIndexFile(path string) ([]indexEntry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseIndex(b), nil
+}
+
+/*
+インデックスの内容をエントリに分ける
+クローズされずに終了したインデックスは最大サイズまでゼロで埋まっているので、
+2件目以降のオフセット0・位置0のエントリ以降は未使用領域として扱う(1件目は正しいエントリでも0・0になる)
+エントリの幅に満たない末尾のバイトも取り除く
+*/
+func parseIndex(b []byte) []indexEntry {
+	var entries []indexEntry
+	for i := 0; i+entWidth <= len(b); i += entWidth {
+		e := indexEntry{
+			off: enc.Uint32(b[i : i+offWidth]),
+			pos: enc.Uint64(b[i+offWidth : i+entWidth]),
+		}
+		if i > 0 && e.off == 0 && e.pos == 0 {
+			break
+		}
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+/*
+セグメントのインデックスとストアの整合性を検査し、見つかった問題を返す
+① インデックスの各エントリの相対オフセットが0から連番になっているか
+② 各エントリの位置が、ストアの同じ順番のフレームの先頭を指しているか
+③ そのフレームがレコードとして読み出せ、レコードのオフセットが一致するか
+④ インデックスに載っていないフレームや、途中で終わっているフレームがないか
+問題がない場合は空のスライスを返す ファイルを読み出せない場合はエラーを返す
+*/
+func VerifySegment(dir string, baseOffset uint64) ([]string, error) {
+	var (
+		problems []string
+		frames   []Frame
+	)
+
+	err := ScanStore(segmentPath(dir, baseOffset, storeExt), func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	})
+	if errors.Is(err, ErrTruncatedFrame) {
+		problems = append(problems, err.Error())
+	} else if err != nil {
+		return nil, err
+	}
+
+	b, err := os.ReadFile(segmentPath(dir, baseOffset, indexExt))
+	if os.IsNotExist(err) {
+		return append(problems, "index file is missing"), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	entries := parseIndex(b)
+
+	for i, e := range entries {
+		offset := baseOffset + uint64(i)
+		if e.off != uint32(i) {
+			problems = append(problems, fmt.Sprintf(
+				"index entry %d: relative offset is %d, want %d", i, e.off, i,
+			))
+		}
+		if i >= len(frames) {
+			problems = append(problems, fmt.Sprintf(
+				"offset %d: index points at position %d beyond the last store frame", offset, e.pos,
+			))
+			continue
+		}
+		f := frames[i]
+		if e.pos != f.Position {
+			problems = append(problems, fmt.Sprintf(
+				"offset %d: index points at position %d, store frame starts at %d", offset, e.pos, f.Position,
+			))
+			continue
+		}
+		if f.Err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"offset %d: record at position %d cannot be decoded: %v", offset, f.Position, f.Err,
+			))
+			continue
+		}
+		if f.Record.Offset != offset {
+			problems = append(problems, fmt.Sprintf(
+				"offset %d: record at position %d has offset %d", offset, f.Position, f.Record.Offset,
+			))
+		}
+	}
+	if len(frames) > len(entries) {
+		problems = append(problems, fmt.Sprintf(
+			"%d store frames from position %d are not indexed",
+			len(frames)-len(entries), frames[len(entries)].Position,
+		))
+	}
+
+	return problems, nil
+}
+
+/*
+ストアのフレームからインデックスを作り直し、書き込んだエントリ数を返す
+途中で終わっている末尾のフレームはインデックスに含めない
+一時ファイルに書き込んでからリネームするので、途中で失敗しても元のインデックスは残る
+*/
+func RebuildIndex(dir string, baseOffset uint64) (uint64, error) {
+	store, err := os.Open(segmentPath(dir, baseOffset, storeExt))
+	if err != nil {
+		return 0, err
+	}
+	defer store.Close()
+
+	fi, err := store.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	b, _, err := buildIndex(store, uint64(fi.Size()))
+	if err != nil {
+		return 0, err
+	}
+	if err := replaceFile(segmentPath(dir, baseOffset, indexExt), b); err != nil {
+		return 0, err
+	}
+
+	return uint64(len(b) / entWidth), nil
+}
+
+/*
+ストアのフレームの位置からインデックスの内容を作り、最後の完全なフレームの終わりの位置と一緒に返す
+途中で終わっている末尾のフレームは含めない
+*/
+func buildIndex(r io.ReaderAt, size uint64) ([]byte, uint64, error) {
+	var b []byte
+	end, err := scanFrames(r, size, func(pos, _ uint64) error {
+		e := make([]byte, entWidth)
+		enc.PutUint32(e[:offWidth], uint32(len(b)/entWidth))
+		enc.PutUint64(e[offWidth:], pos)
+		b = append(b, e...)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrTruncatedFrame) {
+		return nil, 0, err
+	}
+
+	return b, end, nil
+}
+
+// 一時ファイルに書き込んでからリネームし、ファイルの中身を置き換える
+func replaceFile(path string, b []byte) error {
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(path))
+}
+
+func writeFileSync(path string, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// リネームを永続化するためにディレクトリを同期する
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,150 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// 1セグメントに3件ずつ、合計5件のレコードを書き込んでクローズしたログのディレクトリを返す
+func setupInspect(t *testing.T) (string, Config) {
+	t.Helper()
+
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	return dir, c
+}
+
+func TestListSegments(t *testing.T) {
+	dir, _ := setupInspect(t)
+
+	// セグメントではないファイルは無視する
+	require.NoError(t, os.WriteFile(dir+"/README", nil, 0600))
+
+	segments, err := ListSegments(dir)
+	require.NoError(t, err)
+	require.Len(t, segments, 2)
+
+	require.Equal(t, uint64(0), segments[0].BaseOffset)
+	require.Equal(t, uint64(3), segments[0].NextOffset)
+	require.Equal(t, uint64(3), segments[0].Entries)
+	require.Equal(t, int64(3*entWidth), segments[0].IndexBytes)
+	require.Equal(t, uint64(3), segments[1].BaseOffset)
+	require.Equal(t, uint64(5), segments[1].NextOffset)
+
+	fi, err := os.Stat(segmentPath(dir, 3, storeExt))
+	require.NoError(t, err)
+	require.Equal(t, fi.Size(), segments[1].StoreBytes)
+}
+
+func TestScanStore(t *testing.T) {
+	dir, _ := setupInspect(t)
+
+	var frames []Frame
+	require.NoError(t, ScanStore(segmentPath(dir, 3, storeExt), func(f Frame) error {
+		frames = append(frames, f)
+		return nil
+	}))
+	require.Len(t, frames, 2)
+	require.Equal(t, uint64(0), frames[0].Position)
+	require.Equal(t, uint64(lenWidth)+frames[0].Size, frames[1].Position)
+	for i, f := range frames {
+		require.NoError(t, f.Err)
+		require.Equal(t, uint64(3+i), f.Record.Offset)
+		require.Equal(t, []byte("hello world"), f.Record.Value)
+	}
+
+	// 書き込み途中で終わったフレームはErrTruncatedFrameになる
+	path := segmentPath(dir, 3, storeExt)
+	require.NoError(t, os.Truncate(path, int64(frames[1].Position+lenWidth+1)))
+	n := 0
+	err := ScanStore(path, func(Frame) error {
+		n++
+		return nil
+	})
+	require.ErrorIs(t, err, ErrTruncatedFrame)
+	require.Equal(t, 1, n)
+}
+
+func TestVerifyAndRebuildIndex(t *testing.T) {
+	for scenario, corrupt := range map[string]func(t *testing.T, path string){
+		"missing index": func(t *testing.T, path string) {
+			require.NoError(t, os.Remove(path))
+		},
+		"short index": func(t *testing.T, path string) {
+			require.NoError(t, os.Truncate(path, entWidth+4))
+		},
+		"wrong position": func(t *testing.T, path string) {
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			enc.PutUint64(b[entWidth+offWidth:], 7)
+			require.NoError(t, os.WriteFile(path, b, 0600))
+		},
+		"wrong relative offset": func(t *testing.T, path string) {
+			b, err := os.ReadFile(path)
+			require.NoError(t, err)
+			enc.PutUint32(b[2*entWidth:], 9)
+			require.NoError(t, os.WriteFile(path, b, 0600))
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir, c := setupInspect(t)
+
+			problems, err := VerifySegment(dir, 0)
+			require.NoError(t, err)
+			require.Empty(t, problems)
+
+			corrupt(t, segmentPath(dir, 0, indexExt))
+			problems, err = VerifySegment(dir, 0)
+			require.NoError(t, err)
+			require.NotEmpty(t, problems)
+
+			n, err := RebuildIndex(dir, 0)
+			require.NoError(t, err)
+			require.Equal(t, uint64(3), n)
+			problems, err = VerifySegment(dir, 0)
+			require.NoError(t, err)
+			require.Empty(t, problems)
+
+			log, err := NewLog(dir, c)
+			require.NoError(t, err)
+			defer log.Close()
+			for off := uint64(0); off < 5; off++ {
+				record, err := log.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, record.Offset)
+			}
+		})
+	}
+}
+
+func TestVerifyTruncatedStore(t *testing.T) {
+	dir, _ := setupInspect(t)
+
+	// 最後のフレームが途中で終わっていると、そのフレームを指すエントリも問題になる
+	fi, err := os.Stat(segmentPath(dir, 3, storeExt))
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(segmentPath(dir, 3, storeExt), fi.Size()-1))
+
+	problems, err := VerifySegment(dir, 3)
+	require.NoError(t, err)
+	require.Len(t, problems, 2)
+	require.Contains(t, problems[0], "truncated store frame")
+	require.Contains(t, problems[1], "offset 4: index points at position")
+
+	// 再構築したインデックスには完全なフレームだけが含まれる
+	n, err := RebuildIndex(dir, 3)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), n)
+}
@@ -0,0 +1,117 @@
+package log
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+同じディレクトリを複数のプロセスが開くと、互いのインデックスのメモリマップを上書きしてログが壊れるので、
+ディレクトリのロックファイルにflockでアドバイザリロックをかける
+① 書き込むログは排他ロックを取得し、ロックファイルに自身のPIDを書き込む
+② 読み取り専用のログ(Config.ReadOnly)は共有ロックを取得する 読み取り専用のログ同士は同時に開ける
+ロックはプロセスが終了すると解放されるので、異常終了してもロックファイルが残るだけで次の起動を妨げない
+*/
+const lockFile = "LOCK"
+
+// 他のプロセスがディレクトリのロックを保持している場合に返すエラー
+var ErrLocked = errors.New("log: directory is locked")
+
+type dirLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+func lockDir(dir string, exclusive bool) (*dirLock, error) {
+	path := filepath.Join(dir, lockFile)
+
+	var (
+		f   *os.File
+		err error
+		how = unix.LOCK_SH
+	)
+	if exclusive {
+		how = unix.LOCK_EX
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	} else {
+		// 読み取り専用のログはなるべくファイルを作成しない
+		f, err = os.Open(path)
+		if os.IsNotExist(err) {
+			f, err = os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0600)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := unix.Flock(int(f.Fd()), how|unix.LOCK_NB); err != nil {
+		defer f.Close()
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%w: %s is in use by %s", ErrLocked, dir, lockHolder(f))
+		}
+		return nil, fmt.Errorf("log: lock %s: %w", path, err)
+	}
+
+	if exclusive {
+		if err := f.Truncate(0); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if _, err := f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	return &dirLock{file: f, exclusive: exclusive}, nil
+}
+
+/*
+Logを開かずにディレクトリのファイルを操作するツール(proglog-segtoolなど)のために、ロックだけを取得する
+exclusiveがtrueの場合は排他ロック、falseの場合は共有ロックを取得する 返り値のCloseでロックを解放する
+*/
+func LockDir(dir string, exclusive bool) (io.Closer, error) {
+	l, err := lockDir(dir, exclusive)
+	if err != nil {
+		return nil, err
+	}
+
+	return closerFunc(l.release), nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// ロックファイルからロックを保持しているプロセスを表す文字列を返す 共有ロックの保持者はPIDを書き込まない
+func lockHolder(f *os.File) string {
+	b := make([]byte, 32)
+	n, _ := f.ReadAt(b, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(b[:n])))
+	if err != nil {
+		return "a read-only process"
+	}
+
+	return fmt.Sprintf("pid %d", pid)
+}
+
+// ロックを解放する 排他ロックの場合は、次に開くプロセスが古いPIDを表示しないようにPIDを消す
+func (l *dirLock) release() error {
+	if l.exclusive {
+		if err := l.file.Truncate(0); err != nil {
+			l.file.Close()
+			return err
+		}
+	}
+
+	return l.file.Close()
+}
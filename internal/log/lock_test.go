@@ -0,0 +1,114 @@
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLock(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+
+	// 同じディレクトリは、同じプロセスからでも二重に開けない
+	_, err = NewLog(dir, c)
+	require.ErrorIs(t, err, ErrLocked)
+	require.Contains(t, err.Error(), fmt.Sprintf("in use by pid %d", os.Getpid()))
+
+	ro := c
+	ro.ReadOnly = true
+	_, err = NewLog(dir, ro)
+	require.ErrorIs(t, err, ErrLocked)
+
+	// ロックに失敗しても、開いているログには影響しない
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+
+	// 読み取り専用のログ同士は同時に開ける
+	r1, err := NewLog(dir, ro)
+	require.NoError(t, err)
+	r2, err := NewLog(dir, ro)
+	require.NoError(t, err)
+
+	_, err = NewLog(dir, c)
+	require.ErrorIs(t, err, ErrLocked)
+	require.Contains(t, err.Error(), "in use by a read-only process")
+
+	require.NoError(t, r1.Close())
+	require.NoError(t, r2.Close())
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	require.NoError(t, log.Close())
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	// クローズされずに終了した状態(インデックスが最大サイズのまま)を再現する
+	c.Segment.MaxIndexBytes = 1024
+	require.NoError(t, os.Truncate(filepath.Join(dir, "2.index"), 1024))
+	before := dirState(t, dir)
+
+	ro := c
+	ro.ReadOnly = true
+	r, err := NewLog(dir, ro)
+	require.NoError(t, err)
+
+	for off := uint64(0); off < 3; off++ {
+		record, err := r.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := r.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, r.Health())
+
+	_, err = r.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, ErrReadOnly, err)
+	require.Equal(t, ErrReadOnly, r.Truncate(0))
+	require.Equal(t, ErrReadOnly, r.Remove())
+	require.Equal(t, ErrReadOnly, r.Reset())
+	require.NoError(t, r.Close())
+
+	// 読み取り専用のログはファイルを一切変更しない
+	require.Equal(t, before, dirState(t, dir))
+
+	_, err = NewLog(t.TempDir(), ro)
+	require.Error(t, err)
+}
+
+// ディレクトリ内のファイル名とサイズ
+func dirState(t *testing.T, dir string) map[string]int64 {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	state := map[string]int64{}
+	for _, e := range entries {
+		fi, err := e.Info()
+		require.NoError(t, err)
+		state[e.Name()] = fi.Size()
+	}
+
+	return state
+}
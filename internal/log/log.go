@@ -1,18 +1,30 @@
 package log
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
-	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"time"
 
 	api "github.com/KeisukeYamane/proglog/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
 )
 
+// setUpが完了していない、もしくはクローズ済みのログを読み書きしようとした際に返すエラー
+var ErrNotReady = errors.New("log: not ready")
+
+// 読み取り専用で開いたログを変更しようとした際に返すエラー
+var ErrReadOnly = errors.New("log: read-only")
+
+// Readerで読み出している途中のレコードが、TruncateAfterで取り除かれた際に返すエラー
+var ErrTruncated = errors.New("log: truncated while reading")
+
 /*
 ログの開始処理として、ディスク上のセグメントの一覧を取得する
 ファイル名からベースオフセットの値を求めてセグメントのスライスを古い順にソートをかける
@@ -28,6 +40,16 @@ type Log struct {
 
 	activeSegment *segment
 	segments      []*segment
+	// setUpが完了してからCloseされるまでの間だけtrue ヘルスチェックで使用する
+	ready bool
+	// setUpからCloseまでの間保持するディレクトリのロック
+	lock *dirLock
+	// setUpからCloseまでの間、一定の間隔で処理を繰り返すゴルーチン
+	workers []*worker
+	// Config.Tier.Storeからセグメントを取得する処理を一つずつ行う
+	fetchMu sync.Mutex
+
+	metrics *metrics
 }
 
 func NewLog(dir string, c Config) (*Log, error) {
@@ -37,88 +59,236 @@ func NewLog(dir string, c Config) (*Log, error) {
 	if c.Segment.MaxIndexBytes == 0 {
 		c.Segment.MaxIndexBytes = 1024
 	}
+	if c.Tier.Interval == 0 {
+		c.Tier.Interval = defaultTierInterval
+	}
+	if c.FlushInterval == 0 {
+		c.FlushInterval = defaultFlushInterval
+	}
 
 	l := &Log{
-		Dir:    dir,
-		Config: c,
+		Dir:     dir,
+		Config:  c,
+		metrics: newMetrics(),
+	}
+
+	if err := l.setUp(); err != nil {
+		return nil, err
+	}
+
+	// 登録に失敗した場合は、ディレクトリのロックやゴルーチンを残さないようにクローズする
+	if err := l.registerMetrics(); err != nil {
+		l.Close()
+		return nil, err
 	}
 
-	return l, l.setUp()
+	return l, nil
 }
 
 func (l *Log) setUp() error {
-	files, err := os.ReadDir(l.Dir) // 該当のディレクトリ内のファイル名を全て返す もし途中でエラーが発生した場合、途中まで読み込んでいたファイル名を返す
+	if !l.Config.ReadOnly {
+		// Resetでディレクトリごと削除した後にも呼び出されるので、ディレクトリがなければ作成する
+		if err := os.MkdirAll(l.Dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	// 他のプロセスが同じディレクトリを開いていないか確認してから、ファイルを読み書きする
+	// OpenReadOnlyで開くログは、書き込み中のディレクトリを読み出すのでロックを取得しない
+	if !l.Config.follow {
+		lock, err := lockDir(l.Dir, !l.Config.ReadOnly)
+		if err != nil {
+			return err
+		}
+		l.lock = lock
+	}
+
+	if err := l.openSegments(); err != nil {
+		for _, s := range l.segments {
+			s.Close()
+		}
+		l.segments, l.activeSegment = nil, nil
+		if l.lock != nil {
+			l.lock.release()
+			l.lock = nil
+		}
+		return err
+	}
+
+	l.mu.Lock()
+	l.ready = true
+	l.mu.Unlock()
+
+	if l.Config.follow {
+		l.startWorker("follow", l.Config.FollowInterval, func(context.Context) error {
+			return l.Refresh()
+		})
+	}
+	if !l.Config.ReadOnly {
+		l.startWorker("flush", l.Config.FlushInterval, func(context.Context) error {
+			return l.flush()
+		})
+	}
+	if l.Config.Tier.Store != nil && !l.Config.ReadOnly {
+		l.startWorker("tier", l.Config.Tier.Interval, l.Offload)
+	}
+
+	return nil
+}
+
+func (l *Log) openSegments() error {
+	// ディレクトリ内のセグメントを探し、マニフェストと突き合わせる
+	disk, err := l.discoverSegments()
+	if err != nil {
+		return err
+	}
+	m, err := readManifest(l.Dir)
+	if err != nil {
+		return err
+	}
+	baseOffsets, rewrite, err := l.reconcileManifest(m, disk)
 	if err != nil {
 		return err
 	}
 
-	var baseOffsets []uint64
-	for _, file := range files {
-		offStr := strings.TrimSuffix( // 第一引数の末尾(suffix)から第二引数で与えられた文字列を取り除く 該当の文字列がない場合はそのまま返す
-			file.Name(),
-			path.Ext(file.Name()), // pathで使用されてるファイル名の拡張子を返す /testA/testB/main.go -> .go
-		)
+	var remote []uint64
+	if m != nil {
+		remote = intersect(m.Remote, baseOffsets)
+	}
+	uploaded := make(map[uint64]bool, len(remote))
+	for _, base := range remote {
+		uploaded[base] = true
+	}
+	local := make(map[uint64]bool, len(disk))
+	for _, base := range disk {
+		local[base] = true
+	}
 
-		// 文字列を十進数のint型に変換 ex: strconv.ParseUint(offStr, 10, 64) -> 十進数のint64型に変換
-		off, _ := strconv.ParseUint(offStr, 10, 0)
-		baseOffsets = append(baseOffsets, off)
+	// 読み取り専用の場合はファイルを作成できないので、まだファイルのないセグメント(マニフェストの②)や
+	// Config.Tier.Storeに移したセグメントは開かない
+	if l.Config.ReadOnly {
+		baseOffsets = intersect(baseOffsets, disk)
 	}
 
-	// offsetが大きい順に並べ替える
-	sort.Slice(baseOffsets, func(i, j int) bool {
-		return baseOffsets[i] < baseOffsets[j]
-	})
+	// segmentが全くない場合
+	if len(baseOffsets) == 0 {
+		if l.Config.ReadOnly {
+			return fmt.Errorf("log: no segments in %s", l.Dir)
+		}
+		baseOffsets = []uint64{l.Config.Segment.InitialOffset}
+		rewrite = true
+	}
 
-	// len(baseOffsets) = dir内のファイル数になる
-	for i := 0; i < len(baseOffsets); i++ {
-		if err = l.newSegment(baseOffsets[i]); err != nil {
+	// マニフェストを先に書き込んでおけば、セグメントの作成中に停止しても次の起動時に作成し直せる
+	if rewrite && !l.Config.ReadOnly {
+		if err := writeManifest(l.Dir, baseOffsets, remote, l.Config); err != nil {
 			return err
 		}
-
-		// baseOffsetsは、インデックスとストアの2つの重複を含んでいるので、重複しているものはスキップする
-		// TODO: ?? 意味がわからない
-		i++
 	}
 
-	// segmentが全くない場合
-	if l.segments == nil {
-		if err = l.newSegment(
-			l.Config.Segment.InitialOffset,
-		); err != nil {
+	// baseOffsetsは古い順に並んでいる
+	for _, off := range baseOffsets {
+		if uploaded[off] && !local[off] {
+			l.segments = append(l.segments, newOffloadedSegment(off, l.Config))
+			continue
+		}
+		if err = l.newSegment(off); err != nil {
 			return err
 		}
+		l.activeSegment.uploaded = uploaded[off]
+	}
+
+	// 移したセグメントのnextOffsetは、次のセグメントのベースオフセットになる
+	for i, s := range l.segments {
+		if !s.offloaded {
+			continue
+		}
+		if i == len(l.segments)-1 {
+			return fmt.Errorf("log: the last segment %d was moved to a segment store", s.baseOffset)
+		}
+		s.nextOffset = l.segments[i+1].baseOffset
 	}
 
 	return nil
 }
 
 func (l *Log) Append(record *api.Record) (uint64, error) {
+	return l.AppendContext(context.Background(), record)
+}
+
+// ctxのスパンを親としてトレースを記録しながらレコードを書き込む
+func (l *Log) AppendContext(ctx context.Context, record *api.Record) (off uint64, err error) {
+	start := time.Now()
+	tracer := l.Config.tracer()
+	ctx, span := startSpan(ctx, tracer, "Log.Append")
+	defer func() {
+		l.metrics.appendSeconds.Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
+
+	if l.Config.ReadOnly {
+		return 0, ErrReadOnly
+	}
+
+	// 読み出し側がこの書き込みのスパンを辿れるように、ヘッダーにトレースコンテキストを保持する
+	InjectTraceContext(ctx, record)
+
 	// 書き込み・読み込みを許可しない
+	// ロックの競合で待たされている時間を把握できるように、ロックの取得を別のスパンにする
+	_, lockSpan := startSpan(ctx, tracer, "Log.mu.Lock")
 	l.mu.Lock()
+	lockSpan.End()
 	defer l.mu.Unlock()
 
+	// ロックを待っている間にクローズされた場合、閉じたファイルに書き込まないようにする
+	if !l.ready {
+		return 0, ErrNotReady
+	}
+
 	// 最も高い(最後の)オフセットを取得
 	highestOffset, err := l.highestOffset()
 	if err != nil {
 		return 0, err
 	}
 
-	fmt.Println("highestOffset", highestOffset)
-	fmt.Println("l.activeSegment", l.activeSegment)
-	fmt.Println("l.activeSegment.IsMaxed", l.activeSegment.IsMaxed())
 	// アクティブセグメントの容量がいっぱいでログが追加できない場合
 	if l.activeSegment.IsMaxed() {
+		_, rollSpan := startSpan(
+			ctx,
+			tracer,
+			"Log.newSegment",
+			trace.WithAttributes(attribute.Int64("proglog.base_offset", int64(highestOffset+1))),
+		)
+		// 書き込みが終わったセグメントのバッファを書き出し、OpenReadOnlyで開いたログから読めるようにする
+		// マニフェストに記録してからファイルを作成する
 		// newSegmentを実行すると作成されたセグメントが新たなアクティブセグメントになる
-		err = l.newSegment(highestOffset + 1) // 最後+1で新たにセグメントを作成 引数がsegmentのbaseOffsetになる
+		if err = l.activeSegment.store.flush(); err == nil {
+			err = l.writeManifest(highestOffset + 1)
+		}
+		if err == nil {
+			err = l.newSegment(highestOffset + 1) // 最後+1で新たにセグメントを作成 引数がsegmentのbaseOffsetになる
+		}
+		endSpan(rollSpan, err)
 		if err != nil {
 			return 0, err
 		}
 	}
 
-	off, err := l.activeSegment.Append(record)
+	size := l.activeSegment.store.size
+	off, err = l.activeSegment.append(ctx, record)
 	if err != nil {
+		l.Config.logger().Error("append failed", zap.Error(err))
 		return 0, err
 	}
+	l.metrics.bytesWritten.Add(float64(l.activeSegment.store.size - size))
+	span.SetAttributes(attribute.Int64("proglog.offset", int64(off)))
+
+	// 書き込みのたびに出力されるので、サンプリングされる前提
+	l.Config.logger().Debug(
+		"record appended",
+		zap.Uint64("offset", off),
+		zap.Uint64("base_offset", l.activeSegment.baseOffset),
+	)
 
 	return off, err
 }
@@ -137,6 +307,12 @@ func (l *Log) newSegment(off uint64) error {
 	l.segments = append(l.segments, s)
 	l.activeSegment = s
 
+	l.Config.logger().Info(
+		"active segment changed",
+		zap.Uint64("base_offset", off),
+		zap.Int("segments", len(l.segments)),
+	)
+
 	return nil
 }
 
@@ -150,6 +326,11 @@ func (l *Log) LowestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	// Reset・Replaceでログを削除してから開き直すまでの間はセグメントがない
+	if len(l.segments) == 0 {
+		return 0, ErrNotReady
+	}
+
 	return l.segments[0].baseOffset, nil
 }
 
@@ -157,6 +338,10 @@ func (l *Log) HighestOffset() (uint64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
+	if len(l.segments) == 0 {
+		return 0, ErrNotReady
+	}
+
 	return l.highestOffset()
 }
 
@@ -166,14 +351,42 @@ func (l *Log) HighestOffset() (uint64, error) {
 データの内、不要になった古いセグメントを削除する
 */
 func (l *Log) Truncate(lowest uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	uploaded, err := l.truncate(lowest)
+	if err != nil {
+		return err
+	}
+
+	// アップロード済みのセグメントは、マニフェストから取り除いた後、ロックを解放してから削除する
+	// 削除する前に停止しても、残ったセグメントはOffloadが削除する
+	return l.deleteRemote(context.Background(), uploaded)
+}
+
+// Truncateのうちロックが必要な処理 削除したセグメントのうちアップロード済みのもののベースオフセットを返す
+func (l *Log) truncate(lowest uint64) ([]uint64, error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	var segments []*segment
+	var (
+		segments []*segment
+		uploaded []uint64
+	)
 	for _, s := range l.segments {
 		if s.nextOffset <= lowest+1 {
 			if err := s.Remove(); err != nil {
-				return err
+				return nil, err
+			}
+			l.Config.logger().Info(
+				"segment removed",
+				zap.Uint64("base_offset", s.baseOffset),
+				zap.Uint64("next_offset", s.nextOffset),
+			)
+			l.metrics.removed.Inc()
+			if s.uploaded {
+				uploaded = append(uploaded, s.baseOffset)
 			}
 			continue
 		}
@@ -182,6 +395,141 @@ func (l *Log) Truncate(lowest uint64) error {
 
 	l.segments = segments
 
+	// ファイルを削除してからマニフェストを書き込む 間で停止しても、次の起動時に削除済みとして扱える
+	if len(l.segments) > 0 {
+		return uploaded, l.writeManifest()
+	}
+
+	// アクティブセグメントも削除した場合は、続きのオフセット(lowest+1)から空のセグメントを作る
+	if err := l.writeManifest(lowest + 1); err != nil {
+		return nil, err
+	}
+
+	return uploaded, l.newSegment(lowest + 1)
+}
+
+/*
+offより後ろのレコードを全て取り除き、次に書き込むレコードのオフセットをoff+1にする
+Raftのログストアがリーダーと食い違ったエントリを削除する場合や、障害から復旧する際に書き込みを取り消す場合に使う
+① offを含むセグメントのストアとインデックスを、offのレコードの終わりで切り詰めてアクティブセグメントにする
+② それより後ろのセグメントは、マニフェストに取り除いたことを記録してからファイルを削除する(間で停止した場合は起動時に削除する)
+③ 切り詰めたストアをストレージに同期する
+④ 取り除いたセグメントと切り詰めたセグメントのConfig.Tier.Storeにあるファイルを削除する(切り詰めたセグメントは後で改めてアップロードする)
+offが最小のオフセット-1の場合は全てのレコードを取り除き、最大のオフセット以上の場合は何もしない
+ReadやReadContextとは書きロックで排他するので、読み出し中のレコードが途中で切り詰められることはない
+Readerで読み出している途中のセグメントを切り詰めた場合、そのReaderはErrTruncatedを返す
+*/
+func (l *Log) TruncateAfter(off uint64) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	for {
+		offloaded, remote, err := l.truncateAfter(off)
+		if err != nil {
+			return err
+		}
+		if offloaded == nil {
+			// ロックを解放してから削除する 削除する前に停止しても、残ったファイルはOffloadが削除する
+			return l.deleteRemote(context.Background(), remote)
+		}
+
+		// offを含むセグメントがConfig.Tier.Storeに移されている場合は、取得してから切り詰め直す
+		if err := l.fetch(context.Background(), offloaded.baseOffset); err != nil {
+			return err
+		}
+	}
+}
+
+/*
+TruncateAfterのうちロックが必要な処理
+Config.Tier.Storeのファイルを削除するセグメントのベースオフセットを返す
+offを含むセグメントが移されている場合は何もせずにそのセグメントを返す
+*/
+func (l *Log) truncateAfter(off uint64) (*segment, []uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.ready {
+		return nil, nil, ErrNotReady
+	}
+	if off+1 < l.segments[0].baseOffset {
+		return nil, nil, api.ErrOffsetOutOfRange{Offset: off}
+	}
+	if off+1 >= l.activeSegment.nextOffset {
+		return nil, nil, nil
+	}
+
+	i := 0
+	for j, s := range l.segments {
+		if s.baseOffset <= off {
+			i = j
+		}
+	}
+	s := l.segments[i]
+	if s.offloaded {
+		return s, nil, nil
+	}
+
+	var remote []uint64
+	if err := s.truncateAfter(off); err != nil {
+		return nil, nil, err
+	}
+	if s.uploaded {
+		s.uploaded = false
+		remote = append(remote, s.baseOffset)
+	}
+
+	removed := l.segments[i+1:]
+	l.segments = l.segments[:i+1]
+	l.activeSegment = s
+	m := l.manifest()
+	for _, s := range removed {
+		m.Removed = append(m.Removed, s.baseOffset)
+		if s.uploaded {
+			remote = append(remote, s.baseOffset)
+		}
+	}
+	if err := m.write(l.Dir); err != nil {
+		return nil, nil, err
+	}
+
+	for _, s := range removed {
+		if !s.offloaded {
+			s.store.invalidate()
+		}
+		if err := s.Remove(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	l.Config.logger().Info(
+		"log truncated",
+		zap.Uint64("offset", off),
+		zap.Uint64("base_offset", s.baseOffset),
+		zap.Int("removed_segments", len(removed)),
+	)
+
+	return nil, remote, s.store.sync()
+}
+
+// fromより後ろのレコードを含むセグメントのストアをストレージに同期し、書き込んだレコードが停止しても失われないようにする
+func (l *Log) sync(from uint64) error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return ErrNotReady
+	}
+	for _, s := range l.segments {
+		if s.offloaded || s.nextOffset <= from {
+			continue
+		}
+		if err := s.store.sync(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -191,6 +539,8 @@ Readerメソッドはio.MultiReaderを使ってセグメントのストアを連
 セグメントのストアはoriginReader型で定義
 ① io.Readerインターフェースを満たすことで、io.MultiReader呼び出しに渡すため
 ② ストアの最初から読み込みを開始し、そのファイル全体を読み込むことを保証するため
+Readerを作成した時点の各ストアの大きさまでを読み出すので、作成した後に書き込まれたレコードは含まない
+(RaftのスナップショットをPersistでコピーしている間に、Applyが書き込んだレコードを含めないようにする)
 */
 func (l *Log) Reader() io.Reader {
 	l.mu.RLock()
@@ -199,21 +549,66 @@ func (l *Log) Reader() io.Reader {
 	// segment分io.Readerスライスを作成
 	readers := make([]io.Reader, len(l.segments))
 	for i, segment := range l.segments {
-		readers[i] = &originReder{segment.store, 0}
+		// Config.Tier.Storeに移したセグメントは、読み出す時にストアから直接読み出す(ローカルには取得しない)
+		if segment.offloaded {
+			readers[i] = &remoteReader{store: l.Config.Tier.Store, name: blobName(segment.baseOffset)}
+			continue
+		}
+		readers[i] = &originReder{
+			store:     segment.store,
+			size:      int64(segment.store.size),
+			truncated: segment.store.truncations(),
+			remote:    remoteReader{store: l.Config.Tier.Store, name: blobName(segment.baseOffset)},
+		}
 	}
 
 	// 入力されたReaderを論理的に連結したReaderを返し、順次読み込む
 	return io.MultiReader(readers...)
 }
 
+// storeを埋め込むとos.FileのWriteToが昇格し、io.MultiReaderがファイルの現在位置から読み出してしまうので、フィールドとして持つ
 type originReder struct {
-	*store
-	off int64
+	store *store
+	off   int64
+	// Readerを作成した時点のストアの大きさ ここまでを読み出す
+	size int64
+	// Readerを作成した時点でストアが切り詰められた回数 読み出す間に切り詰められた場合はErrTruncatedを返す
+	truncated uint64
+	// 読み出す間にConfig.Tier.Storeに移してファイルを削除した場合は、ストアからoffの続きを読み出す
+	remote  remoteReader
+	evicted bool
 }
 
 func (o *originReder) Read(p []byte) (int, error) {
-	n, err := o.ReadAt(p, o.off)
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if rest := o.size - o.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	var (
+		n   int
+		err error
+	)
+	if !o.evicted {
+		n, err = o.store.readAtUntruncated(p, o.off, o.truncated)
+	}
+	if err == errEvicted {
+		// 移したストアは削除したファイルと同じ内容なので、読み出し済みの部分を読み飛ばす
+		if _, err := io.CopyN(io.Discard, &o.remote, o.off); err != nil {
+			return 0, err
+		}
+		o.evicted = true
+	}
+	if o.evicted {
+		n, err = o.remote.Read(p)
+	}
 	o.off += int64(n)
+	// 大きさまで読み出した場合は、ファイルの終わりに達していなくても終える
+	if err == io.EOF && o.off < o.size {
+		err = io.ErrUnexpectedEOF
+	}
 
 	return n, err
 }
@@ -233,9 +628,48 @@ func (l *Log) highestOffset() (uint64, error) {
 
 // 指定されたオフセットに保存されているレコードを読み出す
 func (l *Log) Read(off uint64) (*api.Record, error) {
-	// 読み込みの場合のみロックをかけない、該当の資源の書き込みはロックされる
-	l.mu.RLock()
-	defer l.mu.RUnlock()
+	return l.ReadContext(context.Background(), off)
+}
+
+// ctxのスパンを親としてトレースを記録しながらレコードを読み出す
+func (l *Log) ReadContext(ctx context.Context, off uint64) (record *api.Record, err error) {
+	start := time.Now()
+	ctx, span := startSpan(
+		ctx,
+		l.Config.tracer(),
+		"Log.Read",
+		trace.WithAttributes(attribute.Int64("proglog.offset", int64(off))),
+	)
+	defer func() {
+		l.metrics.readSeconds.Observe(time.Since(start).Seconds())
+		endSpan(span, err)
+	}()
+
+	for {
+		// 読み込みの場合のみロックをかけない、該当の資源の書き込みはロックされる
+		l.mu.RLock()
+		s, err := l.segmentFor(off)
+		if err != nil || !s.offloaded {
+			if err == nil {
+				record, err = s.read(ctx, off)
+			}
+			l.mu.RUnlock()
+			return record, err
+		}
+		l.mu.RUnlock()
+
+		// Config.Tier.Storeに移したセグメントは、取得してから読み出し直す
+		if err := l.fetch(ctx, s.baseOffset); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// 指定されたオフセットのレコードを含むセグメントを返す 読みロックを取得してから呼び出す
+func (l *Log) segmentFor(off uint64) (*segment, error) {
+	if !l.ready {
+		return nil, ErrNotReady
+	}
 
 	/*
 		指定されたレコードを含むセグメントを見つける
@@ -253,33 +687,86 @@ func (l *Log) Read(off uint64) (*api.Record, error) {
 	}
 
 	if s == nil || s.nextOffset <= off {
-		return nil, fmt.Errorf("offset out of range; %d", off)
+		return nil, api.ErrOffsetOutOfRange{Offset: off}
 	}
 
-	return s.Read(off)
+	return s, nil
 }
 
 // セグメント全てをクローズする
 func (l *Log) Close() error {
+	// ゴルーチンの処理がロックを取得するので、ロックを取得する前に停止する
+	l.stopWorkers()
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
+	l.ready = false
+
 	for _, segement := range l.segments {
 		if err := segement.Close(); err != nil {
 			return err
 		}
 	}
 
+	// セグメントをクローズしてから、他のプロセスが開けるようにロックを解放する
+	if l.lock != nil {
+		err := l.lock.release()
+		l.lock = nil
+		return err
+	}
+
+	return nil
+}
+
+/*
+ログが読み書きできる状態かどうかを確認する
+setUpが完了していない、クローズ済み、もしくはディレクトリに書き込めない場合はエラーを返す
+ロードバランサーなどからのヘルスチェックに使用する
+*/
+func (l *Log) Health() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return ErrNotReady
+	}
+
+	if l.Config.ReadOnly {
+		return nil
+	}
+
+	// 読み取り専用でマウントし直された場合などを検知する(ファイルは作成しない)
+	if err := unix.Access(l.Dir, unix.W_OK); err != nil {
+		return fmt.Errorf("log: directory %s is not writable: %w", l.Dir, err)
+	}
+
 	return nil
 }
 
 // ログをクローズして、そのデータを削除する
 func (l *Log) Remove() error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
 	if err := l.Close(); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(l.Dir)
+	var uploaded []uint64
+	for _, s := range l.segments {
+		if s.uploaded {
+			uploaded = append(uploaded, s.baseOffset)
+		}
+	}
+	if err := os.RemoveAll(l.Dir); err != nil {
+		return err
+	}
+	l.segments, l.activeSegment = nil, nil
+
+	// Config.Tier.Storeにアップロードしたセグメントも削除する
+	return l.deleteRemote(context.Background(), uploaded)
 }
 
 // ログを削除して置き換える新たなログを作成する
@@ -19,6 +19,7 @@ func TestLog(t *testing.T) {
 		"init with existing segments":       testInitExisting,
 		"reader":                            testReader,
 		"truncate":                          testTruncate,
+		"truncate after":                    testTruncateAfter,
 	} {
 		// 新たにログを作成せずテストすることが可能になる
 		t.Run(scenario, func(t *testing.T) {
@@ -170,3 +171,171 @@ func testTruncate(t *testing.T, log *Log) {
 	require.NoError(t, err)
 	require.NoError(t, log.Close())
 }
+
+func testTruncateAfter(t *testing.T, log *Log) {
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.Len(t, log.segments, 3)
+
+	// 2を含むセグメントを2のレコードの終わりで切り詰め、後ろのセグメントを削除する
+	require.NoError(t, log.TruncateAfter(2))
+	require.Len(t, log.segments, 2)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), highest)
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	_, err = os.Stat(segmentPath(log.Dir, 4, storeExt))
+	require.True(t, os.IsNotExist(err))
+
+	// 最大のオフセット以上の場合は何もしない
+	require.NoError(t, log.TruncateAfter(2))
+	require.NoError(t, log.TruncateAfter(10))
+
+	// 切り詰めた位置から書き込みを続け、再起動しても同じレコードを読み出せる
+	off, err := log.Append(&api.Record{Value: []byte("replaced 3")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), off)
+	require.NoError(t, log.Close())
+	log, err = NewLog(log.Dir, log.Config)
+	require.NoError(t, err)
+	for off, want := range []string{"record 0", "record 1", "record 2", "replaced 3"} {
+		record, err := log.Read(uint64(off))
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+
+	// 最小のオフセット-1の場合は全て取り除き、それより前はエラーにする
+	require.NoError(t, log.Truncate(1))
+	require.NoError(t, log.TruncateAfter(1))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+	_, err = log.Read(2)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, log.TruncateAfter(0))
+	off, err = log.Append(&api.Record{Value: []byte("record 2")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+	require.NoError(t, log.Close())
+}
+
+// 読み出しと書き込みを続けながら切り詰めても、読み出せるレコードはそのオフセットのものだけ
+func TestTruncateAfterConcurrentReads(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 4
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// Readerで読み出している途中のセグメントを切り詰めると、ErrTruncatedを返す
+	r := log.Reader()
+	_, err = r.Read(make([]byte, lenWidth))
+	require.NoError(t, err)
+	require.NoError(t, log.TruncateAfter(1))
+	_, err = io.ReadAll(r)
+	require.ErrorIs(t, err, ErrTruncated)
+
+	done := make(chan struct{})
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			for off := uint64(0); off < 20; off++ {
+				record, err := log.Read(off)
+				if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+					continue
+				}
+				if err == nil && record.Offset != off {
+					err = fmt.Errorf("read offset %d, got %d", off, record.Offset)
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}
+	}()
+
+	for i := 0; i < 50; i++ {
+		for j := 0; j < 10; j++ {
+			_, err := log.Append(&api.Record{Value: []byte("hello world")})
+			require.NoError(t, err)
+		}
+		require.NoError(t, log.TruncateAfter(uint64(i%5)))
+	}
+	close(done)
+	require.NoError(t, <-errc)
+}
+
+// TruncateAfterが取り除いたセグメントのファイルを削除する前に停止しても、起動時に削除する
+func TestTruncateAfterInterrupted(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	m, err := readManifest(dir)
+	require.NoError(t, err)
+	m.Segments, m.Removed = []uint64{0, 2}, []uint64{4}
+	require.NoError(t, m.write(dir))
+
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(3), highest)
+	_, err = os.Stat(segmentPath(dir, 4, storeExt))
+	require.True(t, os.IsNotExist(err))
+
+	// 取り除いたことが記録されていないセグメントは、これまで通りエラーにする
+	require.NoError(t, log.Close())
+	require.NoError(t, os.WriteFile(segmentPath(dir, 4, storeExt), nil, 0600))
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+func TestHealth(t *testing.T) {
+	dir, err := os.MkdirTemp("", "health-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	log, err := NewLog(dir, Config{})
+	require.NoError(t, err)
+	require.NoError(t, log.Health())
+
+	// クローズ後は読み書きできない
+	require.NoError(t, log.Close())
+	require.Equal(t, ErrNotReady, log.Health())
+
+	log, err = NewLog(dir, Config{})
+	require.NoError(t, err)
+	defer log.Close()
+	require.NoError(t, log.Health())
+
+	if os.Geteuid() == 0 {
+		t.Skip("root ignores directory permissions")
+	}
+	require.NoError(t, os.Chmod(dir, 0500))
+	defer os.Chmod(dir, 0700)
+	require.Error(t, log.Health())
+}
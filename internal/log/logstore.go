@@ -0,0 +1,145 @@
+package log
+
+import (
+	"fmt"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/hashicorp/raft"
+)
+
+var _ raft.LogStore = (*logStore)(nil)
+
+/*
+Raftのエントリをセグメントに保存するraft.LogStoreの実装
+エントリのインデックスをそのままログのオフセットにする Raftのインデックスは1から始まるので、InitialOffsetを1にする
+エントリの任期と種類はレコードのterm・typeに、データはvalueに保存する
+*/
+type logStore struct {
+	*Log
+}
+
+func newLogStore(dir string, c Config) (*logStore, error) {
+	c.Segment.InitialOffset = 1
+	log, err := NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logStore{log}, nil
+}
+
+// 最初のエントリのインデックス エントリがない場合は0
+func (l *logStore) FirstIndex() (uint64, error) {
+	first, _, err := l.bounds()
+	return first, err
+}
+
+// 最後のエントリのインデックス エントリがない場合は0
+func (l *logStore) LastIndex() (uint64, error) {
+	_, last, err := l.bounds()
+	return last, err
+}
+
+/*
+最初と最後のエントリのインデックスを返す
+スナップショットを取ってエントリを全て削除した後などは、セグメントがあってもエントリがないので、どちらも0を返す
+(Raftは最後のエントリのインデックスが0でなければ、そのエントリを読み出そうとする)
+*/
+func (l *logStore) bounds() (first, last uint64, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return 0, 0, ErrNotReady
+	}
+	first = l.segments[0].baseOffset
+	next := l.activeSegment.nextOffset
+	if next <= first {
+		return 0, 0, nil
+	}
+
+	return first, next - 1, nil
+}
+
+func (l *logStore) GetLog(index uint64, out *raft.Log) error {
+	in, err := l.Read(index)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return raft.ErrLogNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	out.Index = in.Offset
+	out.Term = in.Term
+	out.Type = raft.LogType(in.Type)
+	out.Data = in.Value
+
+	return nil
+}
+
+func (l *logStore) StoreLog(record *raft.Log) error {
+	return l.StoreLogs([]*raft.Log{record})
+}
+
+/*
+エントリを書き込み、ストレージに同期してから返す
+エントリのインデックスが次に書き込むオフセットより大きい場合は、それより前のエントリはスナップショットに含まれているので、
+全てのエントリを削除してそのインデックスから書き込む(スナップショットを受け取ったフォロワーなど)
+小さい場合は、先にDeleteRangeで削除されているはずなのでエラーにする
+*/
+func (l *logStore) StoreLogs(records []*raft.Log) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	for _, record := range records {
+		l.mu.RLock()
+		next := l.activeSegment.nextOffset
+		l.mu.RUnlock()
+
+		if record.Index > next {
+			if err := l.Truncate(record.Index - 1); err != nil {
+				return err
+			}
+		} else if record.Index < next {
+			return fmt.Errorf("log: raft log %d is already stored (next is %d)", record.Index, next)
+		}
+
+		if _, err := l.Append(&api.Record{
+			Value: record.Data,
+			Term:  record.Term,
+			Type:  uint32(record.Type),
+		}); err != nil {
+			return err
+		}
+	}
+
+	return l.sync(records[0].Index)
+}
+
+/*
+minからmaxまでのエントリを削除する
+① 先頭からの削除(スナップショットを取った後の圧縮)は、Truncateでmax以下のエントリだけを含むセグメントを削除する
+セグメントの途中までのエントリは残るが、Raftはスナップショットより前のエントリを読み出さないので問題ない
+② 末尾までの削除(リーダーと食い違ったエントリの削除)は、TruncateAfterでmin-1より後ろを切り詰める
+途中だけを削除することはRaftにはないので、エラーにする
+*/
+func (l *logStore) DeleteRange(min, max uint64) error {
+	first, last, err := l.bounds()
+	if err != nil {
+		return err
+	}
+	if last == 0 || max < first || min > last {
+		return nil
+	}
+
+	switch {
+	case min <= first:
+		return l.Truncate(max)
+	case max >= last:
+		return l.TruncateAfter(min - 1)
+	}
+
+	return fmt.Errorf("log: cannot delete raft logs %d-%d from the middle of %d-%d", min, max, first, last)
+}
@@ -0,0 +1,98 @@
+package log
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/raft"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestLogStore(t *testing.T, dir string) *logStore {
+	t.Helper()
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 3
+	s, err := newLogStore(dir, c)
+	require.NoError(t, err)
+
+	return s
+}
+
+func raftLogs(term uint64, from, to uint64) []*raft.Log {
+	var logs []*raft.Log
+	for i := from; i <= to; i++ {
+		logs = append(logs, &raft.Log{
+			Index: i,
+			Term:  term,
+			Type:  raft.LogCommand,
+			Data:  []byte(fmt.Sprintf("%d-%d", term, i)),
+		})
+	}
+
+	return logs
+}
+
+func requireIndexes(t *testing.T, s *logStore, first, last uint64) {
+	t.Helper()
+
+	got, err := s.FirstIndex()
+	require.NoError(t, err)
+	require.Equal(t, first, got)
+	got, err = s.LastIndex()
+	require.NoError(t, err)
+	require.Equal(t, last, got)
+}
+
+func TestLogStore(t *testing.T) {
+	dir := t.TempDir()
+	s := newTestLogStore(t, dir)
+
+	// エントリがない場合はどちらも0
+	requireIndexes(t, s, 0, 0)
+
+	require.NoError(t, s.StoreLogs(raftLogs(1, 1, 7)))
+	requireIndexes(t, s, 1, 7)
+
+	var out raft.Log
+	require.NoError(t, s.GetLog(5, &out))
+	require.Equal(t, raft.Log{Index: 5, Term: 1, Type: raft.LogCommand, Data: []byte("1-5")}, out)
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(8, &out))
+
+	// 同じインデックスを書き込み直すことはできない
+	require.Error(t, s.StoreLog(raftLogs(2, 7, 7)[0]))
+
+	// 食い違ったエントリを、セグメントをまたいで末尾まで削除し、別の任期のエントリで置き換える
+	require.NoError(t, s.DeleteRange(3, 7))
+	requireIndexes(t, s, 1, 2)
+	require.Equal(t, raft.ErrLogNotFound, s.GetLog(3, &out))
+	require.NoError(t, s.StoreLogs(raftLogs(2, 3, 5)))
+	require.NoError(t, s.GetLog(3, &out))
+	require.Equal(t, uint64(2), out.Term)
+
+	// 先頭からの削除は、削除する範囲だけを含むセグメントを削除する
+	require.NoError(t, s.DeleteRange(1, 4))
+	requireIndexes(t, s, 4, 5)
+
+	// 途中だけを削除することはできない
+	require.NoError(t, s.StoreLogs(raftLogs(2, 6, 8)))
+	require.Error(t, s.DeleteRange(5, 6))
+
+	// 再起動しても同じエントリを読み出せる
+	require.NoError(t, s.Close())
+	s = newTestLogStore(t, dir)
+	requireIndexes(t, s, 4, 8)
+	require.NoError(t, s.GetLog(8, &out))
+	require.Equal(t, []byte("2-8"), out.Data)
+
+	// 全て削除した後は、スナップショットの続きのインデックスから書き込める
+	require.NoError(t, s.DeleteRange(4, 8))
+	requireIndexes(t, s, 0, 0)
+	require.NoError(t, s.StoreLogs(raftLogs(3, 20, 21)))
+	requireIndexes(t, s, 20, 21)
+	require.NoError(t, s.Close())
+
+	s = newTestLogStore(t, dir)
+	defer s.Close()
+	requireIndexes(t, s, 20, 21)
+}
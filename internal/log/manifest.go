@@ -0,0 +1,335 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+/*
+ログのディレクトリに置くマニフェストファイル
+ディレクトリ内のファイル名だけからセグメントを探すと、無関係なファイルや消えたセグメントに気づけないので、
+ログが使用しているセグメントの一覧をマニフェストに記録し、起動時にディレクトリの内容と突き合わせる
+マニフェストは一時ファイルに書き込んでからリネームするので、書き込み途中の内容が残ることはない
+*/
+const (
+	manifestFile    = "MANIFEST"
+	manifestVersion = 1
+	// replaceFileが書き込み途中で停止した場合に残る一時ファイルの拡張子
+	tmpExt = ".tmp"
+)
+
+type manifest struct {
+	Version int `json:"version"`
+	// セグメントのベースオフセット 古い順に並んでいる
+	Segments []uint64 `json:"segments"`
+	// Segmentsのうち、Config.Tier.Storeにアップロード済みのセグメント ローカルのファイルはない場合がある
+	Remote []uint64 `json:"remote,omitempty"`
+	// TruncateAfterが取り除いたセグメント ファイルを削除する前に停止した場合は、起動時に削除する
+	Removed []uint64       `json:"removed,omitempty"`
+	Config  manifestConfig `json:"config"`
+}
+
+// マニフェストを書き込んだ時点のセグメントの設定
+type manifestConfig struct {
+	MaxStoreBytes uint64 `json:"max_store_bytes"`
+	MaxIndexBytes uint64 `json:"max_index_bytes"`
+	InitialOffset uint64 `json:"initial_offset"`
+}
+
+func newManifestConfig(c Config) manifestConfig {
+	return manifestConfig{
+		MaxStoreBytes: c.Segment.MaxStoreBytes,
+		MaxIndexBytes: c.Segment.MaxIndexBytes,
+		InitialOffset: c.Segment.InitialOffset,
+	}
+}
+
+// マニフェストを読み出す マニフェストがない場合はnilを返す
+func readManifest(dir string) (*manifest, error) {
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("log: %s is corrupt: %w", manifestFile, err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf(
+			"log: %s has format version %d, this build supports version %d",
+			manifestFile, m.Version, manifestVersion,
+		)
+	}
+
+	return m, nil
+}
+
+func writeManifest(dir string, segments, remote []uint64, c Config) error {
+	return (&manifest{
+		Version:  manifestVersion,
+		Segments: segments,
+		Remote:   remote,
+		Config:   newManifestConfig(c),
+	}).write(dir)
+}
+
+func (m *manifest) write(dir string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return replaceFile(filepath.Join(dir, manifestFile), append(b, '\n'))
+}
+
+// 現在のセグメントの一覧をマニフェストに書き込む extraは作成しようとしているセグメントのベースオフセット
+func (l *Log) writeManifest(extra ...uint64) error {
+	return l.manifest(extra...).write(l.Dir)
+}
+
+func (l *Log) manifest(extra ...uint64) *manifest {
+	segments := make([]uint64, 0, len(l.segments)+len(extra))
+	var remote []uint64
+	for _, s := range l.segments {
+		segments = append(segments, s.baseOffset)
+		if s.uploaded {
+			remote = append(remote, s.baseOffset)
+		}
+	}
+
+	return &manifest{
+		Version:  manifestVersion,
+		Segments: append(segments, extra...),
+		Remote:   remote,
+		Config:   newManifestConfig(l.Config),
+	}
+}
+
+/*
+ディレクトリ内のファイルからセグメントのベースオフセットを古い順に返す
+次の場合はエラーにする
+① セグメントのファイル、マニフェスト、ロックファイルのいずれでもないファイルやディレクトリがある
+② ファイル名のベースオフセットが正規の表記ではない(007.storeなど ログは7.storeを開くので、7.storeと重複したり別のセグメントとして扱われてしまう)
+③ ストアのないインデックスがある
+書き込み途中で残った一時ファイルは削除する
+*/
+func (l *Log) discoverSegments() ([]uint64, error) {
+	entries, err := os.ReadDir(l.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	stores := map[uint64]bool{}
+	var indexes []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if name == manifestFile || name == lockFile {
+			continue
+		}
+		if strings.HasSuffix(name, tmpExt) && !e.IsDir() {
+			// 読み取り専用の場合は削除せずに無視する
+			if l.Config.ReadOnly {
+				continue
+			}
+			if err := os.Remove(filepath.Join(l.Dir, name)); err != nil {
+				return nil, err
+			}
+			l.Config.logger().Warn("removed leftover temporary file", zap.String("file", name))
+			continue
+		}
+
+		ext := filepath.Ext(name)
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if e.IsDir() || err != nil || (ext != storeExt && ext != indexExt) {
+			return nil, fmt.Errorf(
+				"log: unexpected file %q in %s: the log directory may only contain segment files, %s and %s",
+				name, l.Dir, manifestFile, lockFile,
+			)
+		}
+		if want := strconv.FormatUint(base, 10) + ext; name != want {
+			if _, err := os.Stat(filepath.Join(l.Dir, want)); err == nil {
+				return nil, fmt.Errorf("log: segment file %q duplicates %q in %s", name, want, l.Dir)
+			}
+			return nil, fmt.Errorf(
+				"log: segment file %q in %s has a non-canonical name (want %q)",
+				name, l.Dir, want,
+			)
+		}
+
+		if ext == storeExt {
+			stores[base] = true
+		} else {
+			indexes = append(indexes, base)
+		}
+	}
+
+	for _, base := range indexes {
+		if !stores[base] {
+			return nil, fmt.Errorf(
+				"log: orphaned index %q in %s has no store file",
+				filepath.Base(segmentPath(l.Dir, base, indexExt)), l.Dir,
+			)
+		}
+	}
+
+	bases := make([]uint64, 0, len(stores))
+	for base := range stores {
+		bases = append(bases, base)
+	}
+	sort.Slice(bases, func(i, j int) bool {
+		return bases[i] < bases[j]
+	})
+
+	return bases, nil
+}
+
+/*
+マニフェストとディレクトリ内のセグメントを突き合わせ、開くセグメントと、マニフェストを書き直す必要があるかを返す
+停止するタイミングによっては次の食い違いが起こるので、これらは許容する
+① 古い順に並んだ先頭のセグメントのファイルがない Truncateでファイルを削除した後、マニフェストを書き込む前に停止した
+② 最後のセグメントのファイルがない マニフェストを書き込んだ後、新しいセグメントのファイルを作成する前に停止した
+③ アップロード済みのセグメントのファイルがない Config.Tier.Storeに移した
+④ 取り除いたセグメント(Removed)のファイルがある TruncateAfterがマニフェストを書き込んだ後、ファイルを削除する前に停止した(削除する)
+それ以外の、マニフェストにないセグメントや途中のセグメントがない場合はエラーにする
+*/
+func (l *Log) reconcileManifest(m *manifest, disk []uint64) ([]uint64, bool, error) {
+	logger := l.Config.logger()
+
+	// 以前のバージョンで作成されたディレクトリには、マニフェストがない
+	if m == nil {
+		if len(disk) > 0 {
+			logger.Info("manifest created from existing segments", zap.Int("segments", len(disk)))
+		}
+		return disk, true, nil
+	}
+
+	listed := map[uint64]bool{}
+	for i, base := range m.Segments {
+		if listed[base] {
+			return nil, false, fmt.Errorf("log: %s lists segment %d more than once", manifestFile, base)
+		}
+		if i > 0 && base < m.Segments[i-1] {
+			return nil, false, fmt.Errorf("log: %s lists segments out of order", manifestFile)
+		}
+		listed[base] = true
+	}
+
+	remote := map[uint64]bool{}
+	for _, base := range m.Remote {
+		if !listed[base] {
+			return nil, false, fmt.Errorf("log: %s lists remote segment %d that is not a segment", manifestFile, base)
+		}
+		remote[base] = true
+	}
+
+	// 取り除いたセグメントの記録は、ファイルを削除したらマニフェストを書き直して消す
+	rewrite := len(m.Removed) > 0 && !l.Config.ReadOnly
+	removed := map[uint64]bool{}
+	for _, base := range m.Removed {
+		removed[base] = true
+	}
+
+	present := map[uint64]bool{}
+	for _, base := range disk {
+		if !listed[base] && removed[base] {
+			// ④
+			if !l.Config.ReadOnly {
+				if err := removeSegmentFiles(l.Dir, base); err != nil {
+					return nil, false, err
+				}
+				logger.Warn("segment removed by truncation was left behind", zap.Uint64("base_offset", base))
+			}
+			continue
+		}
+		if !listed[base] {
+			return nil, false, fmt.Errorf(
+				"log: orphaned segment %d in %s is not listed in %s; move its files out of the directory or restore the manifest",
+				base, l.Dir, manifestFile,
+			)
+		}
+		present[base] = true
+	}
+
+	var bases []uint64
+	for i, base := range m.Segments {
+		switch {
+		case present[base]:
+			bases = append(bases, base)
+		case remote[base]:
+			// ③ Config.Tier.Storeに移したセグメント 読み出す時に取得する
+			if l.Config.Tier.Store == nil && !l.Config.ReadOnly {
+				return nil, false, fmt.Errorf(
+					"log: segment %d was moved to a segment store, but Config.Tier.Store is not set",
+					base,
+				)
+			}
+			bases = append(bases, base)
+		case len(bases) == 0 && i < len(m.Segments)-1:
+			// ①
+			logger.Warn("segment listed in manifest was already removed", zap.Uint64("base_offset", base))
+			rewrite = true
+		case i == len(m.Segments)-1:
+			// ② newSegmentがファイルを作成する
+			bases = append(bases, base)
+		default:
+			return nil, false, fmt.Errorf(
+				"log: segment %d listed in %s is missing from %s",
+				base, manifestFile, l.Dir,
+			)
+		}
+	}
+
+	// 読み取り専用のログは書き込まないので、設定が異なっていても影響はない
+	if old, cur := m.Config, newManifestConfig(l.Config); !l.Config.ReadOnly &&
+		(old.MaxStoreBytes != cur.MaxStoreBytes || old.MaxIndexBytes != cur.MaxIndexBytes) {
+		// 既存のセグメントは書き込んだ時の大きさのまま開き、新しい設定は以降に作成するセグメントに適用する
+		logger.Warn(
+			"segment config changed since the manifest was written",
+			zap.Uint64("old_max_store_bytes", old.MaxStoreBytes),
+			zap.Uint64("max_store_bytes", cur.MaxStoreBytes),
+			zap.Uint64("old_max_index_bytes", old.MaxIndexBytes),
+			zap.Uint64("max_index_bytes", cur.MaxIndexBytes),
+		)
+		rewrite = true
+	}
+
+	return bases, rewrite, nil
+}
+
+func removeSegmentFiles(dir string, base uint64) error {
+	for _, ext := range []string{indexExt, storeExt} {
+		if err := os.Remove(segmentPath(dir, base, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// aのうち、bにも含まれるものを順番を保って返す
+func intersect(a, b []uint64) []uint64 {
+	in := make(map[uint64]bool, len(b))
+	for _, v := range b {
+		in[v] = true
+	}
+
+	var out []uint64
+	for _, v := range a {
+		if in[v] {
+			out = append(out, v)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,220 @@
+package log
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func readManifestFile(t *testing.T, dir string) manifest {
+	t.Helper()
+
+	b, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	require.NoError(t, err)
+	var m manifest
+	require.NoError(t, json.Unmarshal(b, &m))
+
+	return m
+}
+
+// 1セグメントに2件ずつ、合計5件のレコードを書き込む(セグメントは0, 2, 4)
+func setupManifest(t *testing.T) (*Log, Config) {
+	t.Helper()
+
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 5; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	return log, c
+}
+
+func TestManifest(t *testing.T) {
+	log, c := setupManifest(t)
+
+	m := readManifestFile(t, log.Dir)
+	require.Equal(t, manifestVersion, m.Version)
+	require.Equal(t, []uint64{0, 2, 4}, m.Segments)
+	require.Equal(t, uint64(entWidth*2), m.Config.MaxIndexBytes)
+
+	require.NoError(t, log.Truncate(1))
+	require.Equal(t, []uint64{2, 4}, readManifestFile(t, log.Dir).Segments)
+	require.NoError(t, log.Close())
+
+	// マニフェストがないディレクトリ(以前のバージョンで作成されたもの)からは、マニフェストを作成する
+	require.NoError(t, os.Remove(filepath.Join(log.Dir, manifestFile)))
+	n, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{2, 4}, readManifestFile(t, log.Dir).Segments)
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(4), off)
+	require.NoError(t, n.Close())
+}
+
+func TestManifestTolerated(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		modify func(t *testing.T, dir string)
+		want   []uint64
+	}{
+		// Truncateでファイルを削除した後、マニフェストを書き込む前に停止した
+		"oldest segments already removed": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(filepath.Join(dir, "0.store")))
+				require.NoError(t, os.Remove(filepath.Join(dir, "0.index")))
+			},
+			want: []uint64{2, 4},
+		},
+		// マニフェストを書き込んだ後、セグメントのファイルを作成する前に停止した
+		"newest segment not created yet": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, writeManifest(dir, []uint64{0, 2, 4, 6}, nil, Config{}))
+			},
+			want: []uint64{0, 2, 4, 6},
+		},
+		"leftover temporary file": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "4.index.tmp"), nil, 0600))
+			},
+			want: []uint64{0, 2, 4},
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			log, c := setupManifest(t)
+			require.NoError(t, log.Close())
+
+			tc.modify(t, log.Dir)
+
+			n, err := NewLog(log.Dir, c)
+			require.NoError(t, err)
+			defer n.Close()
+			var bases []uint64
+			for _, s := range n.segments {
+				bases = append(bases, s.baseOffset)
+			}
+			require.Equal(t, tc.want, bases)
+			require.Equal(t, tc.want, readManifestFile(t, log.Dir).Segments)
+			_, err = os.Stat(filepath.Join(log.Dir, "4.index.tmp"))
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+// MaxIndexBytesを小さくしても、既存のセグメントのレコードはそのまま読み出せ、続きは新しいセグメントに書き込む
+func TestManifestConfigShrunk(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxIndexBytes = 1024
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Close())
+
+	c.Segment.MaxIndexBytes = entWidth * 3
+	n, err := NewLog(log.Dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	require.Equal(t, uint64(entWidth*3), readManifestFile(t, log.Dir).Config.MaxIndexBytes)
+
+	for off := uint64(0); off < 10; off++ {
+		record, err := n.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+	off, err := n.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+	require.Len(t, n.segments, 2)
+}
+
+func TestManifestErrors(t *testing.T) {
+	for scenario, tc := range map[string]struct {
+		modify func(t *testing.T, dir string)
+		want   string
+	}{
+		"foreign file": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0600))
+			},
+			want: `unexpected file "notes.txt"`,
+		},
+		"foreign directory": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.Mkdir(filepath.Join(dir, "2.store.d"), 0700))
+			},
+			want: `unexpected file "2.store.d"`,
+		},
+		"duplicate segment file": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "02.store"), nil, 0600))
+			},
+			want: `segment file "02.store" duplicates "2.store"`,
+		},
+		"non-canonical segment file": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.Rename(filepath.Join(dir, "4.store"), filepath.Join(dir, "004.store")))
+			},
+			want: `segment file "004.store" in`,
+		},
+		"orphaned index": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(filepath.Join(dir, "2.store")))
+			},
+			want: `orphaned index "2.index"`,
+		},
+		"orphaned segment": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, "9.store"), nil, 0600))
+			},
+			want: "orphaned segment 9",
+		},
+		"missing segment": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(filepath.Join(dir, "2.store")))
+				require.NoError(t, os.Remove(filepath.Join(dir, "2.index")))
+			},
+			want: "segment 2 listed in MANIFEST is missing",
+		},
+		"segment listed twice": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, writeManifest(dir, []uint64{0, 2, 2, 4}, nil, Config{}))
+			},
+			want: "lists segment 2 more than once",
+		},
+		"unsupported version": {
+			modify: func(t *testing.T, dir string) {
+				b, err := json.Marshal(manifest{Version: 99})
+				require.NoError(t, err)
+				require.NoError(t, os.WriteFile(filepath.Join(dir, manifestFile), b, 0600))
+			},
+			want: "format version 99",
+		},
+		"corrupt manifest": {
+			modify: func(t *testing.T, dir string) {
+				require.NoError(t, os.WriteFile(filepath.Join(dir, manifestFile), []byte("{"), 0600))
+			},
+			want: "MANIFEST is corrupt",
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			log, c := setupManifest(t)
+			require.NoError(t, log.Close())
+
+			tc.modify(t, log.Dir)
+
+			_, err := NewLog(log.Dir, c)
+			require.Error(t, err)
+			require.Contains(t, err.Error(), tc.want)
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package log
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+/*
+ログの状態をPrometheusのメトリクスとして公開する
+レイテンシや書き込みバイト数は操作のたびに記録し、
+セグメント数や充填率のような現在の状態はスクレイプの度にLogから読み出す
+*/
+type metrics struct {
+	appendSeconds prometheus.Histogram
+	readSeconds   prometheus.Histogram
+	bytesWritten  prometheus.Counter
+	removed       prometheus.Counter
+	uploaded      prometheus.Counter
+	offloaded     prometheus.Counter
+	fetched       prometheus.Counter
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		appendSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "append_duration_seconds",
+			Help:      "Latency of Log.Append.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		readSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "read_duration_seconds",
+			Help:      "Latency of Log.Read.",
+			Buckets:   prometheus.ExponentialBuckets(0.00001, 4, 10),
+		}),
+		bytesWritten: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "written_bytes_total",
+			Help:      "Bytes written to store files, including length prefixes.",
+		}),
+		removed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "retention_removed_segments_total",
+			Help:      "Segments removed by Log.Truncate.",
+		}),
+		uploaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "tier_uploaded_segments_total",
+			Help:      "Closed segments uploaded to the segment store.",
+		}),
+		offloaded: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "tier_offloaded_segments_total",
+			Help:      "Local copies of uploaded segments removed after the hot window.",
+		}),
+		fetched: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "tier_fetched_segments_total",
+			Help:      "Segments fetched from the segment store to serve reads.",
+		}),
+	}
+}
+
+// 現在の状態を表すゲージ スクレイプの度に読みロックを取ってLogから値を読み出す
+func (l *Log) gauges() []prometheus.Collector {
+	return []prometheus.Collector{
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "segments",
+			Help:      "Number of segments in the log.",
+		}, func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+
+			return float64(len(l.segments))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "active_segment_store_fill_ratio",
+			Help:      "Store size of the active segment relative to MaxStoreBytes.",
+		}, func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+
+			if l.activeSegment == nil {
+				return 0
+			}
+			return float64(l.activeSegment.store.size) / float64(l.Config.Segment.MaxStoreBytes)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "log",
+			Name:      "active_segment_index_fill_ratio",
+			Help:      "Index size of the active segment relative to MaxIndexBytes.",
+		}, func() float64 {
+			l.mu.RLock()
+			defer l.mu.RUnlock()
+
+			if l.activeSegment == nil {
+				return 0
+			}
+			return float64(l.activeSegment.index.size) / float64(l.Config.Segment.MaxIndexBytes)
+		}),
+	}
+}
+
+// Config.Registererにメトリクスを登録する
+func (l *Log) registerMetrics() error {
+	if l.Config.Registerer == nil {
+		return nil
+	}
+
+	collectors := append([]prometheus.Collector{
+		l.metrics.appendSeconds,
+		l.metrics.readSeconds,
+		l.metrics.bytesWritten,
+		l.metrics.removed,
+		l.metrics.uploaded,
+		l.metrics.offloaded,
+		l.metrics.fetched,
+	}, l.gauges()...)
+	for i, c := range collectors {
+		if err := l.Config.Registerer.Register(c); err != nil {
+			// 途中まで登録したものは取り消す
+			for _, c := range collectors[:i] {
+				l.Config.Registerer.Unregister(c)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package log
+
+import (
+	"os"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	dir, err := os.MkdirTemp("", "metrics-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	reg := prometheus.NewRegistry()
+	c := Config{Registerer: reg}
+	c.Segment.MaxStoreBytes = 32
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	_, err = log.Read(0)
+	require.NoError(t, err)
+
+	// 1セグメントに2レコードまでなので、3レコード書き込むと2セグメントになる
+	require.Equal(t, float64(2), gauge(t, reg, "proglog_log_segments"))
+	var written uint64
+	for _, s := range log.segments {
+		written += s.store.size
+	}
+	require.Equal(t, float64(written), testutil.ToFloat64(log.metrics.bytesWritten))
+	require.Equal(t, float64(log.activeSegment.store.size)/32, gauge(t, reg, "proglog_log_active_segment_store_fill_ratio"))
+
+	require.NoError(t, log.Truncate(1))
+	require.Equal(t, float64(1), testutil.ToFloat64(log.metrics.removed))
+	require.Equal(t, float64(1), gauge(t, reg, "proglog_log_segments"))
+
+	n, err := testutil.GatherAndCount(reg, "proglog_log_append_duration_seconds", "proglog_log_read_duration_seconds")
+	require.NoError(t, err)
+	require.Equal(t, 2, n)
+
+	// 同じRegistererに二つ目のLogを登録することはできない
+	otherDir := t.TempDir()
+	other, err := NewLog(otherDir, c)
+	require.Nil(t, other)
+	var already prometheus.AlreadyRegisteredError
+	require.ErrorAs(t, err, &already)
+
+	// 失敗したLogはクローズされているので、同じディレクトリを開き直せる
+	c.Registerer = nil
+	other, err = NewLog(otherDir, c)
+	require.NoError(t, err)
+	require.NoError(t, other.Close())
+}
+
+// 登録済みのゲージの値を名前から取得する
+func gauge(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	for _, mf := range mfs {
+		if mf.GetName() == name {
+			return mf.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+
+	return 0
+}
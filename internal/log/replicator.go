@@ -0,0 +1,336 @@
+package log
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+)
+
+/*
+他のノードのログを読み出し、ローカルのサーバーに書き込んで複製する(プル型のレプリケーション)
+discovery.Handlerを実装しているので、Membershipに渡すと参加したノードから複製を開始し、離脱したノードからの複製を停止する
+設定で決めたノードから複製する場合は、それぞれについてJoinを呼び出す
+
+① ノードごとにゴルーチンを起動し、ConsumeStreamで読み出したレコードをLocalServerにProduceする
+② 接続が切れたりエラーが起きたりした場合は、待ち時間を倍にしながら(最大MaxBackoff)再接続する
+③ ノードごとの次に読み出すオフセットをProgressFileに保存し、再起動後はその続きから複製する
+保存は一定間隔(ProgressInterval)とLeave・Closeの時に行う 異常終了した場合は最後の保存以降のレコードを、
+Produceの応答を待っている間に停止した場合はそのレコードを、再び書き込むことがある(at-least-once)
+*/
+type Replicator struct {
+	// 他のノードに接続する時のオプション(トランスポートの認証情報など)
+	DialOptions []grpc.DialOption
+	// 複製したレコードの書き込み先
+	LocalServer api.LogClient
+	// ノードごとの次に読み出すオフセットを保存するファイル 空の場合は保存せず、再起動すると0から複製する
+	ProgressFile string
+	// 進み具合を保存する間隔 0の場合は1秒
+	ProgressInterval time.Duration
+	// 再接続するまでの最初の待ち時間と最大の待ち時間 0の場合はそれぞれ100ミリ秒と10秒
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 構造化ログの出力先 nilの場合は何も出力しない
+	Logger *zap.Logger
+
+	initOnce sync.Once
+	initErr  error
+	logger   *zap.Logger
+
+	mu sync.Mutex
+	// 複製しているノードの名前から、複製を停止するためのチャネルへのマップ
+	servers map[string]*replication
+	// ノードの名前から、次に読み出すオフセットへのマップ 離脱したノードの分も残し、再び参加した時に続きから複製する
+	progress map[string]uint64
+	// 最後に保存してからprogressが変わった場合はtrue
+	dirty bool
+	// LeaveとsaveLoopが同時に保存しないようにする
+	saveMu sync.Mutex
+	closed bool
+	close  chan struct{}
+	wg     sync.WaitGroup
+}
+
+// leaveを閉じると複製を停止し、終了するとdoneが閉じられる
+type replication struct {
+	leave chan struct{}
+	done  chan struct{}
+}
+
+// ProgressFileに保存する内容
+type replicationProgress struct {
+	Peers map[string]uint64 `json:"peers"`
+}
+
+// 複製を開始する 既に複製しているノードの場合は何もしない
+func (r *Replicator) Join(name, addr string) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.closed {
+		return nil
+	}
+	if _, ok := r.servers[name]; ok {
+		return nil
+	}
+
+	rep := &replication{leave: make(chan struct{}), done: make(chan struct{})}
+	r.servers[name] = rep
+	r.wg.Add(1)
+	go r.replicate(name, addr, rep)
+
+	return nil
+}
+
+// 複製を停止し、ゴルーチンが終了するまで待ってから、そのノードの進み具合を保存する
+func (r *Replicator) Leave(name string) error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	rep, ok := r.servers[name]
+	if ok {
+		close(rep.leave)
+		delete(r.servers, name)
+	}
+	r.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	<-rep.done
+
+	return r.saveProgress()
+}
+
+// 全てのノードからの複製を停止し、終了するまで待ってから進み具合を保存する
+func (r *Replicator) Close() error {
+	if err := r.init(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil
+	}
+	r.closed = true
+	close(r.close)
+	r.mu.Unlock()
+
+	r.wg.Wait()
+
+	return r.saveProgress()
+}
+
+// 次に読み出すオフセット(複製が済んだ最後のオフセット+1)を返す まだ複製していないノードの場合は0
+func (r *Replicator) Progress(name string) uint64 {
+	// 保存された進み具合を読み込めない場合は、mapがnilなので0を返す
+	r.init()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.progress[name]
+}
+
+// 最初の呼び出しで設定の既定値を決め、保存された進み具合を読み込む
+func (r *Replicator) init() error {
+	r.initOnce.Do(func() {
+		r.logger = r.Logger
+		if r.logger == nil {
+			r.logger = zap.NewNop()
+		}
+		r.logger = r.logger.Named("replicator")
+		if r.ProgressInterval == 0 {
+			r.ProgressInterval = time.Second
+		}
+		if r.MinBackoff == 0 {
+			r.MinBackoff = 100 * time.Millisecond
+		}
+		if r.MaxBackoff == 0 {
+			r.MaxBackoff = 10 * time.Second
+		}
+		r.servers = map[string]*replication{}
+		r.close = make(chan struct{})
+
+		if r.progress, r.initErr = r.loadProgress(); r.initErr != nil {
+			return
+		}
+		if r.ProgressFile != "" {
+			r.wg.Add(1)
+			go r.saveLoop()
+		}
+	})
+
+	return r.initErr
+}
+
+/*
+nameのノードから複製する 離脱するかCloseされるまで、接続が切れても再接続を繰り返す
+grpc.Dialは接続を待たないので、ノードが停止している間もここでは失敗せず、ConsumeStreamのエラーとして待ち時間を置いて再試行する
+*/
+func (r *Replicator) replicate(name, addr string, rep *replication) {
+	defer r.wg.Done()
+	defer close(rep.done)
+
+	logger := r.logger.With(zap.String("name", name), zap.String("rpc_addr", addr))
+
+	cc, err := grpc.Dial(addr, r.DialOptions...)
+	if err != nil {
+		logger.Error("failed to dial", zap.Error(err))
+		return
+	}
+	defer cc.Close()
+	client := api.NewLogClient(cc)
+
+	// 離脱・Closeで、読み出し中のストリームと書き込み中のProduceも止める
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-rep.leave:
+		case <-r.close:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	backoff := r.MinBackoff
+	for {
+		n, err := r.stream(ctx, client, name)
+		if ctx.Err() != nil {
+			return
+		}
+		// 1件でも複製できた場合は、接続できていたものとして待ち時間を戻す
+		if n > 0 {
+			backoff = r.MinBackoff
+		}
+		logger.Warn("replication interrupted", zap.Error(err), zap.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
+
+// 保存された進み具合の続きからConsumeStreamで読み出し、ローカルに書き込む 複製したレコードの数を返す
+func (r *Replicator) stream(ctx context.Context, client api.LogClient, name string) (int, error) {
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: r.Progress(name)})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return n, err
+		}
+		// 書き込み先のログはレコードのオフセットを自身のオフセットで上書きする
+		off := res.Record.Offset
+		if _, err := r.LocalServer.Produce(ctx, &api.ProduceRequest{Record: res.Record}); err != nil {
+			return n, err
+		}
+		n++
+
+		r.mu.Lock()
+		r.progress[name] = off + 1
+		r.dirty = true
+		r.mu.Unlock()
+	}
+}
+
+// Closeされるまで、ProgressIntervalごとに進み具合を保存する
+func (r *Replicator) saveLoop() {
+	defer r.wg.Done()
+
+	ticker := time.NewTicker(r.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.close:
+			return
+		case <-ticker.C:
+		}
+		if err := r.saveProgress(); err != nil {
+			r.logger.Warn("failed to save replication progress", zap.Error(err))
+		}
+	}
+}
+
+func (r *Replicator) loadProgress() (map[string]uint64, error) {
+	progress := map[string]uint64{}
+	if r.ProgressFile == "" {
+		return progress, nil
+	}
+
+	b, err := os.ReadFile(r.ProgressFile)
+	if os.IsNotExist(err) {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var p replicationProgress
+	if err := json.Unmarshal(b, &p); err != nil {
+		return nil, fmt.Errorf("log: invalid replication progress %s: %w", r.ProgressFile, err)
+	}
+	for name, off := range p.Peers {
+		progress[name] = off
+	}
+
+	return progress, nil
+}
+
+// 前回の保存から変わっていれば、一時ファイルに書き込んでからリネームして保存する
+func (r *Replicator) saveProgress() error {
+	if r.ProgressFile == "" {
+		return nil
+	}
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	if !r.dirty {
+		r.mu.Unlock()
+		return nil
+	}
+	p := replicationProgress{Peers: make(map[string]uint64, len(r.progress))}
+	for name, off := range r.progress {
+		p.Peers[name] = off
+	}
+	r.dirty = false
+	r.mu.Unlock()
+
+	b, err := json.Marshal(p)
+	if err == nil {
+		err = replaceFile(r.ProgressFile, append(b, '\n'))
+	}
+	if err != nil {
+		// 次の保存で再び書き込む
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,189 @@
+package log
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+/*
+テスト用のログサービス internal/serverはこのパッケージに依存しているので使えない
+ConsumeStreamは、まだ書き込まれていないオフセットの場合は書き込まれるまで待つ
+*/
+type testLogServer struct {
+	api.UnimplementedLogServer
+	log *Log
+}
+
+func (s *testLogServer) Produce(_ context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
+	off, err := s.log.Append(req.Record)
+	if err != nil {
+		return nil, err
+	}
+	return &api.ProduceResponse{Offset: off}, nil
+}
+
+func (s *testLogServer) ConsumeStream(req *api.ConsumeRequest, stream api.Log_ConsumeStreamServer) error {
+	for off := req.Offset; ; {
+		record, err := s.log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			select {
+			case <-stream.Context().Done():
+				return nil
+			case <-time.After(10 * time.Millisecond):
+				continue
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(&api.ConsumeResponse{Record: record}); err != nil {
+			return err
+		}
+		off++
+	}
+}
+
+type testNode struct {
+	log    *Log
+	addr   string
+	server *grpc.Server
+}
+
+// ログを開き、addr(空の場合は空いているポート)でログサービスを開始する
+func startTestNode(t *testing.T, log *Log, addr string) *testNode {
+	t.Helper()
+
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	l, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+
+	server := grpc.NewServer()
+	api.RegisterLogServer(server, &testLogServer{log: log})
+	go server.Serve(l)
+	t.Cleanup(server.Stop)
+
+	return &testNode{log: log, addr: l.Addr().String(), server: server}
+}
+
+func newTestNode(t *testing.T) *testNode {
+	t.Helper()
+
+	log, err := NewLog(t.TempDir(), Config{})
+	require.NoError(t, err)
+	t.Cleanup(func() { log.Close() })
+
+	return startTestNode(t, log, "")
+}
+
+func appendValues(t *testing.T, log *Log, values ...string) {
+	t.Helper()
+
+	for _, v := range values {
+		_, err := log.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+}
+
+// ログの全てのレコードの値
+func readValues(t *testing.T, log *Log) []string {
+	t.Helper()
+
+	var values []string
+	for off := uint64(0); ; off++ {
+		record, err := log.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return values
+		}
+		require.NoError(t, err)
+		values = append(values, string(record.Value))
+	}
+}
+
+func TestReplicator(t *testing.T) {
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	local := newTestNode(t)
+	cc, err := grpc.Dial(local.addr, dialOpts...)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	a, b := newTestNode(t), newTestNode(t)
+	appendValues(t, a.log, "a0", "a1", "a2")
+	appendValues(t, b.log, "b0")
+
+	progressFile := filepath.Join(t.TempDir(), "replication.json")
+	newReplicator := func() *Replicator {
+		return &Replicator{
+			DialOptions:      dialOpts,
+			LocalServer:      api.NewLogClient(cc),
+			ProgressFile:     progressFile,
+			ProgressInterval: 10 * time.Millisecond,
+			MinBackoff:       10 * time.Millisecond,
+			MaxBackoff:       50 * time.Millisecond,
+		}
+	}
+	r := newReplicator()
+	require.NoError(t, r.Join("a", a.addr))
+	require.NoError(t, r.Join("b", b.addr))
+	require.NoError(t, r.Join("b", b.addr))
+
+	waitValues := func(want ...string) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return len(readValues(t, local.log)) == len(want)
+		}, 5*time.Second, 10*time.Millisecond)
+		require.ElementsMatch(t, want, readValues(t, local.log))
+	}
+	waitValues("a0", "a1", "a2", "b0")
+
+	// 離脱したノードからは複製しない
+	waitProgress := func(name string, want uint64) {
+		t.Helper()
+		require.Eventually(t, func() bool {
+			return r.Progress(name) == want
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+	waitProgress("a", 3)
+	require.NoError(t, r.Leave("a"))
+	require.Equal(t, uint64(3), r.Progress("a"))
+	appendValues(t, a.log, "a3")
+
+	// 停止したノードには、再び起動するまで再接続を繰り返す
+	b.server.Stop()
+	appendValues(t, b.log, "b1")
+	time.Sleep(100 * time.Millisecond)
+	b = startTestNode(t, b.log, b.addr)
+	appendValues(t, b.log, "b2")
+	waitValues("a0", "a1", "a2", "b0", "b1", "b2")
+
+	// 再起動しても保存した進み具合の続きから複製するので、同じレコードを再び書き込まない
+	waitProgress("b", 3)
+	require.NoError(t, r.Close())
+	r = newReplicator()
+	defer r.Close()
+	require.Equal(t, uint64(3), r.Progress("b"))
+	appendValues(t, b.log, "b3")
+	require.NoError(t, r.Join("b", b.addr))
+	require.NoError(t, r.Join("a", a.addr))
+	waitValues("a0", "a1", "a2", "a3", "b0", "b1", "b2", "b3")
+}
+
+func TestReplicatorInvalidProgress(t *testing.T) {
+	progressFile := filepath.Join(t.TempDir(), "replication.json")
+	require.NoError(t, replaceFile(progressFile, []byte("{")))
+
+	r := &Replicator{ProgressFile: progressFile}
+	err := r.Join("a", "127.0.0.1:0")
+	require.Error(t, err)
+	require.Contains(t, err.Error(), fmt.Sprintf("invalid replication progress %s", progressFile))
+}
@@ -1,11 +1,16 @@
 package log
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 
 	api "github.com/KeisukeYamane/proglog/api/v1"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -28,6 +33,14 @@ type segment struct {
 	baseOffset uint64 // インデックスエントリの相対的なオフセットを計算するためのオフセット
 	nextOffset uint64 // 新たなレコードを追加する際のオフセット
 	config     Config // ストアファイルとインデックスのサイズを設定された制限値と比較でき、セグメントが最大になったことを知ることが可能
+	// OpenReadOnlyで開いた場合に、読み込んだ最後のエントリが指すフレームの終わりの位置
+	followed uint64
+	// Config.Tier.Storeにストアをアップロード済み
+	uploaded bool
+	// ローカルのファイルを削除し、Config.Tier.Storeにだけある storeとindexはnil
+	offloaded bool
+	logger    *zap.Logger
+	tracer    trace.Tracer
 }
 
 /*
@@ -38,13 +51,19 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 	s := &segment{
 		baseOffset: baseOffset,
 		config:     c,
+		logger:     c.logger().With(zap.Uint64("base_offset", baseOffset)),
+		tracer:     c.tracer(),
 	}
 
 	// storeファイルを取得する baseOffsetを使用
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if c.ReadOnly {
+		flag = os.O_RDONLY
+	}
 	storeFile, err := os.OpenFile(
 		// Join関数(引数同士を/で連結する。もしも引数の先頭や末尾に/が含まれていても取り除かれる)
 		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".store")), // storeファイルの拡張子は.store
-		os.O_RDWR|os.O_CREATE|os.O_APPEND,
+		flag,
 		0600,
 	)
 	if err != nil {
@@ -55,9 +74,33 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	indexPath := filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")) // indexファイルの拡張子は.index
+	if c.follow {
+		// 書き込み中のインデックスはストアと食い違っているのが普通なので、読み込めるエントリだけを読み込む
+		s.index = newReadOnlyIndex(nil)
+		if err := s.refresh(); err != nil {
+			s.store.Close()
+			return nil, err
+		}
+		return s.opened()
+	}
+	if c.ReadOnly {
+		if s.index, err = s.readIndex(indexPath); err != nil {
+			s.store.Close()
+			return nil, err
+		}
+		return s.opened()
+	}
+
+	// indexファイルをメモリにマップする前に、ストアと食い違っていないか確認する
+	if err := s.checkIndex(indexPath); err != nil {
+		s.store.Close()
+		return nil, err
+	}
+
 	// indexファイルを取得する baseOffSetを使用
 	indexFile, err := os.OpenFile(
-		filepath.Join(dir, fmt.Sprintf("%d%s", baseOffset, ".index")), // indexファイルの拡張子は.index
+		indexPath,
 		os.O_RDWR|os.O_CREATE|os.O_APPEND,
 		0600,
 	)
@@ -69,31 +112,170 @@ func newSegment(dir string, baseOffset uint64, c Config) (*segment, error) {
 		return nil, err
 	}
 
+	return s.opened()
+}
+
+// Config.Tier.Storeに移したセグメント nextOffsetは呼び出し元が設定する
+func newOffloadedSegment(baseOffset uint64, c Config) *segment {
+	return &segment{
+		baseOffset: baseOffset,
+		nextOffset: baseOffset,
+		config:     c,
+		uploaded:   true,
+		offloaded:  true,
+		logger:     c.logger().With(zap.Uint64("base_offset", baseOffset)),
+		tracer:     c.tracer(),
+	}
+}
+
+// インデックスの最後のエントリからnextOffsetを求める
+func (s *segment) opened() (*segment, error) {
+	baseOffset := s.baseOffset
 	if off, _, err := s.index.Read(-1); err != nil {
 		// errが返る場合はindexファイルの中身が何もない時
 		s.nextOffset = baseOffset
-		fmt.Println("----------")
-		fmt.Println("s.nextOffset = baseOffset", s.nextOffset)
-		fmt.Println("----------")
 	} else {
 		/*
 		 インデックスに少なくとも1つのエントリがある場合、
 		 次に書き込まれるレコードのオフセットはセグメントの最後のオフセットを使う必要がある
 		 ベースのオフセットと相対オフセットの和に1を加算して取得可能
 		*/
-		fmt.Println("----------")
-		fmt.Println("${baseOffset + uint64(off) + 1}", baseOffset)
-		fmt.Println("${baseOffset + uint64(off) + 1}", uint64(off))
-		fmt.Println("${baseOffset + uint64(off) + 1}", 1)
-		fmt.Println("----------")
 		s.nextOffset = baseOffset + uint64(off) + 1
 	}
 
+	s.logger.Debug(
+		"segment opened",
+		zap.Uint64("next_offset", s.nextOffset),
+		zap.Uint64("store_bytes", s.store.size),
+		zap.Uint64("index_bytes", s.index.size),
+	)
+
 	return s, nil
 }
 
+/*
+インデックスが次のいずれかの場合は、ストアのフレームから作り直す
+① インデックスファイルがない(ストアが空の場合は新しいセグメントなので何もしない)
+② ストアのフレームより少ないエントリしかない(インデックスへの書き込みの前に停止した場合など)
+③ ストアと食い違っている(クローズされずに最大サイズのまま残った場合など)
+インデックスが壊れたままだとnextOffsetがベースオフセットに戻り、書き込み済みのオフセットを上書きしてしまう
+全てのフレームを読み出すと起動が遅くなるので、最初と最後のエントリがストアの先頭と末尾のフレームを指しているかだけを確認する
+*/
+func (s *segment) checkIndex(path string) error {
+	b, err := os.ReadFile(path)
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return err
+	}
+	if s.indexMatchesStore(b) {
+		return nil
+	}
+
+	rebuilt, end, err := buildIndex(s.store.File, s.store.size)
+	if err != nil {
+		return err
+	}
+	reason := "inconsistent"
+	if missing {
+		reason = "missing"
+	} else if len(parseIndex(b)) < len(rebuilt)/entWidth {
+		reason = "short"
+	}
+
+	/*
+		作り直したインデックスがMaxIndexBytesに入りきらない場合
+		① 既存のインデックスが一杯で、その後ろのフレームと一致している場合は、インデックスに書き込めずに失敗したレコードなので含めない
+		② それ以外(MaxIndexBytesを小さくした後など)は書き込み済みのレコードなので、取り除かずにエラーを返す
+	*/
+	if max := s.config.Segment.MaxIndexBytes / entWidth * entWidth; uint64(len(rebuilt)) > max {
+		if uint64(len(b)) < max || !bytes.Equal(b[:max], rebuilt[:max]) {
+			return fmt.Errorf(
+				"log: segment %d has %d records, more than MaxIndexBytes (%d) can index: use the MaxIndexBytes the segment was written with",
+				s.baseOffset, len(rebuilt)/entWidth, s.config.Segment.MaxIndexBytes,
+			)
+		}
+		end = enc.Uint64(rebuilt[max+offWidth : max+entWidth])
+		rebuilt = rebuilt[:max]
+	}
+
+	// 途中で終わっている末尾のフレームは読み出せないので取り除き、次の書き込みがその後ろに続かないようにする
+	truncated := s.store.size - end
+	if truncated > 0 {
+		if err := s.store.File.Truncate(int64(end)); err != nil {
+			return err
+		}
+		s.store.size = end
+	}
+
+	if err := replaceFile(path, rebuilt); err != nil {
+		return err
+	}
+	s.logger.Warn(
+		"index rebuilt from store",
+		zap.String("reason", reason),
+		zap.Int("entries", len(rebuilt)/entWidth),
+		zap.Uint64("truncated_store_bytes", truncated),
+	)
+
+	return nil
+}
+
+/*
+読み取り専用のセグメントのインデックスを読み込む
+ファイルを変更できないので、インデックスがストアと食い違っている場合はストアからメモリ上に作り直す
+*/
+func (s *segment) readIndex(path string) (*index, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s.indexMatchesStore(b) {
+		return newReadOnlyIndex(b), nil
+	}
+
+	rebuilt, _, err := buildIndex(s.store.File, s.store.size)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Warn("index rebuilt from store in memory", zap.Int("entries", len(rebuilt)/entWidth))
+
+	return newReadOnlyIndex(rebuilt), nil
+}
+
+// インデックスの内容が、ストアのフレームと一致しているように見えるか
+func (s *segment) indexMatchesStore(b []byte) bool {
+	entries := parseIndex(b)
+	if len(entries)*entWidth != len(b) {
+		// 未使用領域やエントリの幅に満たないバイトが残っている
+		return false
+	}
+	if len(entries) == 0 {
+		return s.store.size == 0
+	}
+
+	first, last := entries[0], entries[len(entries)-1]
+	if first.off != 0 || first.pos != 0 || last.off != uint32(len(entries)-1) {
+		return false
+	}
+	if last.pos+lenWidth > s.store.size {
+		return false
+	}
+	size := make([]byte, lenWidth)
+	if _, err := s.store.File.ReadAt(size, int64(last.pos)); err != nil {
+		return false
+	}
+
+	// 最後のエントリが指すフレームで、ストアがちょうど終わっている
+	return last.pos+lenWidth+enc.Uint64(size) == s.store.size
+}
+
 // セグメントにレコードを書き込む store->indexの順に書き込む
 func (s *segment) Append(record *api.Record) (offset uint64, err error) {
+	return s.append(context.Background(), record)
+}
+
+// ctxのスパンを親として、ストアへの書き込みのスパンを記録する
+func (s *segment) append(ctx context.Context, record *api.Record) (offset uint64, err error) {
 	cur := s.nextOffset
 	record.Offset = cur
 
@@ -101,25 +283,19 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 		recordはレコードの実態そのもの 一度マーシャリングを行い、byte列に変換する
 		value:"hello world" offset:16 先左がエンコーディングされる
 	*/
-	fmt.Println("before record", record)
 	p, err := proto.Marshal(record)
-	fmt.Println("after proto.Marshal(record)", p)
 	if err != nil {
 		return 0, err
 	}
 
 	// posにはマーシャリングされたレコードを読み出す位置が格納されている(= 何もレコードがない時はもちろんposは0になる)
+	_, span := startSpan(ctx, s.tracer, "store.Append")
 	_, pos, err := s.store.Append(p)
+	endSpan(span, err)
 	if err != nil {
 		return 0, err
 	}
 
-	fmt.Println("cur", cur)
-	fmt.Println("s.nextOffset (before append data)", s.nextOffset)
-	fmt.Println("s.baseOffset (before append data)", s.baseOffset)
-	fmt.Println("uint32(s.nextOffset-uint64(s.baseOffset))", uint32(s.nextOffset-uint64(s.baseOffset)))
-	fmt.Println("now store size(before append date in store)", pos)
-
 	if err = s.index.Write(
 		// インデックスのオフセットは、ベースのオフセットからの相対
 		uint32(s.nextOffset-uint64(s.baseOffset)),
@@ -134,6 +310,11 @@ func (s *segment) Append(record *api.Record) (offset uint64, err error) {
 
 // セグメントからレコードを読み出す index->storeの順に読み出す
 func (s *segment) Read(off uint64) (*api.Record, error) {
+	return s.read(context.Background(), off)
+}
+
+// ctxのスパンを親として、ストアからの読み出しのスパンを記録する
+func (s *segment) read(ctx context.Context, off uint64) (*api.Record, error) {
 	/*
 		絶対オフセットを相対オフセットに変換し、関連するインデックスエントリの内容を取得する
 		posはstoreファイル内の位置が保持されているので、それを使用しstoreファイル内のレコードを取得できる
@@ -143,7 +324,14 @@ func (s *segment) Read(off uint64) (*api.Record, error) {
 		return nil, err
 	}
 
+	_, span := startSpan(
+		ctx,
+		s.tracer,
+		"store.Read",
+		trace.WithAttributes(attribute.Int64("proglog.position", int64(pos))),
+	)
 	p, err := s.store.Read(pos)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -166,8 +354,37 @@ func (s *segment) IsMaxed() bool {
 		s.index.isMaxed()
 }
 
+/*
+offより後ろのレコードを取り除き、offのレコードでストアとインデックスが終わるようにする
+offがbaseOffset-1の場合は空のセグメントになる
+ストアを先に切り詰めるので、インデックスを切り詰める前に停止しても、起動時にcheckIndexが切り詰めたストアからインデックスを作り直す
+*/
+func (s *segment) truncateAfter(off uint64) error {
+	if off+1 >= s.nextOffset {
+		return nil
+	}
+
+	entries := off + 1 - s.baseOffset
+	_, pos, err := s.index.Read(int64(entries))
+	if err != nil {
+		return err
+	}
+	if err := s.store.truncate(pos); err != nil {
+		return err
+	}
+	s.index.truncate(entries)
+	s.nextOffset = off + 1
+
+	return nil
+}
+
 // セグメントを閉じて、インデックスファイルとストアファイルを削除する
 func (s *segment) Remove() error {
+	// ローカルのファイルはすでに削除している
+	if s.offloaded {
+		return nil
+	}
+
 	// インデックスファイルとストアファイルにフラッシュと同期をかける
 	if err := s.Close(); err != nil {
 		return err
@@ -187,6 +404,10 @@ func (s *segment) Remove() error {
 }
 
 func (s *segment) Close() error {
+	if s.offloaded {
+		return nil
+	}
+
 	if err := s.index.Close(); err != nil {
 		return err
 	}
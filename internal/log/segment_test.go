@@ -7,6 +7,8 @@ import (
 
 	api "github.com/KeisukeYamane/proglog/api/v1"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
 	"google.golang.org/protobuf/proto"
 )
 
@@ -69,3 +71,116 @@ func TestSegment(t *testing.T) {
 	require.NoError(t, s.Close())
 
 }
+
+func TestSegmentRebuildIndex(t *testing.T) {
+	want := &api.Record{Value: []byte("hello world")}
+	p, _ := proto.Marshal(&api.Record{Value: want.Value, Offset: initialBaseOffset})
+	frameWidth := int64(len(p) + lenWidth)
+
+	for scenario, tc := range map[string]struct {
+		corrupt func(t *testing.T, dir string)
+		reason  string
+		entries int64
+	}{
+		"missing index": {
+			corrupt: func(t *testing.T, dir string) {
+				require.NoError(t, os.Remove(dir+"/16.index"))
+			},
+			reason:  "missing",
+			entries: 3,
+		},
+		"short index": {
+			corrupt: func(t *testing.T, dir string) {
+				require.NoError(t, os.Truncate(dir+"/16.index", entWidth))
+			},
+			reason:  "short",
+			entries: 3,
+		},
+		// クローズされずに終了すると、インデックスは最大サイズのままゼロで埋まっている
+		"index not truncated on close": {
+			corrupt: func(t *testing.T, dir string) {
+				require.NoError(t, os.Truncate(dir+"/16.index", 1024))
+			},
+			reason:  "inconsistent",
+			entries: 3,
+		},
+		// 書き込みの途中で終了すると、ストアの末尾のフレームが途中で終わっている
+		"truncated store frame": {
+			corrupt: func(t *testing.T, dir string) {
+				require.NoError(t, os.Truncate(dir+"/16.store", 3*frameWidth-1))
+				require.NoError(t, os.Truncate(dir+"/16.index", 3*entWidth))
+			},
+			reason:  "inconsistent",
+			entries: 2,
+		},
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			dir := t.TempDir()
+			core, logs := observer.New(zap.WarnLevel)
+			c := Config{Logger: zap.New(core)}
+			c.Segment.MaxStoreBytes = 1024
+			c.Segment.MaxIndexBytes = 1024
+
+			s, err := newSegment(dir, initialBaseOffset, c)
+			require.NoError(t, err)
+			for i := 0; i < 3; i++ {
+				_, err := s.Append(want)
+				require.NoError(t, err)
+			}
+			require.NoError(t, s.Close())
+			require.Equal(t, 0, logs.Len())
+
+			tc.corrupt(t, dir)
+
+			s, err = newSegment(dir, initialBaseOffset, c)
+			require.NoError(t, err)
+			defer s.Close()
+
+			entries := logs.FilterMessage("index rebuilt from store").All()
+			require.Len(t, entries, 1)
+			fields := entries[0].ContextMap()
+			require.Equal(t, tc.reason, fields["reason"])
+			require.Equal(t, tc.entries, fields["entries"])
+
+			// 作り直したインデックスから読み出せ、続きのオフセットから書き込める
+			for off := uint64(initialBaseOffset); off < initialBaseOffset+uint64(tc.entries); off++ {
+				got, err := s.Read(off)
+				require.NoError(t, err)
+				require.Equal(t, off, got.Offset)
+			}
+			off, err := s.Append(want)
+			require.NoError(t, err)
+			require.Equal(t, initialBaseOffset+uint64(tc.entries), off)
+			got, err := s.Read(off)
+			require.NoError(t, err)
+			require.Equal(t, want.Value, got.Value)
+		})
+	}
+}
+
+// 作り直したインデックスがMaxIndexBytesに入りきらない場合は、レコードを取り除かずにエラーを返す
+func TestSegmentRebuildIndexOverCap(t *testing.T) {
+	dir := t.TempDir()
+	c := Config{}
+	c.Segment.MaxStoreBytes = 1024
+	c.Segment.MaxIndexBytes = 1024
+
+	s, err := newSegment(dir, initialBaseOffset, c)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := s.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	store, err := os.Stat(dir + "/16.store")
+	require.NoError(t, err)
+	require.NoError(t, os.Remove(dir+"/16.index"))
+
+	c.Segment.MaxIndexBytes = entWidth * 2
+	_, err = newSegment(dir, initialBaseOffset, c)
+	require.Error(t, err)
+
+	after, err := os.Stat(dir + "/16.store")
+	require.NoError(t, err)
+	require.Equal(t, store.Size(), after.Size())
+}
@@ -0,0 +1,340 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ログのスナップショット
+アーカイブはtar形式で、先頭にマニフェスト、続いて古い順に各セグメントのストアファイルを格納する
+インデックスはストアのフレームから作り直せるので格納しない(書き込み中のインデックスは最大サイズまで広げられていて、
+そのままでは使えないため)
+*/
+
+// アーカイブの形式が正しくない場合に返すエラー
+var ErrInvalidSnapshot = errors.New("log: invalid snapshot")
+
+// スナップショットに含めるセグメントのストア
+type snapshotFile struct {
+	baseOffset uint64
+	// Config.Tier.Storeに移したセグメントの場合はnil
+	file *os.File
+	size int64
+}
+
+/*
+全てのセグメントのストアを、スナップショットを開始した時点のアクティブセグメントの最後のレコードまでwに書き出す
+ロックを取得するのは、アクティブセグメントのバッファを書き出してファイルを開き直す間だけなので、書き込みはほとんど待たされない
+開き直したファイルから読み出すので、書き出している間にTruncateでファイルが削除されても影響はない
+*/
+func (l *Log) Snapshot(w io.Writer) error {
+	files, err := l.snapshotFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			if f.file != nil {
+				f.file.Close()
+			}
+		}
+	}()
+
+	segments := make([]uint64, 0, len(files))
+	for _, f := range files {
+		segments = append(segments, f.baseOffset)
+	}
+	m, err := json.MarshalIndent(manifest{
+		Version:  manifestVersion,
+		Segments: segments,
+		Config:   newManifestConfig(l.Config),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	m = append(m, '\n')
+
+	now := time.Now()
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, manifestFile, int64(len(m)), now, bytes.NewReader(m)); err != nil {
+		return err
+	}
+	for _, f := range files {
+		name := blobName(f.baseOffset)
+		if f.file == nil {
+			if err := l.snapshotRemote(tw, name, now); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := writeTarFile(tw, name, f.size, now, io.NewSectionReader(f.file, 0, f.size)); err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// Config.Tier.Storeに移したセグメントは、ストアから読み出して書き出す
+func (l *Log) snapshotRemote(tw *tar.Writer, name string, modTime time.Time) error {
+	rc, size, err := l.Config.Tier.Store.Get(context.Background(), name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	return writeTarFile(tw, name, size, modTime, rc)
+}
+
+// ロックを取得している間に、各セグメントのストアを開き直してスナップショットに含めるサイズを決める
+func (l *Log) snapshotFiles() ([]snapshotFile, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return nil, ErrNotReady
+	}
+
+	// アクティブセグメントのバッファに残っているレコードもファイルに書き出す
+	if err := l.activeSegment.store.flush(); err != nil {
+		return nil, err
+	}
+
+	files := make([]snapshotFile, 0, len(l.segments))
+	for _, s := range l.segments {
+		if s.offloaded {
+			files = append(files, snapshotFile{baseOffset: s.baseOffset})
+			continue
+		}
+		f, err := os.Open(s.store.Name())
+		if err != nil {
+			for _, f := range files {
+				if f.file != nil {
+					f.file.Close()
+				}
+			}
+			return nil, err
+		}
+		files = append(files, snapshotFile{
+			baseOffset: s.baseOffset,
+			file:       f,
+			size:       int64(s.store.size),
+		})
+	}
+
+	return files, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0600,
+		Size:     size,
+		ModTime:  modTime,
+	}); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(tw, r, size); err != nil {
+		return fmt.Errorf("log: snapshot %s: %w", name, err)
+	}
+
+	return nil
+}
+
+/*
+Snapshotで作成したアーカイブから、NewLogで開けるログのディレクトリを作成する
+dirは存在しないか空である必要がある
+① 一時ディレクトリにマニフェストとストアを展開する
+② ストアからインデックスを作り直し、各レコードのオフセットとセグメントの連続性を検査する
+③ 一時ディレクトリをdirにリネームする 途中で失敗しても、中途半端なログのディレクトリは残らない
+*/
+func Restore(dir string, r io.Reader) error {
+	if entries, err := os.ReadDir(dir); err == nil && len(entries) > 0 {
+		return fmt.Errorf("log: restore into %s: directory is not empty", dir)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	tmp := filepath.Clean(dir) + tmpExt
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmp, 0755); err != nil {
+		return err
+	}
+	if err := restoreTo(tmp, r); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	// 空のディレクトリは置き換える
+	if err := os.Remove(dir); err != nil && !os.IsNotExist(err) {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(filepath.Clean(dir)))
+}
+
+func restoreTo(dir string, r io.Reader) error {
+	stores := map[uint64]bool{}
+	hasManifest := false
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+
+		// セグメントのストアとマニフェスト以外は展開しない(パスを含む名前も受け付けない)
+		name := hdr.Name
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, storeExt), 10, 64)
+		isStore := err == nil && name == strconv.FormatUint(base, 10)+storeExt
+		if hdr.Typeflag != tar.TypeReg || (name != manifestFile && !isStore) {
+			return fmt.Errorf("%w: unexpected entry %q", ErrInvalidSnapshot, name)
+		}
+		if (isStore && stores[base]) || (!isStore && hasManifest) {
+			return fmt.Errorf("%w: duplicate entry %q", ErrInvalidSnapshot, name)
+		}
+
+		if err := writeFrom(filepath.Join(dir, name), tr); err != nil {
+			return err
+		}
+		if isStore {
+			stores[base] = true
+		} else {
+			hasManifest = true
+		}
+	}
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	if m == nil {
+		return fmt.Errorf("%w: %s is missing", ErrInvalidSnapshot, manifestFile)
+	}
+	if len(m.Segments) != len(stores) {
+		return fmt.Errorf(
+			"%w: %s lists %d segments, archive has %d",
+			ErrInvalidSnapshot, manifestFile, len(m.Segments), len(stores),
+		)
+	}
+
+	var next uint64
+	for i, base := range m.Segments {
+		if !stores[base] {
+			return fmt.Errorf("%w: segment %d is missing", ErrInvalidSnapshot, base)
+		}
+		if i > 0 && base != next {
+			return fmt.Errorf("%w: segment %d does not follow offset %d", ErrInvalidSnapshot, base, next-1)
+		}
+
+		n, err := RebuildIndex(dir, base)
+		if err != nil {
+			return err
+		}
+		problems, err := VerifySegment(dir, base)
+		if err != nil {
+			return err
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("%w: segment %d: %s", ErrInvalidSnapshot, base, problems[0])
+		}
+		next = base + n
+	}
+
+	return syncDir(dir)
+}
+
+func writeFrom(path string, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Replaceで復元する一時ディレクトリの拡張子
+const replaceExt = ".replace"
+
+/*
+空のログ(まだ何も書き込んでいないログ)を、Snapshotで作成したアーカイブの内容に置き換える
+別のノードから移行する時など、開いたままのログにデータを移すために使用する
+① dirとは別の一時ディレクトリにRestoreする 途中で失敗しても、ログはそのまま使える
+② ログを削除し、復元したディレクトリをdirにリネームしてから開き直す
+*/
+func (l *Log) Replace(r io.Reader) error {
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+	if err := l.checkEmpty(); err != nil {
+		return err
+	}
+
+	tmp := filepath.Clean(l.Dir) + replaceExt
+	if err := os.RemoveAll(tmp); err != nil {
+		return err
+	}
+	if err := Restore(tmp, r); err != nil {
+		return err
+	}
+
+	if err := l.Remove(); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, l.Dir); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(filepath.Clean(l.Dir))); err != nil {
+		return err
+	}
+
+	return l.setUp()
+}
+
+// ログにレコードがあればエラーを返す
+func (l *Log) checkEmpty() error {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return ErrNotReady
+	}
+	if len(l.segments) != 1 || l.activeSegment.nextOffset != l.activeSegment.baseOffset {
+		return fmt.Errorf("log: replace %s: log is not empty", l.Dir)
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package log
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	c.Segment.InitialOffset = 10
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	for i := 0; i < 20; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Truncate(12))
+	lowest, err := log.LowestOffset()
+	require.NoError(t, err)
+	highest, err := log.HighestOffset()
+	require.NoError(t, err)
+
+	// 書き出している間(パイプの読み出し側が読み出すのを待っている間)も書き込める
+	pr, pw := io.Pipe()
+	done := make(chan error)
+	go func() {
+		err := log.Snapshot(pw)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	head := make([]byte, 1)
+	_, err = io.ReadFull(pr, head)
+	require.NoError(t, err)
+	after, err := log.Append(&api.Record{Value: []byte("after snapshot")})
+	require.NoError(t, err)
+	rest, err := io.ReadAll(pr)
+	require.NoError(t, err)
+	require.NoError(t, <-done)
+	archive := append(head, rest...)
+
+	dir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(dir, bytes.NewReader(archive)))
+
+	restored, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer restored.Close()
+
+	off, err := restored.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, lowest, off)
+	off, err = restored.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, highest, off)
+	for off := lowest; off <= highest; off++ {
+		want, err := log.Read(off)
+		require.NoError(t, err)
+		got, err := restored.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got), "offset %d: %v != %v", off, got, want)
+	}
+
+	// スナップショットの後に書き込んだレコードは含まれない
+	_, err = restored.Read(after)
+	require.Error(t, err)
+
+	// 復元したログにそのまま書き込める
+	off, err = restored.Append(&api.Record{Value: []byte("restored")})
+	require.NoError(t, err)
+	require.Equal(t, highest+1, off)
+
+	// 空でないディレクトリには復元しない
+	err = Restore(dir, bytes.NewReader(archive))
+	require.Error(t, err)
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	archive := func(files map[string]string) io.Reader {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		for name, body := range files {
+			require.NoError(t, tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Mode:     0600,
+				Size:     int64(len(body)),
+			}))
+			_, err := tw.Write([]byte(body))
+			require.NoError(t, err)
+		}
+		require.NoError(t, tw.Close())
+		return &buf
+	}
+
+	for name, r := range map[string]io.Reader{
+		"path":     archive(map[string]string{"../0.store": ""}),
+		"manifest": archive(map[string]string{"0.store": ""}),
+		"missing": archive(map[string]string{
+			manifestFile: `{"version":1,"segments":[0,3]}`,
+			"0.store":    "",
+		}),
+		"torn": archive(map[string]string{
+			manifestFile: `{"version":1,"segments":[0]}`,
+			"0.store":    "\x00\x00\x00\x00\x00\x00\x00\x09abc",
+		}),
+		"garbage": bytes.NewReader([]byte("not a tar archive")),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "restored")
+			err := Restore(dir, r)
+			require.ErrorIs(t, err, ErrInvalidSnapshot)
+
+			// 失敗しても何も残さない
+			_, err = os.Stat(dir)
+			require.True(t, os.IsNotExist(err))
+			_, err = os.Stat(dir + tmpExt)
+			require.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestReplace(t *testing.T) {
+	c := Config{}
+	c.Segment.MaxStoreBytes = 64
+	src, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer src.Close()
+	for i := 0; i < 10; i++ {
+		_, err := src.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var archive bytes.Buffer
+	require.NoError(t, src.Snapshot(&archive))
+
+	dst, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer dst.Close()
+
+	// 失敗した場合は空のログのまま使える
+	err = dst.Replace(bytes.NewReader([]byte("not a tar archive")))
+	require.ErrorIs(t, err, ErrInvalidSnapshot)
+	_, err = os.Stat(filepath.Clean(dst.Dir) + replaceExt)
+	require.True(t, os.IsNotExist(err))
+	require.NoError(t, dst.Health())
+
+	require.NoError(t, dst.Replace(bytes.NewReader(archive.Bytes())))
+	for off := uint64(0); off < 10; off++ {
+		want, err := src.Read(off)
+		require.NoError(t, err)
+		got, err := dst.Read(off)
+		require.NoError(t, err)
+		require.True(t, proto.Equal(want, got), "offset %d: %v != %v", off, got, want)
+	}
+	off, err := dst.Append(&api.Record{Value: []byte("replaced")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(10), off)
+
+	// 空でないログは置き換えない
+	err = dst.Replace(bytes.NewReader(archive.Bytes()))
+	require.Error(t, err)
+	got, err := dst.Read(10)
+	require.NoError(t, err)
+	require.Equal(t, []byte("replaced"), got.Value)
+}
@@ -4,7 +4,6 @@ package log
 import (
 	"bufio"
 	"encoding/binary"
-	"fmt"
 	"os"
 	"sync"
 )
@@ -24,6 +23,10 @@ type store struct {
 	mu   sync.Mutex
 	buf  *bufio.Writer
 	size uint64
+	// truncateで切り詰めた(invalidateで無効にした)回数 Log.Readerが読み出している間に変わったかを確認する
+	truncated uint64
+	// Config.Tier.Storeに移してファイルを削除した Log.Readerはストアから続きを読み出す
+	evicted bool
 }
 
 // 与えられたファイルに対するstoreを作成する
@@ -44,7 +47,6 @@ func (s *store) Append(p []byte) (n uint64, pos uint64, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	fmt.Println("store write byte", len(p))
 	// レコードを追加前にファイルのサイズを取得することで返り値をポシジョンとして使用できる
 	pos = s.size
 	// len(p)=5の場合、8byte分取るので[0 0 0 0 0 0 0 5]のスライス
@@ -82,6 +84,84 @@ func (s *store) ReadAt(p []byte, offset int64) (int, error) {
 	return s.File.ReadAt(p, offset)
 }
 
+// バッファに溜まっているレコードをファイルに書き出す
+func (s *store) flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.buf.Flush()
+}
+
+// sizeより後ろを切り詰める 以降の書き込みはsizeの位置から続く(O_APPENDで開いている)
+func (s *store) truncate(size uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+	if err := s.File.Truncate(int64(size)); err != nil {
+		return err
+	}
+	s.size = size
+	s.truncated++
+
+	return nil
+}
+
+// 削除するストアを読み出しているReaderが、ErrTruncatedを返すようにする
+func (s *store) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.truncated++
+}
+
+// ファイルを削除するストアを読み出しているReaderが、Config.Tier.Storeから続きを読み出すようにする
+func (s *store) evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.evicted = true
+}
+
+func (s *store) truncations() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.truncated
+}
+
+// ReadAtと同じだが、truncatedの後にストアが切り詰められていた場合はErrTruncatedを返す
+func (s *store) readAtUntruncated(p []byte, offset int64, truncated uint64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.truncated != truncated {
+		return 0, ErrTruncated
+	}
+	if s.evicted {
+		return 0, errEvicted
+	}
+	if err := s.buf.Flush(); err != nil {
+		return 0, err
+	}
+
+	return s.File.ReadAt(p, offset)
+}
+
+// バッファを書き出し、ファイルの内容をストレージに同期する
+func (s *store) sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.buf.Flush(); err != nil {
+		return err
+	}
+
+	return s.File.Sync()
+}
+
 func (s *store) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -0,0 +1,384 @@
+package log
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+/*
+階層化ストレージ
+ディスクの容量を抑えながら古いレコードを残しておくために、書き込みが終わったセグメントをConfig.Tier.Storeに移す
+① Offloadがアクティブセグメント以外のセグメントのストアをアップロードし、マニフェストにアップロード済みとして記録する
+② 最後に書き込まれてからHotWindowが過ぎたアップロード済みのセグメントは、ローカルのファイルを削除する
+③ ファイルを削除したセグメントを読み出す場合は、ストアを取得してインデックスを作り直してから読み出す
+取得したファイルは、HotWindowが過ぎると再び削除される(キャッシュとして扱う)
+インデックスはストアから作り直せるので、アップロードするのはストアだけ
+*/
+
+const defaultTierInterval = time.Minute
+
+/*
+セグメントのストアを保存するオブジェクトストレージなど
+名前は"<ベースオフセット>.store"で、同じ名前で保存し直すと置き換える
+実装はinternal/segstoreを参照
+*/
+type SegmentStore interface {
+	// rからsizeバイトを読み出してnameに保存する
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// nameの内容とそのバイト数を返す ない場合はfs.ErrNotExistをラップしたエラーを返す
+	Get(ctx context.Context, name string) (io.ReadCloser, int64, error)
+	// 保存されている名前を全て返す
+	List(ctx context.Context) ([]string, error)
+	// nameを削除する ない場合もエラーにしない
+	Delete(ctx context.Context, name string) error
+}
+
+// セグメントのストアを保存する名前
+func blobName(baseOffset uint64) string {
+	return strconv.FormatUint(baseOffset, 10) + storeExt
+}
+
+// 移動する候補のセグメント
+type tierCandidate struct {
+	baseOffset uint64
+	path       string
+	// 候補にした時点のストアと切り詰めた回数 アップロードしている間に作り直されたり切り詰められたりしていないかを確認する
+	store     *store
+	truncated uint64
+}
+
+/*
+①と②を一度だけ行う Config.Tier.Intervalごとに自動的に呼び出される
+ネットワークを使う処理はロックを解放してから行うので、その間も書き込みや読み出しは待たされない
+最後に、Truncateが削除しきれずに残ったストアの古いセグメントを削除する
+*/
+func (l *Log) Offload(ctx context.Context) error {
+	store := l.Config.Tier.Store
+	if store == nil {
+		return nil
+	}
+	if l.Config.ReadOnly {
+		return ErrReadOnly
+	}
+
+	upload, evict, err := l.tierCandidates()
+	if err != nil {
+		return err
+	}
+
+	for _, c := range upload {
+		if err := putFile(ctx, store, c.path, blobName(c.baseOffset)); err != nil {
+			return err
+		}
+	}
+	stale, err := l.markUploaded(upload)
+	if err != nil {
+		return err
+	}
+	if err := l.deleteRemote(ctx, stale); err != nil {
+		return err
+	}
+	l.metrics.uploaded.Add(float64(len(upload) - len(stale)))
+
+	for _, c := range evict {
+		fi, err := os.Stat(c.path)
+		if err != nil {
+			return err
+		}
+		if time.Since(fi.ModTime()) < l.Config.Tier.HotWindow {
+			continue
+		}
+		if err := l.evict(c.baseOffset); err != nil {
+			return err
+		}
+	}
+
+	return l.deleteOrphans(ctx)
+}
+
+// アップロードするセグメントと、ローカルのファイルを削除する候補のセグメントを返す
+func (l *Log) tierCandidates() (upload, evict []tierCandidate, err error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if !l.ready {
+		return nil, nil, ErrNotReady
+	}
+
+	// アクティブセグメント(最後のセグメント)はまだ書き込まれるので移さない
+	for _, s := range l.segments[:len(l.segments)-1] {
+		if s.offloaded {
+			continue
+		}
+		c := tierCandidate{
+			baseOffset: s.baseOffset,
+			path:       s.store.Name(),
+			store:      s.store,
+			truncated:  s.store.truncations(),
+		}
+		if s.uploaded {
+			evict = append(evict, c)
+		} else {
+			upload = append(upload, c)
+		}
+	}
+	// アップロードしたセグメントは同じOffloadの中で削除の候補にする
+	evict = append(evict, upload...)
+
+	return upload, evict, nil
+}
+
+/*
+アップロードが完了したセグメントをマニフェストに記録する
+アップロードしている間にTruncateAfterやResetで切り詰められたり作り直されたりしたセグメント、
+アクティブセグメントになったセグメントは、アップロードしたファイルが古いので記録せず、そのベースオフセットを返す
+(呼び出し元がストアから削除する 次のOffloadで改めてアップロードする)
+*/
+func (l *Log) markUploaded(uploaded []tierCandidate) (stale []uint64, err error) {
+	if len(uploaded) == 0 {
+		return nil, nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, c := range uploaded {
+		// アップロードしている間にTruncateで削除されたセグメントは、deleteOrphansがストアから削除する
+		s := l.segmentAt(c.baseOffset)
+		if s == nil || s.uploaded {
+			continue
+		}
+		if s == l.activeSegment || s.store != c.store || s.store.truncations() != c.truncated {
+			stale = append(stale, c.baseOffset)
+			continue
+		}
+		s.uploaded = true
+		s.logger.Info("segment uploaded")
+	}
+
+	return stale, l.writeManifest()
+}
+
+// アップロード済みのセグメントのローカルのファイルを削除する
+func (l *Log) evict(base uint64) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s := l.segmentAt(base)
+	if s == nil || s.offloaded || !s.uploaded {
+		return nil
+	}
+
+	// 読み出し中のLog.Readerが閉じたファイルを読まないように、ファイルを閉じる前に知らせる
+	s.store.evict()
+	if err := s.Remove(); err != nil {
+		return err
+	}
+	s.store, s.index = nil, nil
+	s.offloaded = true
+	l.metrics.offloaded.Inc()
+	s.logger.Info("segment offloaded", zap.Uint64("next_offset", s.nextOffset))
+
+	// マニフェストにはアップロード済みとして記録されているので、書き直す必要はない
+	return nil
+}
+
+/*
+移したセグメントをストアから取得し、ローカルのファイルとして開き直す
+ストアを一時ファイルに書き込んでからリネームし、インデックスを作り直してから、ロックを取得してセグメントを置き換える
+*/
+func (l *Log) fetch(ctx context.Context, base uint64) error {
+	// 同じセグメントを同時に取得しないようにする
+	l.fetchMu.Lock()
+	defer l.fetchMu.Unlock()
+
+	l.mu.RLock()
+	s := l.segmentAt(base)
+	l.mu.RUnlock()
+	if s == nil || !s.offloaded {
+		// 待っている間に他の読み出しが取得したか、Truncateで削除された
+		return nil
+	}
+
+	path := segmentPath(l.Dir, base, storeExt)
+	if err := getFile(ctx, l.Config.Tier.Store, blobName(base), path); err != nil {
+		return err
+	}
+	if _, err := RebuildIndex(l.Dir, base); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	i := l.segmentIndex(base)
+	if i < 0 {
+		// 取得している間にTruncateで削除された
+		os.Remove(path)
+		os.Remove(segmentPath(l.Dir, base, indexExt))
+		return nil
+	}
+
+	fetched, err := newSegment(l.Dir, base, l.Config)
+	if err != nil {
+		return err
+	}
+	if fetched.nextOffset != s.nextOffset {
+		fetched.Close()
+		return fmt.Errorf(
+			"log: segment %d fetched from the segment store ends at offset %d, want %d",
+			base, fetched.nextOffset, s.nextOffset,
+		)
+	}
+	fetched.uploaded = true
+	l.segments[i] = fetched
+	l.metrics.fetched.Inc()
+	fetched.logger.Info("segment fetched")
+
+	return nil
+}
+
+// ストアに残っている、ログの最も古いセグメントより前のセグメントを削除する
+func (l *Log) deleteOrphans(ctx context.Context) error {
+	names, err := l.Config.Tier.Store.List(ctx)
+	if err != nil {
+		return err
+	}
+
+	lowest, err := l.LowestOffset()
+	if err != nil {
+		return err
+	}
+
+	var orphans []uint64
+	for _, name := range names {
+		base, err := strconv.ParseUint(strings.TrimSuffix(name, storeExt), 10, 64)
+		if err != nil || name != blobName(base) {
+			continue
+		}
+		if base < lowest {
+			orphans = append(orphans, base)
+		}
+	}
+
+	return l.deleteRemote(ctx, orphans)
+}
+
+// ストアからセグメントを削除する
+func (l *Log) deleteRemote(ctx context.Context, bases []uint64) error {
+	store := l.Config.Tier.Store
+	if store == nil {
+		return nil
+	}
+
+	for _, base := range bases {
+		if err := store.Delete(ctx, blobName(base)); err != nil {
+			return err
+		}
+		l.Config.logger().Info("remote segment deleted", zap.Uint64("base_offset", base))
+	}
+
+	return nil
+}
+
+// ベースオフセットがbaseのセグメントを返す ロックを取得してから呼び出す
+func (l *Log) segmentAt(base uint64) *segment {
+	if i := l.segmentIndex(base); i >= 0 {
+		return l.segments[i]
+	}
+
+	return nil
+}
+
+func (l *Log) segmentIndex(base uint64) int {
+	for i, s := range l.segments {
+		if s.baseOffset == base {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func putFile(ctx context.Context, store SegmentStore, path, name string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	return store.Put(ctx, name, f, fi.Size())
+}
+
+func getFile(ctx context.Context, store SegmentStore, name, path string) error {
+	rc, size, err := store.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tmp := path + tmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, rc)
+	if err == nil && n != size {
+		err = fmt.Errorf("log: %s: got %d bytes from the segment store, want %d", name, n, size)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// ストアに移したセグメントを、最初に読み出された時に取得して読み出す
+// Config.Tier.Storeに移したためにファイルを削除したストアを、Log.Readerが読み出そうとした
+var errEvicted = errors.New("log: store was moved to the segment store")
+
+type remoteReader struct {
+	store SegmentStore
+	name  string
+	rc    io.ReadCloser
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	if r.rc == nil {
+		rc, _, err := r.store.Get(context.Background(), r.name)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+
+	n, err := r.rc.Read(p)
+	if err == io.EOF {
+		r.rc.Close()
+	}
+
+	return n, err
+}
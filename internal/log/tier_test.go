@@ -0,0 +1,292 @@
+package log
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// テスト用のメモリ上のSegmentStore
+type memStore struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+	gets  int
+	// nilでなければPutで読み出す前に呼び出す
+	beforePut func(name string)
+}
+
+func newMemStore() *memStore {
+	return &memStore{blobs: map[string][]byte{}}
+}
+
+func (m *memStore) Put(_ context.Context, name string, r io.Reader, size int64) error {
+	if m.beforePut != nil {
+		m.beforePut(name)
+	}
+	b, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[name] = b
+	return nil
+}
+
+func (m *memStore) Get(_ context.Context, name string) (io.ReadCloser, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.blobs[name]
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+	}
+	m.gets++
+	return io.NopCloser(bytes.NewReader(b)), int64(len(b)), nil
+}
+
+func (m *memStore) List(context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var names []string
+	for name := range m.blobs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (m *memStore) Delete(_ context.Context, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.blobs, name)
+	return nil
+}
+
+func TestTier(t *testing.T) {
+	dir := t.TempDir()
+	store := newMemStore()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tier.Store = store
+	c.Tier.Interval = time.Hour
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	var want bytes.Buffer
+	_, err = io.Copy(&want, log.Reader())
+	require.NoError(t, err)
+
+	// 読み出している途中でファイルを削除しても、Readerはストアから続きを読み出す
+	reader := log.Reader()
+	head := make([]byte, 10)
+	_, err = io.ReadFull(reader, head)
+	require.NoError(t, err)
+
+	// アクティブセグメント(6)以外をアップロードし、ローカルのファイルを削除する
+	require.NoError(t, log.Offload(context.Background()))
+
+	rest, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), append(head, rest...))
+	store.gets = 0
+
+	names, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store", "2.store", "4.store"}, names)
+	for _, base := range []uint64{0, 2, 4} {
+		_, err := os.Stat(segmentPath(dir, base, storeExt))
+		require.True(t, os.IsNotExist(err))
+	}
+	m, err := readManifest(dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2, 4, 6}, m.Segments)
+	require.Equal(t, []uint64{0, 2, 4}, m.Remote)
+
+	// スナップショットには、移したセグメントをストアから読み出して含める
+	var archive bytes.Buffer
+	require.NoError(t, log.Snapshot(&archive))
+	restoredDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, Restore(restoredDir, &archive))
+	restored, err := NewLog(restoredDir, Config{})
+	require.NoError(t, err)
+	record, err := restored.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, "record 1", string(record.Value))
+	require.NoError(t, restored.Close())
+	require.Equal(t, 3, store.gets)
+	store.gets = 0
+
+	// 移したセグメントのレコードは、取得してから読み出す
+	record, err = log.Read(3)
+	require.NoError(t, err)
+	require.Equal(t, "record 3", string(record.Value))
+	require.Equal(t, 1, store.gets)
+	_, err = os.Stat(segmentPath(dir, 2, indexExt))
+	require.NoError(t, err)
+	_, err = log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, 1, store.gets)
+
+	var got bytes.Buffer
+	_, err = io.Copy(&got, log.Reader())
+	require.NoError(t, err)
+	require.Equal(t, want.Bytes(), got.Bytes())
+
+	// 再起動しても、移したセグメントを読み出せる
+	require.NoError(t, log.Close())
+	log, err = NewLog(dir, c)
+	require.NoError(t, err)
+	for off := uint64(0); off < 7; off++ {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, off, record.Offset)
+	}
+
+	// Truncateはストアからも削除する
+	require.NoError(t, log.Truncate(3))
+	names, err = store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"4.store"}, names)
+	require.NoError(t, log.Offload(context.Background()))
+	require.NoError(t, log.Close())
+
+	// ストアの設定がなければ開かない
+	c.Tier.Store = nil
+	_, err = NewLog(dir, c)
+	require.Error(t, err)
+}
+
+// 移したセグメントの途中で切り詰める場合は、取得してから切り詰め、ストアからは後で改めてアップロードするために削除する
+func TestTierTruncateAfter(t *testing.T) {
+	store := newMemStore()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tier.Store = store
+	c.Tier.Interval = time.Hour
+
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+	require.NoError(t, log.Offload(context.Background()))
+
+	require.NoError(t, log.TruncateAfter(2))
+	require.Equal(t, 1, store.gets)
+	names, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store"}, names)
+	m, err := readManifest(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, m.Segments)
+	require.Equal(t, []uint64{0}, m.Remote)
+
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, "record 2", string(record.Value))
+	_, err = log.Read(3)
+	require.IsType(t, api.ErrOffsetOutOfRange{}, err)
+}
+
+// アップロードしている間に切り詰めたセグメントは、古いファイルをアップロード済みとして記録しない
+func TestTierTruncateDuringUpload(t *testing.T) {
+	store := newMemStore()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	c.Tier.Store = store
+	c.Tier.Interval = time.Hour
+
+	log, err := NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 7; i++ {
+		_, err := log.Append(&api.Record{Value: []byte(fmt.Sprintf("record %d", i))})
+		require.NoError(t, err)
+	}
+
+	// 最後にアップロードするセグメント4を切り詰め、アクティブセグメントにする
+	store.beforePut = func(name string) {
+		if name == "4.store" {
+			require.NoError(t, log.TruncateAfter(4))
+		}
+	}
+	require.NoError(t, log.Offload(context.Background()))
+
+	names, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store", "2.store"}, names)
+	m, err := readManifest(log.Dir)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{0, 2}, m.Remote)
+
+	off, err := log.Append(&api.Record{Value: []byte("record 5 again")})
+	require.NoError(t, err)
+	require.Equal(t, uint64(5), off)
+	for off, want := range map[uint64]string{4: "record 4", 5: "record 5 again"} {
+		record, err := log.Read(off)
+		require.NoError(t, err)
+		require.Equal(t, want, string(record.Value))
+	}
+}
+
+func TestTierHotWindow(t *testing.T) {
+	dir := t.TempDir()
+	store := newMemStore()
+	c := Config{}
+	c.Segment.MaxIndexBytes = entWidth
+	c.Tier.Store = store
+	c.Tier.HotWindow = time.Hour
+
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+	for i := 0; i < 3; i++ {
+		_, err := log.Append(&api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+
+	// アップロードしても、HotWindowが過ぎるまではローカルのファイルを残す
+	require.NoError(t, log.Offload(context.Background()))
+	names, err := store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store", "1.store"}, names)
+	_, err = os.Stat(segmentPath(dir, 0, storeExt))
+	require.NoError(t, err)
+
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(segmentPath(dir, 0, storeExt), old, old))
+	require.NoError(t, log.Offload(context.Background()))
+	_, err = os.Stat(segmentPath(dir, 0, storeExt))
+	require.True(t, os.IsNotExist(err))
+	_, err = os.Stat(filepath.Join(dir, "1.store"))
+	require.NoError(t, err)
+
+	// Truncateが削除しきれなかったストアの古いセグメントを削除する
+	require.NoError(t, log.Truncate(0))
+	require.NoError(t, store.Put(context.Background(), "0.store", bytes.NewReader(nil), 0))
+	require.NoError(t, log.Offload(context.Background()))
+	names, err = store.List(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, []string{"1.store"}, names)
+}
@@ -0,0 +1,79 @@
+package log
+
+import (
+	"context"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/KeisukeYamane/proglog/internal/log"
+
+// レコードのヘッダーにトレースコンテキストを書き込む際の形式(W3C Trace Context)
+var propagator = propagation.TraceContext{}
+
+// nilの場合でもそのまま使えるトレーサーを返す
+func (c Config) tracer() trace.Tracer {
+	if c.TracerProvider == nil {
+		return trace.NewNoopTracerProvider().Tracer(tracerName)
+	}
+
+	return c.TracerProvider.Tracer(tracerName)
+}
+
+/*
+書き込み側のトレースコンテキストをレコードのヘッダー(traceparent)に保持する
+読み出し側はSpanContextFromRecordで取り出し、自身のスパンからリンクできる
+レプリケーションなどで既にヘッダーを持っている場合は、最初の書き込み側を辿れるように上書きしない
+*/
+func InjectTraceContext(ctx context.Context, record *api.Record) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return
+	}
+	if _, ok := record.Headers["traceparent"]; ok {
+		return
+	}
+	if record.Headers == nil {
+		record.Headers = make(map[string]string)
+	}
+
+	propagator.Inject(ctx, propagation.MapCarrier(record.Headers))
+}
+
+// レコードのヘッダーから書き込み側のスパンコンテキストを取り出す 持っていない場合は無効なSpanContextを返す
+func SpanContextFromRecord(record *api.Record) trace.SpanContext {
+	if len(record.Headers) == 0 {
+		return trace.SpanContext{}
+	}
+	ctx := propagator.Extract(context.Background(), propagation.MapCarrier(record.Headers))
+
+	return trace.SpanContextFromContext(ctx)
+}
+
+/*
+ログ内部のスパンは呼び出し元のスパンの子としてのみ作成する
+呼び出し元がトレースしていない読み書き(ConsumeStreamのポーリングなど)で大量のルートスパンが作られないようにするため
+*/
+func startSpan(
+	ctx context.Context,
+	tracer trace.Tracer,
+	name string,
+	opts ...trace.SpanStartOption,
+) (context.Context, trace.Span) {
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		return ctx, trace.SpanFromContext(ctx)
+	}
+
+	return tracer.Start(ctx, name, opts...)
+}
+
+// エラーがあればスパンに記録して終了する
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -0,0 +1,95 @@
+package log
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTrace(t *testing.T) {
+	dir, err := os.MkdirTemp("", "trace-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	c := Config{TracerProvider: tp}
+	c.Segment.MaxIndexBytes = entWidth * 2
+	log, err := NewLog(dir, c)
+	require.NoError(t, err)
+	defer log.Close()
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "produce")
+	// 1セグメントに2レコードまでなので、3レコード目でセグメントが切り替わる
+	for i := 0; i < 3; i++ {
+		_, err := log.AppendContext(ctx, &api.Record{Value: []byte("hello world")})
+		require.NoError(t, err)
+	}
+	parent.End()
+
+	names := map[string]int{}
+	var appendSpan tracetest.SpanStub
+	for _, s := range exporter.GetSpans() {
+		names[s.Name]++
+		require.Equal(t, parent.SpanContext().TraceID(), s.SpanContext.TraceID())
+		if s.Name == "Log.Append" {
+			appendSpan = s
+		}
+	}
+	require.Equal(t, 3, names["Log.Append"])
+	require.Equal(t, 3, names["Log.mu.Lock"])
+	require.Equal(t, 3, names["store.Append"])
+	require.Equal(t, 1, names["Log.newSegment"])
+
+	// 書き込み時のスパンがヘッダーから辿れる
+	record, err := log.Read(2)
+	require.NoError(t, err)
+	require.Equal(t, appendSpan.SpanContext.SpanID(), SpanContextFromRecord(record).SpanID())
+
+	exporter.Reset()
+	ctx, parent = tp.Tracer("test").Start(context.Background(), "consume")
+	_, err = log.ReadContext(ctx, 0)
+	require.NoError(t, err)
+	_, err = log.ReadContext(ctx, 3)
+	require.Error(t, err)
+	parent.End()
+
+	names = map[string]int{}
+	for _, s := range exporter.GetSpans() {
+		names[s.Name]++
+	}
+	require.Equal(t, 2, names["Log.Read"])
+	require.Equal(t, 1, names["store.Read"])
+
+	// 親のスパンがない読み書きではスパンを作らない
+	exporter.Reset()
+	_, err = log.Append(&api.Record{Value: []byte("hello world")})
+	require.NoError(t, err)
+	_, err = log.Read(0)
+	require.NoError(t, err)
+	require.Empty(t, exporter.GetSpans())
+}
+
+func TestInjectTraceContext(t *testing.T) {
+	tp := sdktrace.NewTracerProvider()
+	record := &api.Record{}
+
+	InjectTraceContext(context.Background(), record)
+	require.Nil(t, record.Headers)
+	require.False(t, SpanContextFromRecord(record).IsValid())
+
+	ctx, span := tp.Tracer("test").Start(context.Background(), "first")
+	InjectTraceContext(ctx, record)
+	require.Equal(t, span.SpanContext().TraceID(), SpanContextFromRecord(record).TraceID())
+
+	// 既に持っているトレースコンテキストは上書きしない
+	ctx, _ = tp.Tracer("test").Start(context.Background(), "second")
+	InjectTraceContext(ctx, record)
+	require.Equal(t, span.SpanContext().TraceID(), SpanContextFromRecord(record).TraceID())
+}
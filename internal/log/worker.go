@@ -0,0 +1,63 @@
+package log
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// setUpで開始し、Closeで停止するゴルーチン
+type worker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+}
+
+/*
+intervalごとにfnを呼び出すゴルーチンを開始する
+Closeで停止する際はfnに渡したコンテキストをキャンセルするので、時間のかかる処理(アップロードなど)も途中で止まる
+*/
+func (l *Log) startWorker(name string, interval time.Duration, fn func(context.Context) error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &worker{cancel: cancel, done: make(chan struct{})}
+	l.workers = append(l.workers, w)
+
+	go func() {
+		defer close(w.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		// 同じエラーが続く場合は、間隔ごとに出力しない
+		var last string
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			err := fn(ctx)
+			switch {
+			case err == nil || ctx.Err() != nil:
+				last = ""
+			case err.Error() != last:
+				last = err.Error()
+				l.Config.logger().Warn("background task failed", zap.String("task", name), zap.Error(err))
+			}
+		}
+	}()
+}
+
+// 全てのゴルーチンを停止し、終了するまで待つ 何度呼び出してもよい
+func (l *Log) stopWorkers() {
+	for _, w := range l.workers {
+		w.once.Do(func() {
+			w.cancel()
+			<-w.done
+		})
+	}
+	l.workers = nil
+}
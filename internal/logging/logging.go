@@ -0,0 +1,48 @@
+// サーバーとログで共有する構造化ロガーを作成する
+package logging
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+type Config struct {
+	// debug, info, warn, error のいずれか 空の場合はinfo
+	Level string
+	// trueの場合は人が読みやすいコンソール形式で出力する falseの場合はJSON形式
+	Development bool
+	/*
+		同じレベル・同じメッセージのログを1秒ごとに間引く
+		最初のInitial件を出力し、以降はThereafter件ごとに1件だけ出力する
+		レコードの追加のように書き込みのたびに出力されるログ(ホットパス)がスループットを落とさないようにするため
+		Initialが0の場合はサンプリングしない
+	*/
+	Sampling struct {
+		Initial    int
+		Thereafter int
+	}
+}
+
+func New(c Config) (*zap.Logger, error) {
+	level := zap.NewAtomicLevelAt(zapcore.InfoLevel)
+	if c.Level != "" {
+		if err := level.UnmarshalText([]byte(c.Level)); err != nil {
+			return nil, err
+		}
+	}
+
+	zc := zap.NewProductionConfig()
+	if c.Development {
+		zc = zap.NewDevelopmentConfig()
+	}
+	zc.Level = level
+	zc.Sampling = nil
+	if c.Sampling.Initial > 0 {
+		zc.Sampling = &zap.SamplingConfig{
+			Initial:    c.Sampling.Initial,
+			Thereafter: c.Sampling.Thereafter,
+		}
+	}
+
+	return zc.Build()
+}
@@ -0,0 +1,25 @@
+package logging
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap/zapcore"
+)
+
+func TestNew(t *testing.T) {
+	logger, err := New(Config{})
+	require.NoError(t, err)
+	require.True(t, logger.Core().Enabled(zapcore.InfoLevel))
+	require.False(t, logger.Core().Enabled(zapcore.DebugLevel))
+
+	c := Config{Level: "debug", Development: true}
+	c.Sampling.Initial = 10
+	c.Sampling.Thereafter = 100
+	logger, err = New(c)
+	require.NoError(t, err)
+	require.True(t, logger.Core().Enabled(zapcore.DebugLevel))
+
+	_, err = New(Config{Level: "verbose"})
+	require.Error(t, err)
+}
@@ -0,0 +1,147 @@
+package mirror
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/log"
+)
+
+// ミラーしたレコードの、読み出し元と書き込み先でのオフセット
+type Mapping struct {
+	Source uint64
+	Target uint64
+}
+
+// 1つの対応のサイズ 読み出し元と書き込み先のオフセットを、8バイトずつビッグエンディアンで並べる
+const mappingWidth = 16
+
+// チェックポイントに対応がない場合のエラー
+var ErrNoMapping = errors.New("mirror: no offset mapping in checkpoint")
+
+/*
+ミラーしたレコードのオフセットの対応を、書き込んだ順に保存するログ
+読み出し元と書き込み先のオフセットはどちらも増えていくので、二分探索で対応を探せる
+*/
+type Checkpoint struct {
+	log *log.Log
+}
+
+// dirのログを開く 既にミラーを動かしているディレクトリの場合は、続きから対応を保存する
+func OpenCheckpoint(dir string) (*Checkpoint, error) {
+	c := log.Config{}
+	c.Segment.MaxStoreBytes = 64 << 20
+	c.Segment.MaxIndexBytes = 1 << 20
+	l, err := log.NewLog(dir, c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{log: l}, nil
+}
+
+/*
+ミラーが書き込んでいるdirのログを、対応を調べるために開く AppendはErrReadOnlyを返す
+ミラーは対応をバッファに溜めて書き込むので、最後の方の対応はミラーを停止するまで見えないことがある
+*/
+func OpenCheckpointReadOnly(dir string) (*Checkpoint, error) {
+	l, err := log.OpenReadOnly(dir, log.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Checkpoint{log: l}, nil
+}
+
+func (c *Checkpoint) Append(m Mapping) error {
+	b := make([]byte, mappingWidth)
+	binary.BigEndian.PutUint64(b[:8], m.Source)
+	binary.BigEndian.PutUint64(b[8:], m.Target)
+	_, err := c.log.Append(&api.Record{Value: b})
+
+	return err
+}
+
+// 最後に保存した対応 一つもない場合はokがfalse
+func (c *Checkpoint) Last() (m Mapping, ok bool, err error) {
+	highest, err := c.log.HighestOffset()
+	if err != nil {
+		return Mapping{}, false, err
+	}
+	m, err = c.read(highest)
+	if errors.Is(err, ErrNoMapping) {
+		return Mapping{}, false, nil
+	}
+
+	return m, err == nil, err
+}
+
+/*
+読み出し元でsourceから読み出しを再開する利用者が、書き込み先で読み出しを再開するオフセットを返す
+sourceかそれより後で最初にミラーしたレコードのオフセットで、sourceがミラーした最後のレコードより後の場合は、
+その次のオフセット(次にミラーするレコードを書き込むオフセット)を返す
+書き込み先に他から書き込まれたレコードは、この対応に含まれないので区別しない
+*/
+func (c *Checkpoint) Translate(source uint64) (uint64, error) {
+	lowest, err := c.log.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	highest, err := c.log.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	last, err := c.read(highest)
+	if err != nil {
+		return 0, err
+	}
+	if source > last.Source {
+		return last.Target + 1, nil
+	}
+
+	// source以上になる最初の対応を探す 最後の対応はsource以上なので必ず見つかる
+	lo, hi := lowest, highest
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		m, err := c.read(mid)
+		if err != nil {
+			return 0, err
+		}
+		if m.Source < source {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	m, err := c.read(lo)
+	if err != nil {
+		return 0, err
+	}
+
+	return m.Target, nil
+}
+
+func (c *Checkpoint) read(off uint64) (Mapping, error) {
+	record, err := c.log.Read(off)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return Mapping{}, ErrNoMapping
+	}
+	if err != nil {
+		return Mapping{}, err
+	}
+	if len(record.Value) != mappingWidth {
+		return Mapping{}, fmt.Errorf("mirror: invalid offset mapping at %d (%d bytes)", off, len(record.Value))
+	}
+
+	return Mapping{
+		Source: binary.BigEndian.Uint64(record.Value[:8]),
+		Target: binary.BigEndian.Uint64(record.Value[8:]),
+	}, nil
+}
+
+// バッファをフラッシュしてログを閉じる
+func (c *Checkpoint) Close() error {
+	return c.log.Close()
+}
@@ -0,0 +1,56 @@
+package mirror
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	c, err := OpenCheckpoint(dir)
+	require.NoError(t, err)
+
+	_, ok, err := c.Last()
+	require.NoError(t, err)
+	require.False(t, ok)
+	_, err = c.Translate(0)
+	require.ErrorIs(t, err, ErrNoMapping)
+
+	// 読み出し元の3と6は書き込まなかったレコード
+	mappings := []Mapping{
+		{Source: 1, Target: 10},
+		{Source: 2, Target: 11},
+		{Source: 4, Target: 15},
+		{Source: 5, Target: 16},
+		{Source: 7, Target: 20},
+	}
+	for _, m := range mappings {
+		require.NoError(t, c.Append(m))
+	}
+
+	// 開き直しても続きから保存する
+	require.NoError(t, c.Close())
+	c, err = OpenCheckpoint(dir)
+	require.NoError(t, err)
+	defer c.Close()
+
+	last, ok, err := c.Last()
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, mappings[len(mappings)-1], last)
+
+	for source, want := range map[uint64]uint64{
+		0: 10,
+		1: 10,
+		3: 15,
+		4: 15,
+		6: 20,
+		7: 20,
+		8: 21,
+	} {
+		got, err := c.Translate(source)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "source offset %d", source)
+	}
+}
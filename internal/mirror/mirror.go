@@ -0,0 +1,251 @@
+// あるproglogのクラスタのレコードを、別のクラスタに一方向に複製する(ミラー)
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/loadbalance"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// ミラーしたレコードのヘッダーのキー ミラーの名前と、読み出し元でのオフセットを入れる
+	HeaderName         = "proglog-mirror"
+	HeaderSourceOffset = "proglog-mirror-source-offset"
+)
+
+/*
+読み出し元(Source)のConsumeStreamで読み出したレコードを、書き込み先(Target)にProduceする
+① Filterがfalseを返したレコードは書き込まない
+② 書き込んだレコードごとに、読み出し元と書き込み先のオフセットの対応をCheckpointに保存する
+③ 書き込むレコードのヘッダーに、ミラーの名前と読み出し元でのオフセットを入れる
+異常終了やProduceの応答を受け取れなかった場合は、Checkpointに保存する前に書き込みが終わっていることがある
+そこで読み出しを始める前に、書き込み先の最後に保存した対応より後ろを読み出し、このミラーが書き込んだレコードの対応を
+Checkpointに補ってから、その続きから読み出す これにより同じレコードを二度書き込まず、読み飛ばすこともない
+(書き込みに遅れるノードから読み出すと補えないので、proglog:///で接続したTargetでもプライマリから読み出す)
+④ 接続が切れたりエラーが起きたりした場合は、待ち時間を倍にしながら(最大MaxBackoff)再開する
+Checkpointへの保存に失敗した場合と、最後に保存した対応より後ろが書き込み先から削除されていて補えない場合は、
+続けると対応が欠けるので停止する
+*/
+type Mirror struct {
+	// 読み出し元と書き込み先のクラスタのクライアント
+	Source api.LogClient
+	Target api.LogClient
+	// オフセットの対応の保存先
+	Checkpoint *Checkpoint
+	// ヘッダーに入れるミラーの名前 同じ書き込み先に書き込む複数のミラーを見分ける
+	Name string
+	// trueを返したレコードだけを書き込む nilの場合は全て書き込む
+	Filter func(*api.Record) bool
+	// Checkpointに対応がない(初めて起動した)場合に、読み出し元から読み出し始めるオフセット
+	StartOffset uint64
+	// 再開するまでの最初の待ち時間と最大の待ち時間 0の場合はそれぞれ100ミリ秒と10秒
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+	// 構造化ログの出力先 nilの場合は何も出力しない
+	Logger *zap.Logger
+
+	// 次に読み出す読み出し元のオフセット 書き込まなかったレコードも読み飛ばせるように、Checkpointとは別に持つ
+	next   uint64
+	logger *zap.Logger
+}
+
+// Checkpointへの保存に失敗したことを表す 再開しても対応が欠けるので、Runはこのエラーで停止する
+type checkpointError struct {
+	err error
+}
+
+func (e checkpointError) Error() string {
+	return fmt.Sprintf("mirror: save checkpoint: %v", e.err)
+}
+
+func (e checkpointError) Unwrap() error {
+	return e.err
+}
+
+// Checkpointの最後の対応より後ろが書き込み先から削除されていることを表す Runはこのエラーで停止する
+var errTargetTruncated = errors.New("mirror: target log was truncated past the checkpoint")
+
+// ctxがキャンセルされるまでミラーを続ける キャンセルされた場合はnilを返す
+func (m *Mirror) Run(ctx context.Context) error {
+	if m.Name == "" {
+		return errors.New("mirror: name is required")
+	}
+	if m.MinBackoff == 0 {
+		m.MinBackoff = 100 * time.Millisecond
+	}
+	if m.MaxBackoff == 0 {
+		m.MaxBackoff = 10 * time.Second
+	}
+	m.logger = m.Logger
+	if m.logger == nil {
+		m.logger = zap.NewNop()
+	}
+	m.logger = m.logger.Named("mirror").With(zap.String("name", m.Name))
+	m.next = m.StartOffset
+
+	backoff := m.MinBackoff
+	for {
+		n, err := m.mirror(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		var cerr checkpointError
+		if errors.As(err, &cerr) || errors.Is(err, errTargetTruncated) {
+			return err
+		}
+		// 1件でも書き込めた場合は、接続できていたものとして待ち時間を戻す
+		if n > 0 {
+			backoff = m.MinBackoff
+		}
+		m.logger.Warn("mirror interrupted", zap.Error(err), zap.Duration("backoff", backoff))
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > m.MaxBackoff {
+			backoff = m.MaxBackoff
+		}
+	}
+}
+
+// 書き込み先からCheckpointを補ってから、その続きを読み出して書き込む 書き込んだレコードの数を返す
+func (m *Mirror) mirror(ctx context.Context) (int, error) {
+	if err := m.recover(ctx); err != nil {
+		return 0, err
+	}
+	m.logger.Info("mirroring", zap.Uint64("source_offset", m.next))
+
+	stream, err := m.Source.ConsumeStream(ctx, &api.ConsumeRequest{Offset: m.next})
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for {
+		res, err := stream.Recv()
+		if err != nil {
+			return n, err
+		}
+		record := res.Record
+		if m.Filter != nil && !m.Filter(record) {
+			m.next = record.Offset + 1
+			continue
+		}
+
+		headers := make(map[string]string, len(record.Headers)+2)
+		for k, v := range record.Headers {
+			headers[k] = v
+		}
+		headers[HeaderName] = m.Name
+		headers[HeaderSourceOffset] = strconv.FormatUint(record.Offset, 10)
+		produced, err := m.Target.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: record.Value, Headers: headers},
+		})
+		if err != nil {
+			return n, err
+		}
+		if err := m.Checkpoint.Append(Mapping{Source: record.Offset, Target: produced.Offset}); err != nil {
+			return n, checkpointError{err}
+		}
+		m.next = record.Offset + 1
+		n++
+	}
+}
+
+/*
+書き込み先の、最後に保存した対応より後ろ(対応がない場合は最初)からログの末尾までを読み出し、
+このミラーが書き込んだのにCheckpointに保存していないレコードの対応を保存する
+*/
+func (m *Mirror) recover(ctx context.Context) error {
+	last, ok, err := m.Checkpoint.Last()
+	if err != nil {
+		return checkpointError{err}
+	}
+	var from uint64
+	if ok {
+		from = last.Target + 1
+		if last.Source+1 > m.next {
+			m.next = last.Source + 1
+		}
+	}
+
+	// 書き込んだノード(プライマリ)から読み出す
+	ctx = loadbalance.WithPrimary(ctx)
+	for off := from; ; off++ {
+		res, err := m.Target.Consume(ctx, &api.ConsumeRequest{Offset: off})
+		if isOutOfRange(err) && off == from {
+			lowest, err := m.targetLowestOffset(ctx)
+			if err != nil {
+				return err
+			}
+			if from < lowest {
+				// 最後の対応の後ろがすでに削除されていると、このミラーが書き込んだレコードを補えない
+				// 読み出し元のどこから再開すべきか分からないので、推測せずに停止する
+				if ok {
+					return fmt.Errorf(
+						"%w: checkpoint ends at target offset %d but the lowest offset is %d",
+						errTargetTruncated, last.Target, lowest,
+					)
+				}
+				// 初めて起動した場合は、残っているレコードから補う
+				from, off = lowest, lowest-1
+				continue
+			}
+		}
+		if isOutOfRange(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		headers := res.Record.Headers
+		if headers[HeaderName] != m.Name {
+			continue
+		}
+		source, err := strconv.ParseUint(headers[HeaderSourceOffset], 10, 64)
+		if err != nil {
+			return fmt.Errorf("mirror: invalid %s header at target offset %d: %w", HeaderSourceOffset, off, err)
+		}
+		// 前回までに対応を保存したレコード(再び読み出した古いレコード)は除く
+		if ok && source <= last.Source {
+			continue
+		}
+
+		if err := m.Checkpoint.Append(Mapping{Source: source, Target: off}); err != nil {
+			return checkpointError{err}
+		}
+		m.logger.Info("recovered offset mapping", zap.Uint64("source_offset", source), zap.Uint64("target_offset", off))
+		last, ok = Mapping{Source: source, Target: off}, true
+		if source+1 > m.next {
+			m.next = source + 1
+		}
+	}
+}
+
+// 書き込み先(プライマリ)のログのLowestOffset
+func (m *Mirror) targetLowestOffset(ctx context.Context) (uint64, error) {
+	res, err := m.Target.GetServers(ctx, &api.GetServersRequest{Local: true})
+	if err != nil {
+		return 0, err
+	}
+	if len(res.Servers) == 0 {
+		return 0, errors.New("mirror: target returned no servers")
+	}
+
+	return res.Servers[0].LowestOffset, nil
+}
+
+// ログの範囲外のオフセットを読み出そうとした場合のエラーか
+func isOutOfRange(err error) bool {
+	return status.Code(err) == api.ErrOffsetOutOfRange{}.GRPCStatus().Code()
+}
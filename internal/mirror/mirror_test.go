@@ -0,0 +1,391 @@
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/loadbalance"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/KeisukeYamane/proglog/internal/server"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// ログを開いてサーバーを起動し、そのログとクライアントを返す
+func setupCluster(t *testing.T) (*log.Log, api.LogClient) {
+	t.Helper()
+
+	return setupClusterConfig(t, log.Config{})
+}
+
+func setupClusterConfig(t *testing.T, c log.Config) (*log.Log, api.LogClient) {
+	t.Helper()
+
+	clog, err := log.NewLog(t.TempDir(), c)
+	require.NoError(t, err)
+	t.Cleanup(func() { clog.Close() })
+
+	gsrv, err := server.NewGRPCServer(&server.Config{CommitLog: clog})
+	require.NoError(t, err)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go gsrv.Serve(l)
+	t.Cleanup(gsrv.Stop)
+
+	cc, err := grpc.Dial(l.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+
+	return clog, api.NewLogClient(cc)
+}
+
+/*
+プライマリとセカンダリの2台のクラスタを起動し、プライマリのログとproglog:///で接続したクライアントを返す
+セカンダリはプライマリとは別のログを持ち、書き込みを拒否する
+*/
+func setupPrimaryCluster(t *testing.T) (*log.Log, api.LogClient) {
+	t.Helper()
+
+	var listeners []net.Listener
+	servers := &server.StaticServers{
+		DialOptions: []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())},
+	}
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		listeners = append(listeners, l)
+		servers.Servers = append(servers.Servers, server.StaticServer{
+			ID:      fmt.Sprintf("node-%d", i),
+			RPCAddr: l.Addr().String(),
+		})
+	}
+
+	var logs []*log.Log
+	for _, l := range listeners {
+		clog, err := log.NewLog(t.TempDir(), log.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { clog.Close() })
+		logs = append(logs, clog)
+
+		gsrv, err := server.NewGRPCServer(&server.Config{
+			CommitLog: clog,
+			Primary:   server.NewPrimary(l.Addr().String(), listeners[0].Addr().String(), server.RedirectWrites),
+			Servers:   servers,
+		})
+		require.NoError(t, err)
+		go gsrv.Serve(l)
+		t.Cleanup(gsrv.Stop)
+	}
+
+	cc, err := grpc.Dial(
+		fmt.Sprintf("%s:///%s", loadbalance.Name, listeners[1].Addr().String()),
+		grpc.WithResolvers(&loadbalance.Builder{}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+
+	return logs[0], api.NewLogClient(cc)
+}
+
+func appendValues(t *testing.T, l *log.Log, values ...string) {
+	t.Helper()
+
+	for _, v := range values {
+		_, err := l.Append(&api.Record{Value: []byte(v)})
+		require.NoError(t, err)
+	}
+}
+
+// ログの全てのレコード
+func readRecords(t *testing.T, l *log.Log) []*api.Record {
+	t.Helper()
+
+	var records []*api.Record
+	for off := uint64(0); ; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return records
+		}
+		require.NoError(t, err)
+		records = append(records, record)
+	}
+}
+
+func values(records []*api.Record) []string {
+	var values []string
+	for _, r := range records {
+		values = append(values, string(r.Value))
+	}
+	return values
+}
+
+// 値がskipで始まるレコードは書き込まない
+func skipFilter(record *api.Record) bool {
+	return !strings.HasPrefix(string(record.Value), "skip")
+}
+
+// mを起動し、止めるための関数を返す 止めるとRunの結果を返す
+func start(m *Mirror) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- m.Run(ctx)
+	}()
+
+	return func() error {
+		cancel()
+		return <-errc
+	}
+}
+
+func waitValues(t *testing.T, l *log.Log, want ...string) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return len(readRecords(t, l)) >= len(want)
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Equal(t, want, values(readRecords(t, l)))
+}
+
+// レコードを書き込んでからCheckpointに保存するので、書き込み先のレコードとは別に待つ
+func waitCheckpoint(t *testing.T, c *Checkpoint, want Mapping) {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		last, _, err := c.Last()
+		return err == nil && last == want
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestMirror(t *testing.T) {
+	sourceLog, source := setupCluster(t)
+	targetLog, target := setupCluster(t)
+	// 書き込み先には他のレコードもある
+	appendValues(t, targetLog, "local")
+	appendValues(t, sourceLog, "first", "skip", "second")
+
+	checkpoint, err := OpenCheckpoint(t.TempDir())
+	require.NoError(t, err)
+	defer checkpoint.Close()
+
+	stop := start(&Mirror{
+		Source:     source,
+		Target:     target,
+		Checkpoint: checkpoint,
+		Name:       "us-to-eu",
+		Filter:     skipFilter,
+	})
+	waitValues(t, targetLog, "local", "first", "second")
+
+	// 読み出し元に書き込まれたレコードを続けてミラーする
+	appendValues(t, sourceLog, "skip again", "third")
+	waitValues(t, targetLog, "local", "first", "second", "third")
+	waitCheckpoint(t, checkpoint, Mapping{Source: 4, Target: 3})
+	require.NoError(t, stop())
+
+	records := readRecords(t, targetLog)
+	require.Equal(t, "us-to-eu", records[1].Headers[HeaderName])
+	require.Equal(t, "2", records[2].Headers[HeaderSourceOffset])
+	require.Empty(t, records[0].Headers)
+
+	for source, want := range map[uint64]uint64{0: 1, 1: 2, 2: 2, 3: 3, 5: 4} {
+		got, err := checkpoint.Translate(source)
+		require.NoError(t, err)
+		require.Equal(t, want, got, "source offset %d", source)
+	}
+}
+
+/*
+Produceが書き込み先に届いてから、Checkpointに保存するまでの間に停止した場合を再現する
+crashAtの回数目のProduceは、書き込んだ後にミラーを止めてエラーを返す
+*/
+type crashingTarget struct {
+	api.LogClient
+
+	crashAt int
+	crash   func()
+	n       int
+}
+
+func (c *crashingTarget) Produce(
+	ctx context.Context,
+	req *api.ProduceRequest,
+	opts ...grpc.CallOption,
+) (*api.ProduceResponse, error) {
+	res, err := c.LogClient.Produce(ctx, req, opts...)
+	if c.n++; c.n == c.crashAt {
+		c.crash()
+		return nil, errors.New("crashed")
+	}
+
+	return res, err
+}
+
+// 異常終了しても、同じレコードを二度書き込まずに続きからミラーする
+func TestMirrorResumeAfterCrash(t *testing.T) {
+	sourceLog, source := setupCluster(t)
+	targetLog, target := setupCluster(t)
+	var want []string
+	for i := 0; i < 5; i++ {
+		v := fmt.Sprintf("record %d", i)
+		appendValues(t, sourceLog, v)
+		want = append(want, v)
+	}
+
+	dir := t.TempDir()
+	checkpoint, err := OpenCheckpoint(dir)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Mirror{
+		Source:     source,
+		Target:     &crashingTarget{LogClient: target, crashAt: 3, crash: cancel},
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+	}
+	require.NoError(t, m.Run(ctx))
+	require.Equal(t, want[:3], values(readRecords(t, targetLog)))
+	// 3件目の対応は保存されていない
+	last, _, err := checkpoint.Last()
+	require.NoError(t, err)
+	require.Equal(t, Mapping{Source: 1, Target: 1}, last)
+	require.NoError(t, checkpoint.Close())
+
+	checkpoint, err = OpenCheckpoint(dir)
+	require.NoError(t, err)
+	defer checkpoint.Close()
+	stop := start(&Mirror{
+		Source:     source,
+		Target:     target,
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+	})
+	waitValues(t, targetLog, want...)
+	waitCheckpoint(t, checkpoint, Mapping{Source: 4, Target: 4})
+	require.NoError(t, stop())
+
+	for i := uint64(0); i < 5; i++ {
+		got, err := checkpoint.Translate(i)
+		require.NoError(t, err)
+		require.Equal(t, i, got)
+	}
+}
+
+// Produceの応答を受け取れずに再開しても、同じレコードを二度書き込まない
+func TestMirrorRetryLostResponse(t *testing.T) {
+	sourceLog, source := setupCluster(t)
+	targetLog, target := setupCluster(t)
+	appendValues(t, sourceLog, "first", "second", "third")
+
+	checkpoint, err := OpenCheckpoint(t.TempDir())
+	require.NoError(t, err)
+	defer checkpoint.Close()
+
+	stop := start(&Mirror{
+		Source:     source,
+		Target:     &crashingTarget{LogClient: target, crashAt: 2, crash: func() {}},
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+		MinBackoff: 10 * time.Millisecond,
+	})
+	waitValues(t, targetLog, "first", "second", "third")
+	waitCheckpoint(t, checkpoint, Mapping{Source: 2, Target: 2})
+	require.NoError(t, stop())
+}
+
+// proglog:///で接続した書き込み先でも、書き込んだプライマリから対応を補う
+func TestMirrorRecoverFromPrimary(t *testing.T) {
+	sourceLog, source := setupCluster(t)
+	targetLog, target := setupPrimaryCluster(t)
+	appendValues(t, sourceLog, "first", "second")
+	// 1件目を書き込んだ後、Checkpointに保存する前に停止した
+	_, err := targetLog.Append(&api.Record{
+		Value:   []byte("first"),
+		Headers: map[string]string{HeaderName: "mirror", HeaderSourceOffset: "0"},
+	})
+	require.NoError(t, err)
+
+	// セカンダリに接続するまで待つ 以降の読み出しはセカンダリに送られる
+	require.Eventually(t, func() bool {
+		_, err := target.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+		return isOutOfRange(err)
+	}, 3*time.Second, 10*time.Millisecond)
+
+	checkpoint, err := OpenCheckpoint(t.TempDir())
+	require.NoError(t, err)
+	defer checkpoint.Close()
+	stop := start(&Mirror{
+		Source:     source,
+		Target:     target,
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+	})
+	waitCheckpoint(t, checkpoint, Mapping{Source: 1, Target: 1})
+	require.NoError(t, stop())
+	require.Equal(t, []string{"first", "second"}, values(readRecords(t, targetLog)))
+}
+
+// 最後の対応より後ろが書き込み先から削除されている場合は、読み出し元のどこから再開するか推測せずに停止する
+func TestMirrorTargetTruncated(t *testing.T) {
+	sourceLog, source := setupCluster(t)
+	// 1つのセグメントに1件だけ書き込み、Truncateで先頭のレコードを削除できるようにする
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 12
+	targetLog, target := setupClusterConfig(t, c)
+	appendValues(t, sourceLog, "first", "second", "third", "fourth")
+	for i, v := range []string{"first", "second", "third"} {
+		_, err := targetLog.Append(&api.Record{
+			Value:   []byte(v),
+			Headers: map[string]string{HeaderName: "mirror", HeaderSourceOffset: fmt.Sprint(i)},
+		})
+		require.NoError(t, err)
+	}
+	require.NoError(t, targetLog.Truncate(1))
+	lowest, err := targetLog.LowestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), lowest)
+
+	// 1件目までしか保存していないので、2件目の対応が分からない
+	checkpoint, err := OpenCheckpoint(t.TempDir())
+	require.NoError(t, err)
+	defer checkpoint.Close()
+	require.NoError(t, checkpoint.Append(Mapping{Source: 0, Target: 0}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = (&Mirror{
+		Source:     source,
+		Target:     target,
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+	}).Run(ctx)
+	require.ErrorIs(t, err, errTargetTruncated)
+	require.NoError(t, ctx.Err())
+	last, _, err := checkpoint.Last()
+	require.NoError(t, err)
+	require.Equal(t, Mapping{Source: 0, Target: 0}, last)
+
+	// Checkpointがない場合は、残っているレコードから対応を補って続きを書き込む
+	checkpoint, err = OpenCheckpoint(t.TempDir())
+	require.NoError(t, err)
+	defer checkpoint.Close()
+	stop := start(&Mirror{
+		Source:     source,
+		Target:     target,
+		Checkpoint: checkpoint,
+		Name:       "mirror",
+	})
+	waitCheckpoint(t, checkpoint, Mapping{Source: 3, Target: 3})
+	require.NoError(t, stop())
+	got, err := checkpoint.Translate(2)
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), got)
+}
@@ -0,0 +1,130 @@
+// ログのセグメントを移す先(log.SegmentStore)の実装 ローカルのファイルシステムとS3互換のオブジェクトストレージを提供する
+package segstore
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/KeisukeYamane/proglog/internal/log"
+)
+
+var _ log.SegmentStore = (*Local)(nil)
+
+/*
+ディレクトリにセグメントを保存する
+ネットワーク越しにマウントした大容量のディスク(NFSなど)に移す場合に使う
+書き込みは一時ファイルに書き込んでからリネームするので、書き込み途中の内容を読み出すことはない
+*/
+type Local struct {
+	dir string
+}
+
+const localTmpExt = ".tmp"
+
+func NewLocal(dir string) (*Local, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Local{dir: dir}, nil
+}
+
+func (l *Local) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + localTmpExt
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, io.LimitReader(r, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("segstore: %s: read %d bytes, want %d", name, n, size)
+	}
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) Get(_ context.Context, name string) (io.ReadCloser, int64, error) {
+	path, err := l.path(name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// ファイルがない場合のos.Openのエラーはfs.ErrNotExistをラップしている
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+
+	return f, fi.Size(), nil
+}
+
+func (l *Local) List(context.Context) ([]string, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, e := range entries {
+		if e.IsDir() || strings.HasSuffix(e.Name(), localTmpExt) {
+			continue
+		}
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (l *Local) Delete(_ context.Context, name string) error {
+	path, err := l.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// ディレクトリの外を指す名前は受け付けない
+func (l *Local) path(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("segstore: invalid name %q: %w", name, fs.ErrInvalid)
+	}
+
+	return filepath.Join(l.dir, name), nil
+}
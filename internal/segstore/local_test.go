@@ -0,0 +1,75 @@
+package segstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+)
+
+// log.SegmentStoreの実装が満たすべき振る舞い
+func testSegmentStore(t *testing.T, s log.SegmentStore) {
+	ctx := context.Background()
+
+	names, err := s.List(ctx)
+	require.NoError(t, err)
+	require.Empty(t, names)
+
+	_, _, err = s.Get(ctx, "0.store")
+	require.ErrorIs(t, err, fs.ErrNotExist)
+
+	for _, name := range []string{"2.store", "0.store", "4.store", "6.store"} {
+		body := "segment " + name
+		require.NoError(t, s.Put(ctx, name, strings.NewReader(body), int64(len(body))))
+	}
+	// 同じ名前は置き換える 空の内容も保存できる
+	require.NoError(t, s.Put(ctx, "2.store", strings.NewReader("replaced"), 8))
+	require.NoError(t, s.Put(ctx, "8.store", bytes.NewReader(nil), 0))
+
+	rc, size, err := s.Get(ctx, "2.store")
+	require.NoError(t, err)
+	b, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	require.NoError(t, rc.Close())
+	require.Equal(t, "replaced", string(b))
+	require.Equal(t, int64(8), size)
+
+	rc, size, err = s.Get(ctx, "8.store")
+	require.NoError(t, err)
+	rc.Close()
+	require.Equal(t, int64(0), size)
+
+	require.NoError(t, s.Delete(ctx, "4.store"))
+	require.NoError(t, s.Delete(ctx, "4.store"))
+
+	names, err = s.List(ctx)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0.store", "2.store", "6.store", "8.store"}, names)
+}
+
+func TestLocal(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "segments")
+	s, err := NewLocal(dir)
+	require.NoError(t, err)
+
+	testSegmentStore(t, s)
+
+	// 書き込みに失敗しても一時ファイルや途中までの内容を残さない
+	err = s.Put(context.Background(), "10.store", strings.NewReader("short"), 10)
+	require.Error(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Len(t, entries, 4)
+
+	// ディレクトリの外は指せない
+	for _, name := range []string{"../x.store", "", ".."} {
+		require.ErrorIs(t, s.Put(context.Background(), name, strings.NewReader(""), 0), fs.ErrInvalid)
+	}
+}
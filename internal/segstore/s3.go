@@ -0,0 +1,308 @@
+package segstore
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/KeisukeYamane/proglog/internal/log"
+)
+
+var _ log.SegmentStore = (*S3)(nil)
+
+type S3Config struct {
+	// "https://s3.ap-northeast-1.amazonaws.com"や"http://localhost:9000"など バケットはパスで指定する(パス形式)ので、
+	// MinIOなどのS3互換のストレージにもそのまま使える
+	Endpoint string
+	Bucket   string
+	// キーの先頭に付ける文字列 同じバケットに複数のログを保存する場合に使う("proglog/node-1/"など)
+	Prefix string
+	// 空の場合はus-east-1
+	Region string
+	// 空の場合はリクエストに署名しない(匿名アクセス)
+	AccessKeyID     string
+	SecretAccessKey string
+	// nilの場合はhttp.DefaultClientを使う
+	Client *http.Client
+}
+
+/*
+S3互換のオブジェクトストレージにセグメントを保存する
+SDKに依存しないように、必要な4つのAPI(PutObject、GetObject、ListObjectsV2、DeleteObject)だけを
+net/httpと署名バージョン4で呼び出す ペイロードには署名しない(UNSIGNED-PAYLOAD)ので、エンドポイントにはHTTPSを使うこと
+*/
+type S3 struct {
+	c        S3Config
+	endpoint *url.URL
+	client   *http.Client
+	// テストで署名の時刻を固定するために差し替える
+	now func() time.Time
+}
+
+func NewS3(c S3Config) (*S3, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("segstore: invalid endpoint %q: %w", c.Endpoint, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("segstore: invalid endpoint %q: want http(s)://host[:port]", c.Endpoint)
+	}
+	if c.Bucket == "" {
+		return nil, errors.New("segstore: bucket is required")
+	}
+	if (c.AccessKeyID == "") != (c.SecretAccessKey == "") {
+		return nil, errors.New("segstore: access key id and secret access key must be set together")
+	}
+	if c.Region == "" {
+		c.Region = "us-east-1"
+	}
+
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &S3{c: c, endpoint: u, client: client, now: time.Now}, nil
+}
+
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	var body io.Reader = http.NoBody
+	if size > 0 {
+		body = io.LimitReader(r, size)
+	}
+	resp, err := s.do(ctx, http.MethodPut, s.c.Prefix+name, nil, body, size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	resp, err := s.do(ctx, http.MethodGet, s.c.Prefix+name, nil, nil, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (s *S3) List(ctx context.Context) ([]string, error) {
+	var (
+		names []string
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.c.Prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.do(ctx, http.MethodGet, "", q, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			IsTruncated           bool
+			NextContinuationToken string
+			Contents              []struct {
+				Key string
+			}
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("segstore: s3 list %s: %w", s.c.Bucket, err)
+		}
+
+		for _, c := range result.Contents {
+			names = append(names, strings.TrimPrefix(c.Key, s.c.Prefix))
+		}
+		if !result.IsTruncated {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	sort.Strings(names)
+
+	return names, nil
+}
+
+func (s *S3) Delete(ctx context.Context, name string) error {
+	resp, err := s.do(ctx, http.MethodDelete, s.c.Prefix+name, nil, nil, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+/*
+バケット内のkeyにリクエストを送る keyが空の場合はバケット自体に送る
+2xx以外のレスポンスはエラーにする 404の場合はfs.ErrNotExistをラップする
+*/
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	u := *s.endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/" + s.c.Bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u.Path, u.RawPath = path, uriEncode(path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if s.c.AccessKeyID != "" {
+		signV4(req, unsignedPayload, s.c.AccessKeyID, s.c.SecretAccessKey, s.c.Region, s.now())
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var e struct {
+		Code    string
+		Message string
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&e)
+	err = fmt.Errorf("segstore: s3 %s %s: %s %s %s", method, path, resp.Status, e.Code, e.Message)
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+
+	return nil, err
+}
+
+const (
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+	amzDateFormat   = "20060102T150405Z"
+)
+
+/*
+署名バージョン4でリクエストに署名する
+① 正規リクエスト(メソッド、パス、クエリ、署名するヘッダー、ペイロードのハッシュ)を作る
+② 日付・リージョン・サービスのスコープと正規リクエストのハッシュから署名する文字列を作る
+③ シークレットキーから日付・リージョン・サービスの順にHMACで導出した鍵で署名する
+ヘッダーはHostと、この時点でreqに設定されている全てのヘッダーに署名する
+*/
+func signV4(req *http.Request, payloadHash, accessKeyID, secret, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secret), date)
+	for _, v := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, v)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// キーでソートし、署名バージョン4の規則でエンコードしたクエリ文字列
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), q[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// 英数字と-_.~以外をパーセントエンコードする encodeSlashがfalseの場合は/をそのまま残す
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Watchで状態の変化を確認する間隔
+const healthCheckInterval = time.Second
+
+// ヘルスチェックに対応したCommitLog internal/logのLogはsetUpが完了してから書き込めなくなるまでの間nilを返す
+type healthCommitLog interface {
+	Health() error
+}
+
+/*
+grpc.health.v1.Healthの実装
+問い合わせの度にCommitLogの状態を確認し、読み書きできる場合のみSERVINGを返す
+CommitLogがヘルスチェックに対応していない場合は常にSERVINGを返す
+*/
+type healthServer struct {
+	*health.Server
+	log CommitLog
+}
+
+func newHealthServer(log CommitLog) *healthServer {
+	h := &healthServer{
+		Server: health.NewServer(),
+		log:    log,
+	}
+	h.update()
+
+	return h
+}
+
+// CommitLogの状態をサービス全体("")とログサービスの状態に反映する
+// Shutdownの後はhealth.Serverが更新を無視するので、NOT_SERVINGのままになる
+func (h *healthServer) update() {
+	status := healthpb.HealthCheckResponse_SERVING
+	if hl, ok := h.log.(healthCommitLog); ok && hl.Health() != nil {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+
+	h.SetServingStatus("", status)
+	h.SetServingStatus(api.Log_ServiceDesc.ServiceName, status)
+}
+
+func (h *healthServer) Check(
+	ctx context.Context,
+	req *healthpb.HealthCheckRequest,
+) (*healthpb.HealthCheckResponse, error) {
+	h.update()
+
+	return h.Server.Check(ctx, req)
+}
+
+// ストリームが開いている間だけ定期的に状態を確認し、変化があればhealth.Serverが通知する
+func (h *healthServer) Watch(
+	req *healthpb.HealthCheckRequest,
+	stream healthpb.Health_WatchServer,
+) error {
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+
+	h.update()
+	go func() {
+		ticker := time.NewTicker(healthCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				h.update()
+			}
+		}
+	}()
+
+	return h.Server.Watch(req, stream)
+}
+
+// ロードバランサーがトークンを持たずに問い合わせられるように、ヘルスチェックは認証しない
+func (h *healthServer) AuthFuncOverride(ctx context.Context, fullMethodName string) (context.Context, error) {
+	return ctx, nil
+}
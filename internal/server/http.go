@@ -1,20 +1,74 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
 	"net/http"
+	"strings"
 
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/auth"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// 書き込みを拒否した時に、プライマリのアドレスを入れるレスポンスヘッダー(PrimaryMetadataKeyと同じ)
+const PrimaryHeader = "Proglog-Primary"
+
 type httpServer struct {
-	Log *Log
+	Log httpLog
+	// nilでなければ書き込みはLogではなくこちらで行う
+	producer Producer
+}
+
+// gRPCのProduceの実装 Server.Producerが返す
+type Producer interface {
+	Produce(context.Context, *api.ProduceRequest) (*api.ProduceResponse, error)
 }
 
-func newHTTPServer() *httpServer {
+// HTTPのハンドラーが読み書きするログ
+type httpLog interface {
+	Append(Record) (uint64, error)
+	Read(uint64) (Record, error)
+}
+
+// CommitLogがnilの場合はメモリ上のLogを使用する
+func newHTTPServer(clog CommitLog) *httpServer {
+	if clog == nil {
+		return &httpServer{
+			Log: NewLog(),
+		}
+	}
+
 	return &httpServer{
-		Log: NewLog(),
+		Log: &commitLogAdapter{clog},
+	}
+}
+
+// gRPCサーバーと同じCommitLogをHTTPのハンドラーから読み書きできるようにする
+type commitLogAdapter struct {
+	CommitLog
+}
+
+func (a *commitLogAdapter) Append(record Record) (uint64, error) {
+	return a.CommitLog.Append(&api.Record{Value: record.Value})
+}
+
+func (a *commitLogAdapter) Read(offset uint64) (Record, error) {
+	record, err := a.CommitLog.Read(offset)
+	if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+		return Record{}, ErrOffsetNotFound
+	}
+	if err != nil {
+		return Record{}, err
 	}
+
+	return Record{Value: record.Value, Offset: record.Offset}, nil
 }
 
 type ProduceRequest struct {
@@ -49,9 +103,9 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	off, err := s.Log.Append(req.Record)
+	off, err := s.append(w, r, req.Record)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		http.Error(w, err.Error(), httpStatus(err))
 		return
 	}
 
@@ -63,6 +117,71 @@ func (s *httpServer) handleProduce(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+/*
+Producerがある場合は、gRPCのProduceと同じく、セカンダリならプライマリに転送するか拒否し、移行している間は拒否する
+転送する時にトークンを引き継げるように、AuthorizationヘッダーをgRPCのメタデータとして渡す
+拒否された場合は、プライマリのアドレスをPrimaryHeaderで返す
+*/
+func (s *httpServer) append(w http.ResponseWriter, r *http.Request, record Record) (uint64, error) {
+	if s.producer == nil {
+		return s.Log.Append(record)
+	}
+
+	md := metadata.MD{}
+	if authz := r.Header.Get("Authorization"); authz != "" {
+		md.Set("authorization", authz)
+	}
+	stream := &httpTransportStream{}
+	ctx := grpc.NewContextWithServerTransportStream(metadata.NewIncomingContext(r.Context(), md), stream)
+	res, err := s.producer.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: record.Value}})
+	if addr := stream.trailer.Get(PrimaryMetadataKey); len(addr) > 0 {
+		w.Header().Set(PrimaryHeader, addr[0])
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return res.Offset, nil
+}
+
+// Produceが返したgRPCのステータスに対応するHTTPのステータス
+func httpStatus(err error) int {
+	switch status.Code(err) {
+	case codes.InvalidArgument:
+		return http.StatusBadRequest
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+
+	return http.StatusInternalServerError
+}
+
+// Produceがgrpc.SetTrailerで設定したトレーラーを受け取る
+type httpTransportStream struct {
+	trailer metadata.MD
+}
+
+func (s *httpTransportStream) Method() string {
+	return "/log.v1.Log/Produce"
+}
+
+func (s *httpTransportStream) SetHeader(md metadata.MD) error {
+	return nil
+}
+
+func (s *httpTransportStream) SendHeader(md metadata.MD) error {
+	return nil
+}
+
+func (s *httpTransportStream) SetTrailer(md metadata.MD) error {
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
 /**
 * ① リクエストを構造体へデコーディングする
 * ② ①の構造体を使い該当のoffsetに位置するレコードを取得する
@@ -96,15 +215,60 @@ func (s *httpServer) handleConsume(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func NewHTTPServer(addr string) *http.Server {
-	httpsrv := newHTTPServer()
+type HTTPConfig struct {
+	// gRPCサーバーと共有するログ nilの場合はメモリ上のLogを使用する
+	CommitLog CommitLog
+	// nilの場合は認証を行わない
+	Authenticator Authenticator
+	// nilでなければ/metricsでメトリクスを公開する スクレイパーのために認証はかけない
+	Gatherer prometheus.Gatherer
+	// nilでなければ書き込みをgRPCのProduceと同じ処理で行う(プライマリへの転送や移行中の拒否)
+	// gRPCサーバーと同じノードで公開する場合はServer.Producerを渡す
+	Producer Producer
+}
+
+func NewHTTPServer(addr string, config *HTTPConfig) *http.Server {
+	httpsrv := newHTTPServer(config.CommitLog)
+	httpsrv.producer = config.Producer
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", httpsrv.handleProduce).Methods(http.MethodPost) // ログの書き込み
 	r.HandleFunc("/", httpsrv.handleConsume).Methods(http.MethodGet)  // ログの読み出し
 
+	var h http.Handler = r
+	if config.Authenticator != nil {
+		h = authenticateHTTP(config.Authenticator, h)
+	}
+
+	if config.Gatherer != nil {
+		m := http.NewServeMux()
+		m.Handle("/metrics", promhttp.HandlerFor(config.Gatherer, promhttp.HandlerOpts{}))
+		m.Handle("/", h)
+		h = m
+	}
+
 	return &http.Server{
 		Addr:    addr,
-		Handler: r,
+		Handler: h,
 	}
 }
+
+// Authorizationヘッダーの「Bearer <token>」を検証し、サブジェクトをリクエストのコンテキストに保持する
+func authenticateHTTP(a Authenticator, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		parts := strings.SplitN(r.Header.Get("Authorization"), " ", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], "bearer") {
+			token = strings.TrimSpace(parts[1])
+		}
+
+		subject, err := a.Authenticate(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), subject)))
+	})
+}
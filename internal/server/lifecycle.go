@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// DrainTimeoutが指定されていない場合に、処理中のRPCの完了を待つ時間
+const defaultDrainTimeout = 10 * time.Second
+
+/*
+gRPCサーバーとHTTPサーバーの起動から停止までを管理する
+停止する際は次の順に後始末を行う
+① ヘルスチェックをNOT_SERVINGにし、ロードバランサーが新たなリクエストを振り分けないようにする
+② 開いているConsumeStreamをUnavailableのステータスで終了する
+③ 新たな接続とRPCの受け付けを止め、処理中のProduceなどが終わるのを待つ(DrainTimeoutを過ぎたら強制的に切断する)
+④ CommitLogをクローズし、バッファをフラッシュしてインデックスファイルを切り詰める
+ログをクローズしないと、インデックスファイルが最大サイズのまま残り、次の起動時にnextOffsetを正しく求められない
+*/
+type Server struct {
+	GRPC *grpc.Server
+	// nilでなければgRPCサーバーと一緒に起動・停止する
+	HTTP *http.Server
+	// 停止時に処理中のRPCの完了を待つ最大時間 0の場合は10秒
+	DrainTimeout time.Duration
+
+	config *Config
+	srv    *grpcServer
+	health *healthServer
+
+	shutdownOnce sync.Once
+	shutdownErr  error
+}
+
+func NewServer(config *Config, opts ...grpc.ServerOption) (*Server, error) {
+	gsrv, srv, hsrv, err := newServer(config, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		GRPC:   gsrv,
+		config: config,
+		srv:    srv,
+		health: hsrv,
+	}, nil
+}
+
+// gRPCのProduceの実装 HTTPConfig.Producerに渡す
+func (s *Server) Producer() Producer {
+	return s.srv
+}
+
+/*
+gRPCサーバーとHTTPサーバーを起動し、両方が停止するまでブロックする
+httpLnがnil、もしくはHTTPがnilの場合はgRPCサーバーのみ起動する
+Shutdownによる停止はエラーとして扱わない
+*/
+func (s *Server) Serve(grpcLn, httpLn net.Listener) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs error
+	)
+	record := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errs == nil {
+			errs = err
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := s.GRPC.Serve(grpcLn); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+			record(err)
+		}
+	}()
+
+	if s.HTTP != nil && httpLn != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.HTTP.Serve(httpLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				record(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+/*
+SIGTERMかSIGINTを受け取るまでサーバーを動かし、受け取ったらShutdownする
+サーバーが異常終了した場合も後始末をしてからそのエラーを返す
+*/
+func (s *Server) Run(grpcLn, httpLn net.Listener) error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- s.Serve(grpcLn, httpLn)
+	}()
+
+	select {
+	case err := <-errc:
+		if shutdownErr := s.Shutdown(context.Background()); err == nil {
+			err = shutdownErr
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		<-errc
+		return err
+	}
+
+	return <-errc
+}
+
+/*
+処理中のRPCの完了を待ってからサーバーを停止し、CommitLogをクローズする
+ctxに期限がない場合はDrainTimeoutを期限とする 期限を過ぎたら処理中のRPCを強制的に終了する
+何度呼び出しても後始末は一度だけ行う
+*/
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+
+	return s.shutdownErr
+}
+
+func (s *Server) shutdown(ctx context.Context) error {
+	if _, ok := ctx.Deadline(); !ok {
+		timeout := s.DrainTimeout
+		if timeout == 0 {
+			timeout = defaultDrainTimeout
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	// ①、② Shutdownの後はヘルスチェックの状態が更新されないので、NOT_SERVINGのままになる
+	s.health.Shutdown()
+	close(s.srv.closing)
+
+	// ③ HTTPサーバーも同じ期限で処理中のリクエストを待つ
+	var httpErr error
+	httpDone := make(chan struct{})
+	go func() {
+		defer close(httpDone)
+		if s.HTTP != nil {
+			httpErr = s.HTTP.Shutdown(ctx)
+		}
+	}()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.GRPC.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// 期限を過ぎても終わらないRPC(送信を続けるProduceStreamなど)は強制的に切断する
+		s.GRPC.Stop()
+		<-stopped
+	}
+	<-httpDone
+
+	// 転送中のProduceもないので、プライマリへのコネクションを閉じる
+	if s.config.Primary != nil {
+		s.config.Primary.Close()
+	}
+
+	// ④ ハンドラーが全て戻った後なので、書き込み中のレコードはない
+	if closer, ok := s.config.CommitLog.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+
+	if httpErr != nil && !errors.Is(httpErr, context.DeadlineExceeded) {
+		return httpErr
+	}
+
+	return nil
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// 書き込みをunblockが閉じられるまで止めるCommitLog
+type blockingLog struct {
+	CommitLog
+	started chan struct{}
+	unblock chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (b *blockingLog) Append(record *api.Record) (uint64, error) {
+	close(b.started)
+	<-b.unblock
+
+	return b.CommitLog.Append(record)
+}
+
+func (b *blockingLog) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+
+	return nil
+}
+
+// テスト用にServerを起動し、クライアントのコネクションを返す
+func setupLifecycle(t *testing.T, clog CommitLog) (*Server, *grpc.ClientConn, chan error) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	srv, err := NewServer(&Config{CommitLog: clog})
+	require.NoError(t, err)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Serve(l, nil)
+	}()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { cc.Close() })
+
+	return srv, cc, errc
+}
+
+func TestShutdown(t *testing.T) {
+	dir := t.TempDir()
+	c := log.Config{}
+	c.Segment.MaxIndexBytes = 1024
+	clog, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+
+	srv, cc, errc := setupLifecycle(t, clog)
+	client := api.NewLogClient(cc)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := client.Produce(ctx, &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		require.NoError(t, err)
+	}
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err := stream.Recv()
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, srv.Shutdown(context.Background()))
+	require.NoError(t, <-errc)
+
+	// 購読中のストリームは最後にUnavailableのステータスを受け取る
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unavailable, status.Code(err))
+
+	// 二度目の呼び出しは何もしない
+	require.NoError(t, srv.Shutdown(context.Background()))
+
+	// ログがクローズされ、インデックスファイルが実際のエントリ数に切り詰められている
+	fi, err := os.Stat(dir + "/0.index")
+	require.NoError(t, err)
+	require.Equal(t, int64(3*12), fi.Size())
+
+	n, err := log.NewLog(dir, c)
+	require.NoError(t, err)
+	defer n.Close()
+	off, err := n.HighestOffset()
+	require.NoError(t, err)
+	require.Equal(t, uint64(2), off)
+}
+
+func TestShutdownWaitsForInFlightProduce(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+	defer clog.Close()
+
+	blocking := &blockingLog{
+		CommitLog: clog,
+		started:   make(chan struct{}),
+		unblock:   make(chan struct{}),
+	}
+	srv, cc, errc := setupLifecycle(t, blocking)
+	client := api.NewLogClient(cc)
+
+	produced := make(chan error, 1)
+	go func() {
+		_, err := client.Produce(context.Background(), &api.ProduceRequest{
+			Record: &api.Record{Value: []byte("hello world")},
+		})
+		produced <- err
+	}()
+	<-blocking.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// 停止を始めるとヘルスチェックはNOT_SERVINGになる
+	require.Eventually(t, func() bool {
+		res, err := srv.health.Check(context.Background(), &healthpb.HealthCheckRequest{})
+		return err == nil && res.Status == healthpb.HealthCheckResponse_NOT_SERVING
+	}, time.Second, 10*time.Millisecond)
+
+	// 処理中のProduceが終わるまで停止しない
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before in-flight produce finished")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(blocking.unblock)
+	require.NoError(t, <-produced)
+	require.NoError(t, <-shutdown)
+	require.NoError(t, <-errc)
+
+	blocking.mu.Lock()
+	defer blocking.mu.Unlock()
+	require.True(t, blocking.closed)
+}
+
+func TestShutdownDrainTimeout(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+
+	srv, cc, errc := setupLifecycle(t, clog)
+	srv.DrainTimeout = 100 * time.Millisecond
+	client := api.NewLogClient(cc)
+
+	// 送信を続けるProduceStreamは期限まで待ってから切断する
+	stream, err := client.ProduceStream(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	}))
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, srv.Shutdown(context.Background()))
+	require.GreaterOrEqual(t, time.Since(start), srv.DrainTimeout)
+	require.NoError(t, <-errc)
+
+	_, err = stream.Recv()
+	require.Error(t, err)
+
+	// クローズ済みのログは読み書きできない
+	_, err = clog.Append(&api.Record{Value: []byte("hello world")})
+	require.Equal(t, log.ErrNotReady, err)
+}
+
+func TestRunStopsOnSignal(t *testing.T) {
+	clog, err := log.NewLog(t.TempDir(), log.Config{})
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv, err := NewServer(&Config{CommitLog: clog})
+	require.NoError(t, err)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- srv.Run(l, nil)
+	}()
+
+	cc, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	defer cc.Close()
+
+	// 接続できた時点でRunはシグナルを待ち受けている
+	_, err = healthpb.NewHealthClient(cc).Check(
+		context.Background(),
+		&healthpb.HealthCheckRequest{},
+		grpc.WaitForReady(true),
+	)
+	require.NoError(t, err)
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGTERM))
+	select {
+	case err := <-errc:
+		require.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("server did not stop on SIGTERM")
+	}
+	require.Equal(t, log.ErrNotReady, clog.Health())
+}
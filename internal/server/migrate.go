@@ -0,0 +1,506 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/auth"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// スナップショットを送るメッセージ1つあたりの最大サイズ
+	snapshotChunkSize = 64 << 10
+	// 1回の追いつきで送ったレコードがこの数以下になったら、書き込みを止めて引き継ぐ
+	catchUpLag = 100
+	// 書き込みが多くて追いつけない場合も、この回数で引き継ぐ
+	maxCatchUpRounds = 10
+	// 書き込みを止めてから、移行先が全てのレコードを書き込んだ応答を待つ最大時間
+	handoverTimeout = 10 * time.Second
+	// 移行先が進み具合を送るレコードの間隔
+	progressInterval = 1000
+)
+
+// スナップショットを書き出せるCommitLog internal/logのLogが実装している
+type snapshotter interface {
+	Snapshot(io.Writer) error
+}
+
+// 空のログをスナップショットで置き換えられるCommitLog internal/logのLogが実装している
+type replacer interface {
+	offsetRange
+	Read(uint64) (*api.Record, error)
+	Replace(io.Reader) error
+	Reset() error
+}
+
+var _ api.AdminServer = (*adminServer)(nil)
+
+/*
+ノードのログを別のノードに移す(ExportLog・ImportLog)
+移行元は、移行先が全てのレコードを書き込んだ応答を受け取ってから書き込みを移行先に向け、
+移行先は、移行元が引き継ぎを終えて(ExportLogが正常に終了して)から書き込みを受け付ける
+引き継ぎの途中で接続が切れた場合は、両方のノードが書き込みを受け付けることはないが、どちらも受け付けないことはある
+HTTPでの書き込みは、HTTPConfig.Producerを設定した場合だけProduceと同じように止める
+引き継いだ後のプライマリはConfig.HandoverFileに保存するので、再起動しても移行元は書き込みを受け付けない
+*/
+type adminServer struct {
+	api.UnimplementedAdminServer
+	*grpcServer
+}
+
+// 認証されたサブジェクトがAdminSubjectsに含まれない場合はPermissionDeniedを返す
+func (s *adminServer) authorize(ctx context.Context) error {
+	if s.Authenticator == nil {
+		return nil
+	}
+	subject := auth.Subject(ctx)
+	for _, admin := range s.AdminSubjects {
+		if subject == admin {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.PermissionDenied, "subject %q is not allowed to migrate the log", subject)
+}
+
+// 移行した後のプライマリのアドレスをConfig.HandoverFileに保存する addrが空の場合はファイルを削除する
+func (s *grpcServer) saveHandover(addr string) error {
+	if s.HandoverFile == "" {
+		return nil
+	}
+	if addr == "" {
+		if err := os.Remove(s.HandoverFile); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := s.HandoverFile + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(addr + "\n")
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.HandoverFile)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// 起動時に、Config.HandoverFileに保存したプライマリに書き込みを向ける
+func (s *grpcServer) loadHandover() error {
+	if s.HandoverFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(s.HandoverFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	addr := strings.TrimSpace(string(b))
+
+	switch {
+	case s.Primary == nil:
+		s.handedOverTo = addr
+	case addr == s.Primary.LocalAddr:
+		s.Primary.SetAddr(addr)
+	default:
+		s.Primary.HandOver(addr)
+	}
+
+	return nil
+}
+
+// 移行を始める 既に移行元か移行先として移行している場合はfalse
+func (s *grpcServer) startMigration() bool {
+	return atomic.CompareAndSwapInt32(&s.migrating, 0, 1)
+}
+
+func (s *grpcServer) endMigration() {
+	atomic.StoreInt32(&s.migrating, 0)
+}
+
+// 移行元・移行先として書き込みを受け付けない場合は、その理由のエラーを返す 呼び出し元がs.writesのロックを取得する
+func (s *grpcServer) migrationError(ctx context.Context) error {
+	if s.handedOverTo != "" {
+		grpc.SetTrailer(ctx, metadata.Pairs(PrimaryMetadataKey, s.handedOverTo))
+		return status.Errorf(codes.Unavailable, "log was migrated: write to %s", s.handedOverTo)
+	}
+	if s.importing {
+		return status.Error(codes.Unavailable, "log is being imported from another node")
+	}
+
+	return nil
+}
+
+/*
+移行元 移行先からのメッセージに応じて、スナップショット、それ以降のレコード、引き継ぎを順に送る
+書き込みを止めるのは、最後の追いつきで残ったレコードを送ってから、移行先の応答を受け取るまでの間だけ
+*/
+func (s *adminServer) ExportLog(stream api.Admin_ExportLogServer) error {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+	cl, ok := s.CommitLog.(snapshotter)
+	if !ok {
+		return status.Error(codes.Unimplemented, "commit log does not support snapshots")
+	}
+	if !s.startMigration() {
+		return status.Error(codes.FailedPrecondition, "a migration is already in progress")
+	}
+	defer s.endMigration()
+
+	req, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	target := req.TargetAddr
+	if target == "" {
+		return status.Error(codes.InvalidArgument, "target address is required")
+	}
+
+	// ① 閉じたセグメントと、アクティブセグメントの書き出し済みの部分
+	w := bufio.NewWriterSize(snapshotWriter{stream}, snapshotChunkSize)
+	if err := cl.Snapshot(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := stream.Send(&api.ExportLogResponse{SnapshotEnd: true}); err != nil {
+		return err
+	}
+
+	// ② 移行先が復元したログの続きから、書き込まれたレコードに追いつくまで送る
+	if req, err = stream.Recv(); err != nil {
+		return err
+	}
+	next := req.NextOffset
+	for round := 1; ; round++ {
+		var n int
+		if n, next, err = s.sendRecords(stream, next); err != nil {
+			return err
+		}
+		if n <= catchUpLag || round >= maxCatchUpRounds {
+			break
+		}
+	}
+
+	// ③ 書き込み中のProduceが終わるのを待って書き込みを止め、残りのレコードを送る
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	if _, next, err = s.sendRecords(stream, next); err != nil {
+		return err
+	}
+	if err := stream.Send(&api.ExportLogResponse{Handover: true, HandoverOffset: next}); err != nil {
+		return err
+	}
+	req, err = recvTimeout(stream, handoverTimeout)
+	if err != nil {
+		return err
+	}
+	if !req.HandoverAck {
+		return status.Error(codes.InvalidArgument, "expected handover acknowledgement")
+	}
+
+	if err := s.saveHandover(target); err != nil {
+		return err
+	}
+	if s.Primary != nil {
+		s.Primary.HandOver(target)
+	} else {
+		s.handedOverTo = target
+	}
+
+	return nil
+}
+
+// fromからログの末尾までのレコードを送る 送ったレコードの数と、次に送るオフセットを返す
+func (s *adminServer) sendRecords(stream api.Admin_ExportLogServer, from uint64) (int, uint64, error) {
+	var n int
+	for off := from; ; off++ {
+		record, err := s.CommitLog.Read(off)
+		switch err.(type) {
+		case nil:
+		case api.ErrOffsetOutOfRange:
+			return n, off, nil
+		default:
+			return n, off, err
+		}
+
+		if err := stream.Send(&api.ExportLogResponse{Record: record}); err != nil {
+			return n, off, err
+		}
+		n++
+	}
+}
+
+// 最大timeoutの間、移行先からのメッセージを待つ
+func recvTimeout(stream api.Admin_ExportLogServer, timeout time.Duration) (*api.ExportLogRequest, error) {
+	type result struct {
+		req *api.ExportLogRequest
+		err error
+	}
+	// 待つのをやめてもRecvはRPCの終了とともに返るので、バッファを持たせてゴルーチンを残さない
+	ch := make(chan result, 1)
+	go func() {
+		req, err := stream.Recv()
+		ch <- result{req, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.req, r.err
+	case <-time.After(timeout):
+		return nil, status.Error(codes.DeadlineExceeded, "timed out waiting for handover acknowledgement")
+	}
+}
+
+// 書き込まれたバイト列をスナップショットのメッセージとして送る
+type snapshotWriter struct {
+	stream api.Admin_ExportLogServer
+}
+
+func (w snapshotWriter) Write(p []byte) (int, error) {
+	if err := w.stream.Send(&api.ExportLogResponse{Snapshot: p}); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+/*
+移行先 req.SourceAddrのノードのExportLogを呼び出し、このノードの空のログに移行元のログを移す
+① 移行している間はProduceを受け付けない(プライマリの設定があれば、移行元に転送する)
+② 移行元に引き継ぎの応答を送る前に失敗した場合は、ログを空に戻して、もう一度移行できるようにする
+③ 移行元が引き継ぎを終えたら、このノードがプライマリとして書き込みを受け付ける
+*/
+func (s *adminServer) ImportLog(req *api.ImportLogRequest, stream api.Admin_ImportLogServer) (err error) {
+	if err := s.authorize(stream.Context()); err != nil {
+		return err
+	}
+	cl, ok := s.CommitLog.(replacer)
+	if !ok {
+		return status.Error(codes.Unimplemented, "commit log does not support snapshots")
+	}
+	addr := req.Addr
+	if addr == "" && s.Primary != nil {
+		addr = s.Primary.LocalAddr
+	}
+	if addr == "" {
+		return status.Error(codes.InvalidArgument, "address of this node is required")
+	}
+	if req.SourceAddr == "" {
+		return status.Error(codes.InvalidArgument, "source address is required")
+	}
+	if !s.startMigration() {
+		return status.Error(codes.FailedPrecondition, "a migration is already in progress")
+	}
+	defer s.endMigration()
+
+	next, err := nextOffset(cl)
+	if err != nil {
+		return err
+	}
+	if lowest, err := cl.LowestOffset(); err != nil {
+		return err
+	} else if next != lowest {
+		return status.Error(codes.FailedPrecondition, "log is not empty")
+	}
+
+	s.setImporting(true)
+	acked := false
+	defer func() {
+		// 引き継ぎの応答を送った後に失敗した場合は、移行元が書き込みをこのノードに向けているかもしれないので、
+		// どちらのノードも書き込みを受け付けないままにする(プライマリの設定があれば、移行元に転送する)
+		if err != nil && !acked {
+			cl.Reset()
+			s.setImporting(false)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	// 移行元でもう一度認証できるように、受け取ったメタデータのauthorizationを引き継ぐ
+	if md, _ := metadata.FromIncomingContext(ctx); len(md.Get("authorization")) > 0 {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", md.Get("authorization")[0])
+	}
+	cc, err := grpc.DialContext(ctx, req.SourceAddr, s.DialOptions...)
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	export, err := api.NewAdminClient(cc).ExportLog(ctx)
+	if err != nil {
+		return err
+	}
+
+	progress := func(phase api.MigrationPhase) error {
+		return stream.Send(&api.ImportLogResponse{Phase: phase, NextOffset: next})
+	}
+
+	if err := export.Send(&api.ExportLogRequest{TargetAddr: addr}); err != nil {
+		return err
+	}
+	if err := progress(api.MigrationPhase_MIGRATION_PHASE_SNAPSHOT); err != nil {
+		return err
+	}
+	if err := s.importSnapshot(export, cl); err != nil {
+		return err
+	}
+
+	if next, err = nextOffset(cl); err != nil {
+		return err
+	}
+	if err := export.Send(&api.ExportLogRequest{NextOffset: next}); err != nil {
+		return err
+	}
+	if err := progress(api.MigrationPhase_MIGRATION_PHASE_CATCH_UP); err != nil {
+		return err
+	}
+
+	for {
+		res, err := export.Recv()
+		if err != nil {
+			return err
+		}
+		if res.Handover {
+			if res.HandoverOffset != next {
+				return status.Errorf(
+					codes.DataLoss,
+					"source handed over at offset %d, imported up to %d", res.HandoverOffset, next,
+				)
+			}
+			break
+		}
+		if res.Record == nil {
+			return status.Error(codes.InvalidArgument, "expected record or handover")
+		}
+
+		off, err := s.CommitLog.Append(res.Record)
+		if err != nil {
+			return err
+		}
+		if off != res.Record.Offset {
+			return status.Errorf(codes.DataLoss, "record %d was imported at offset %d", res.Record.Offset, off)
+		}
+		next = off + 1
+		if next%progressInterval == 0 {
+			if err := progress(api.MigrationPhase_MIGRATION_PHASE_CATCH_UP); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := progress(api.MigrationPhase_MIGRATION_PHASE_HANDOVER); err != nil {
+		return err
+	}
+	if err := export.Send(&api.ExportLogRequest{HandoverAck: true}); err != nil {
+		return err
+	}
+	acked = true
+	// ExportLogが正常に終了したら、移行元は書き込みをこのノードに向けている
+	if _, err := export.Recv(); err != io.EOF {
+		if err == nil {
+			err = status.Error(codes.InvalidArgument, "unexpected message after handover")
+		}
+		return fmt.Errorf("handover to %s was not confirmed: %w", addr, err)
+	}
+
+	s.writes.Lock()
+	primary := ""
+	if s.Primary != nil {
+		s.Primary.SetAddr(s.Primary.LocalAddr)
+		primary = s.Primary.LocalAddr
+	}
+	s.importing = false
+	s.writes.Unlock()
+	// 移行元は引き継ぎを終えているので、保存に失敗しても書き込みは受け付ける
+	if err := s.saveHandover(primary); err != nil {
+		return fmt.Errorf("save handover to %s: %w", s.HandoverFile, err)
+	}
+
+	return progress(api.MigrationPhase_MIGRATION_PHASE_DONE)
+}
+
+// 移行元から受け取ったスナップショットでログを置き換える
+func (s *adminServer) importSnapshot(export api.Admin_ExportLogClient, cl replacer) error {
+	pr, pw := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := cl.Replace(pr)
+		// 途中で失敗した場合は、移行元から受け取っているWriteを終わらせる
+		pr.CloseWithError(err)
+		done <- err
+	}()
+
+	for {
+		res, err := export.Recv()
+		if err != nil {
+			pw.CloseWithError(err)
+			<-done
+			return err
+		}
+		if res.SnapshotEnd {
+			break
+		}
+		if _, err := pw.Write(res.Snapshot); err != nil {
+			return <-done
+		}
+	}
+	pw.Close()
+
+	return <-done
+}
+
+func (s *grpcServer) setImporting(importing bool) {
+	s.writes.Lock()
+	defer s.writes.Unlock()
+
+	s.importing = importing
+}
+
+// ログに次に書き込むオフセット HighestOffsetは空のログでも0以上を返すので、読み出せるかで区別する
+func nextOffset(cl replacer) (uint64, error) {
+	lowest, err := cl.LowestOffset()
+	if err != nil {
+		return 0, err
+	}
+	highest, err := cl.HighestOffset()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := cl.Read(highest); err != nil {
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return lowest, nil
+		}
+		return 0, err
+	}
+
+	return highest + 1, nil
+}
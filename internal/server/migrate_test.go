@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// 書き込みを続けながら移行しても、書き込みが成功したレコードは移行先のログに一度ずつ、応答したオフセットで残る
+func TestMigrate(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	src, dst := nodes[0], nodes[1]
+	ctx := withToken(t, context.Background(), "admin")
+
+	// 閉じたセグメントがいくつもできるように書き込んでおく
+	for i := 0; i < 200; i++ {
+		_, err := src.log.Append(&api.Record{Value: []byte(fmt.Sprintf("before-%d", i))})
+		require.NoError(t, err)
+	}
+
+	// 移行元と移行先(移行元に転送する)の両方に書き込み続ける 拒否された書き込みは書き込まれていないので再送する
+	var (
+		mu       sync.Mutex
+		produced = map[uint64]string{}
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 200; i++ {
+		produced[uint64(i)] = fmt.Sprintf("before-%d", i)
+	}
+	stop := make(chan struct{})
+	for w, client := range []api.LogClient{src.client, dst.client, src.client, dst.client} {
+		wg.Add(1)
+		go func(w int, client api.LogClient) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				value := fmt.Sprintf("writer-%d-%d", w, i)
+				for {
+					res, err := client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte(value)}})
+					if status.Code(err) == codes.Unavailable {
+						time.Sleep(time.Millisecond)
+						continue
+					}
+					if err != nil {
+						t.Errorf("produce %s: %v", value, err)
+						return
+					}
+					mu.Lock()
+					if prev, ok := produced[res.Offset]; ok {
+						t.Errorf("offset %d was returned for %s and %s", res.Offset, prev, value)
+					}
+					produced[res.Offset] = value
+					mu.Unlock()
+					break
+				}
+			}
+		}(w, client)
+	}
+
+	stream, err := dst.admin.ImportLog(ctx, &api.ImportLogRequest{SourceAddr: src.addr})
+	require.NoError(t, err)
+	var (
+		phases   []api.MigrationPhase
+		handover uint64
+	)
+	for {
+		res, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		if res.Phase == api.MigrationPhase_MIGRATION_PHASE_HANDOVER {
+			handover = res.NextOffset
+		}
+		if len(phases) == 0 || phases[len(phases)-1] != res.Phase {
+			phases = append(phases, res.Phase)
+		}
+	}
+	require.Equal(t, []api.MigrationPhase{
+		api.MigrationPhase_MIGRATION_PHASE_SNAPSHOT,
+		api.MigrationPhase_MIGRATION_PHASE_CATCH_UP,
+		api.MigrationPhase_MIGRATION_PHASE_HANDOVER,
+		api.MigrationPhase_MIGRATION_PHASE_DONE,
+	}, phases)
+
+	// 移行した後も書き込み続け、移行元に転送された書き込みも移行先に書き込まれる
+	require.Eventually(t, func() bool {
+		next, err := nextOffset(dst.log)
+		require.NoError(t, err)
+		return next > handover+100
+	}, 10*time.Second, 10*time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	require.Equal(t, dst.addr, src.primary.Addr())
+	require.True(t, dst.primary.IsLocal())
+
+	values := logValues(t, dst.log)
+	require.Equal(t, len(produced), len(values))
+	for off, value := range values {
+		require.Equal(t, produced[uint64(off)], value, "offset %d", off)
+	}
+
+	// 移行元には引き継いだ後のレコードが書き込まれていない
+	srcValues := logValues(t, src.log)
+	require.Equal(t, int(handover), len(srcValues))
+	require.Greater(t, handover, uint64(200))
+	require.Equal(t, values[:len(srcValues)], srcValues)
+}
+
+// 空でないログには移行せず、書き込み済みのレコードもそのまま残る
+func TestMigrateNotEmpty(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	src, dst := nodes[0], nodes[1]
+	ctx := withToken(t, context.Background(), "admin")
+
+	_, err := src.log.Append(&api.Record{Value: []byte("source")})
+	require.NoError(t, err)
+	_, err = dst.log.Append(&api.Record{Value: []byte("target")})
+	require.NoError(t, err)
+
+	stream, err := dst.admin.ImportLog(ctx, &api.ImportLogRequest{SourceAddr: src.addr})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.FailedPrecondition, status.Code(err))
+
+	require.Equal(t, []string{"target"}, logValues(t, dst.log))
+	require.Equal(t, src.addr, src.primary.Addr())
+}
+
+// AdminSubjectsに含まれないサブジェクトは、移行先としても移行元としても移行できない
+func TestMigratePermissionDenied(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	src, dst := nodes[0], nodes[1]
+	ctx := withToken(t, context.Background(), "producer")
+
+	_, err := src.log.Append(&api.Record{Value: []byte("source")})
+	require.NoError(t, err)
+
+	imports, err := dst.admin.ImportLog(ctx, &api.ImportLogRequest{SourceAddr: src.addr})
+	require.NoError(t, err)
+	_, err = imports.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	exports, err := src.admin.ExportLog(ctx)
+	require.NoError(t, err)
+	require.NoError(t, exports.Send(&api.ExportLogRequest{TargetAddr: dst.addr}))
+	_, err = exports.Recv()
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	require.Empty(t, logValues(t, dst.log))
+	require.Equal(t, src.addr, src.primary.Addr())
+}
+
+// EnableAdminを設定しない場合は、Adminサービスを登録しない
+func TestAdminDisabled(t *testing.T) {
+	cc, _, teardown := setupConn(t, nil)
+	defer teardown()
+
+	stream, err := api.NewAdminClient(cc).ImportLog(
+		withToken(t, context.Background(), "admin"),
+		&api.ImportLogRequest{SourceAddr: "127.0.0.1:0"},
+	)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+// プライマリを切り替えていないセカンダリからの書き込みも、移行元が移行先に転送する
+func TestMigrateForwardFromSecondary(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 3, ForwardWrites)
+	src, dst, other := nodes[0], nodes[1], nodes[2]
+	ctx := withToken(t, context.Background(), "admin")
+
+	_, err := src.log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+
+	stream, err := dst.admin.ImportLog(ctx, &api.ImportLogRequest{SourceAddr: src.addr})
+	require.NoError(t, err)
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+	require.Equal(t, src.addr, other.primary.Addr())
+
+	res, err := other.client.Produce(
+		withToken(t, context.Background(), "producer"),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("after")}},
+	)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), res.Offset)
+	require.Equal(t, []string{"before", "after"}, logValues(t, dst.log))
+	require.Equal(t, []string{"before"}, logValues(t, src.log))
+}
+
+// HTTPでの書き込みも移行先に向け、再起動した後も引き継いだプライマリに書き込みを向ける
+func TestMigrateHandoverPersisted(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	src, dst := nodes[0], nodes[1]
+
+	_, err := src.log.Append(&api.Record{Value: []byte("before")})
+	require.NoError(t, err)
+	stream, err := dst.admin.ImportLog(
+		withToken(t, context.Background(), "admin"),
+		&api.ImportLogRequest{SourceAddr: src.addr},
+	)
+	require.NoError(t, err)
+	for {
+		_, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+	}
+
+	rec := produceHTTP(t, src.http, "after")
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	require.Equal(t, []string{"before", "after"}, logValues(t, dst.log))
+	require.Equal(t, []string{"before"}, logValues(t, src.log))
+
+	// 起動時の設定ではsrcがプライマリのままでも、保存した引き継ぎ先に書き込みを向ける
+	for _, n := range []*primaryNode{src, dst} {
+		primary := NewPrimary(n.addr, src.addr, ForwardWrites)
+		_, err := NewGRPCServer(&Config{CommitLog: n.log, Primary: primary, HandoverFile: n.handoverFile})
+		require.NoError(t, err)
+		require.Equal(t, dst.addr, primary.Addr())
+	}
+
+	// プライマリの設定がない移行元は、書き込みを拒否する
+	srv, err := NewServer(&Config{CommitLog: src.log, HandoverFile: src.handoverFile})
+	require.NoError(t, err)
+	rec = produceHTTP(t, NewHTTPServer("", &HTTPConfig{CommitLog: src.log, Producer: srv.Producer()}).Handler, "again")
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	require.Equal(t, dst.addr, rec.Header().Get(PrimaryHeader))
+	require.Equal(t, []string{"before"}, logValues(t, src.log))
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// セカンダリが書き込みを受け取った時の動作
+type WriteMode int
+
+const (
+	// プライマリにProduceを転送し、その応答を返す
+	ForwardWrites WriteMode = iota
+	// codes.Unavailableを返し、トレーラーのPrimaryMetadataKeyでプライマリのアドレスを伝える
+	RedirectWrites
+)
+
+func (m WriteMode) String() string {
+	switch m {
+	case ForwardWrites:
+		return "forward"
+	case RedirectWrites:
+		return "redirect"
+	}
+
+	return fmt.Sprintf("WriteMode(%d)", int(m))
+}
+
+const (
+	// 書き込みを拒否した時に、プライマリのアドレスを入れるトレーラーのキー
+	PrimaryMetadataKey = "proglog-primary"
+	// 転送したProduceに付けるメタデータのキー 転送したノードのアドレスを入れる
+	forwardedMetadataKey = "proglog-forwarded-by"
+)
+
+/*
+ログへの書き込みを受け付けるノード(プライマリ)を決める
+静的な設定でプライマリのアドレスを1つ指定し、LocalAddrがそれと一致するノードだけがログに書き込む
+それ以外のノード(セカンダリ)は、Modeに従ってProduce・ProduceStreamを転送するか拒否する
+
+① SetAddrで実行中にプライマリを切り替えられる ProduceStreamはレコードごとにプライマリを確認するので、
+切り替えた後のレコードは新しいプライマリに書き込む(それまでに書き込んだレコードは前のプライマリに残る)
+② 転送されたProduceは再び転送しない 切り替えの途中で互いをプライマリとみなしているノードの間で転送が繰り返されないように、
+自身がプライマリでなければ拒否する ただしHandOverでログを移したノードは、プライマリを切り替えていないセカンダリからの転送を
+一度だけ新しいプライマリに転送する(転送元が新しいプライマリ自身の場合は拒否する)
+③ 転送する時は、受け取ったメタデータのauthorizationを引き継ぐ プライマリでもう一度認証する
+HTTPでの書き込みも、HTTPConfig.Producerを設定すれば同じように扱う
+*/
+type Primary struct {
+	// このノードのgRPCのアドレス プライマリのアドレスと文字列として比較する
+	LocalAddr string
+	// セカンダリが書き込みを受け取った時の動作
+	Mode WriteMode
+	// プライマリに転送する時の接続オプション(トランスポートの認証情報など)
+	DialOptions []grpc.DialOption
+
+	mu   sync.RWMutex
+	addr string
+	// HandOverでこのノードのログを別のノードに移した場合はtrue
+	handedOver bool
+	// 転送先のアドレスごとのコネクション 切り替えの前に始めた転送を切らないように、Closeまで閉じない
+	conns map[string]*grpc.ClientConn
+}
+
+// addrをプライマリとし、localAddrのノードの書き込みを扱う
+func NewPrimary(localAddr, addr string, mode WriteMode, opts ...grpc.DialOption) *Primary {
+	return &Primary{
+		LocalAddr:   localAddr,
+		Mode:        mode,
+		DialOptions: opts,
+		addr:        addr,
+	}
+}
+
+// 現在のプライマリのアドレス
+func (p *Primary) Addr() string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.addr
+}
+
+// プライマリをaddrのノードに切り替える
+func (p *Primary) SetAddr(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addr = addr
+}
+
+// このノードのログを移したaddrのノードをプライマリにする 他のノードから転送された書き込みもaddrに転送する
+func (p *Primary) HandOver(addr string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addr = addr
+	p.handedOver = true
+}
+
+// このノードがプライマリかどうか
+func (p *Primary) IsLocal() bool {
+	return p.Addr() == p.LocalAddr
+}
+
+// 転送に使ったコネクションを全て閉じる
+func (p *Primary) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var err error
+	for addr, cc := range p.conns {
+		if cerr := cc.Close(); err == nil {
+			err = cerr
+		}
+		delete(p.conns, addr)
+	}
+
+	return err
+}
+
+// addrのノードのクライアント 初めて転送する時に接続する
+func (p *Primary) client(addr string) (api.LogClient, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if cc, ok := p.conns[addr]; ok {
+		return api.NewLogClient(cc), nil
+	}
+	cc, err := grpc.Dial(addr, p.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	if p.conns == nil {
+		p.conns = map[string]*grpc.ClientConn{}
+	}
+	p.conns[addr] = cc
+
+	return api.NewLogClient(cc), nil
+}
+
+/*
+セカンダリが受け取ったProduceを扱う ok(このノードがプライマリ)の場合は何もせずfalseを返すので、呼び出し元がログに書き込む
+拒否する場合と転送に失敗した場合は、トレーラーでプライマリのアドレスを伝える
+*/
+func (p *Primary) produce(ctx context.Context, req *api.ProduceRequest) (res *api.ProduceResponse, handled bool, err error) {
+	p.mu.RLock()
+	addr, handedOver := p.addr, p.handedOver
+	p.mu.RUnlock()
+	if addr == p.LocalAddr {
+		return nil, false, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	forwarded := md.Get(forwardedMetadataKey)
+	if p.Mode == RedirectWrites || len(forwarded) > 1 || (len(forwarded) == 1 && (!handedOver || forwarded[0] == addr)) {
+		return nil, true, p.redirect(ctx, addr)
+	}
+
+	client, err := p.client(addr)
+	if err == nil {
+		outgoing := metadata.Pairs(forwardedMetadataKey, p.LocalAddr)
+		outgoing.Append(forwardedMetadataKey, forwarded...)
+		if authz := md.Get("authorization"); len(authz) > 0 {
+			outgoing.Set("authorization", authz...)
+		}
+		res, err = client.Produce(metadata.NewOutgoingContext(ctx, outgoing), req)
+	}
+	if err != nil {
+		grpc.SetTrailer(ctx, metadata.Pairs(PrimaryMetadataKey, addr))
+		return nil, true, err
+	}
+
+	return res, true, nil
+}
+
+func (p *Primary) redirect(ctx context.Context, addr string) error {
+	grpc.SetTrailer(ctx, metadata.Pairs(PrimaryMetadataKey, addr))
+
+	return status.Errorf(codes.Unavailable, "%s is not the primary: write to %s", p.LocalAddr, addr)
+}
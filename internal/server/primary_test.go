@@ -0,0 +1,266 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/auth"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type primaryNode struct {
+	addr    string
+	log     *log.Log
+	primary *Primary
+	servers *StaticServers
+	client  api.LogClient
+	admin   api.AdminClient
+	// gRPCと同じ処理で書き込むHTTPのハンドラー
+	http http.Handler
+	// 開き直す時にConfig.HandoverFileに渡す
+	handoverFile string
+}
+
+/*
+それぞれのログを持つnodeCount個のサーバーを起動する 最初のノードをプライマリにする
+GetServersは全てのノードで同じStaticServersを使う(サーバーの一覧は空なので、テストで設定する)
+*/
+func setupPrimaryNodes(t *testing.T, nodeCount int, mode WriteMode) []*primaryNode {
+	t.Helper()
+
+	dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	servers := &StaticServers{DialOptions: dialOpts}
+	authenticator, err := auth.New(auth.Config{KeyFile: writeSecret(t)})
+	require.NoError(t, err)
+
+	var nodes []*primaryNode
+	for i := 0; i < nodeCount; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		nodes = append(nodes, &primaryNode{addr: l.Addr().String()})
+
+		clog, err := log.NewLog(t.TempDir(), log.Config{})
+		require.NoError(t, err)
+		t.Cleanup(func() { clog.Close() })
+
+		primary := NewPrimary(l.Addr().String(), nodes[0].addr, mode, dialOpts...)
+		t.Cleanup(func() { primary.Close() })
+
+		handoverFile := filepath.Join(t.TempDir(), "handover")
+		server, err := NewServer(&Config{
+			CommitLog:     clog,
+			Authenticator: authenticator,
+			Primary:       primary,
+			Servers:       servers,
+			DialOptions:   dialOpts,
+			EnableAdmin:   true,
+			AdminSubjects: []string{"admin"},
+			HandoverFile:  handoverFile,
+		})
+		require.NoError(t, err)
+		go server.GRPC.Serve(l)
+		t.Cleanup(server.GRPC.Stop)
+
+		cc, err := grpc.Dial(l.Addr().String(), dialOpts...)
+		require.NoError(t, err)
+		t.Cleanup(func() { cc.Close() })
+
+		nodes[i].log = clog
+		nodes[i].primary = primary
+		nodes[i].servers = servers
+		nodes[i].client = api.NewLogClient(cc)
+		nodes[i].admin = api.NewAdminClient(cc)
+		nodes[i].http = NewHTTPServer("", &HTTPConfig{
+			CommitLog:     clog,
+			Authenticator: authenticator,
+			Producer:      server.Producer(),
+		}).Handler
+		nodes[i].handoverFile = handoverFile
+	}
+
+	return nodes
+}
+
+// 全てのノードのプライマリを切り替える
+func setPrimary(nodes []*primaryNode, addr string) {
+	for _, n := range nodes {
+		n.primary.SetAddr(addr)
+	}
+}
+
+func logValues(t *testing.T, l *log.Log) []string {
+	t.Helper()
+
+	var values []string
+	for off := uint64(0); ; off++ {
+		record, err := l.Read(off)
+		if _, ok := err.(api.ErrOffsetOutOfRange); ok {
+			return values
+		}
+		require.NoError(t, err)
+		values = append(values, string(record.Value))
+	}
+}
+
+// HTTPでvalueを書き込み、レスポンスを返す
+func produceHTTP(t *testing.T, h http.Handler, value string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(ProduceRequest{Record: Record{Value: []byte(value)}})
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+newToken(t, "producer"))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	return rec
+}
+
+func produceOnStream(t *testing.T, stream api.Log_ProduceStreamClient, value string) (*api.ProduceResponse, error) {
+	t.Helper()
+
+	require.NoError(t, stream.Send(&api.ProduceRequest{Record: &api.Record{Value: []byte(value)}}))
+
+	return stream.Recv()
+}
+
+// セカンダリへの書き込みはプライマリに転送され、ストリームの途中で切り替えた後は新しいプライマリに書き込まれる
+func TestPrimaryForward(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 3, ForwardWrites)
+	a, b, c := nodes[0], nodes[1], nodes[2]
+	ctx := withToken(t, context.Background(), "producer")
+
+	stream, err := b.client.ProduceStream(ctx)
+	require.NoError(t, err)
+	for i, v := range []string{"first", "second"} {
+		res, err := produceOnStream(t, stream, v)
+		require.NoError(t, err)
+		require.Equal(t, uint64(i), res.Offset)
+	}
+
+	setPrimary(nodes, c.addr)
+	res, err := produceOnStream(t, stream, "third")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// ストリームを受け付けたノード自身がプライマリになった場合は、そのノードに書き込む
+	setPrimary(nodes, b.addr)
+	res, err = produceOnStream(t, stream, "fourth")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	require.NoError(t, stream.CloseSend())
+
+	require.Equal(t, []string{"first", "second"}, logValues(t, a.log))
+	require.Equal(t, []string{"fourth"}, logValues(t, b.log))
+	require.Equal(t, []string{"third"}, logValues(t, c.log))
+
+	// 転送先でも認証するので、トークンのない書き込みは転送しても拒否される
+	setPrimary(nodes, a.addr)
+	_, err = c.client.Produce(context.Background(), &api.ProduceRequest{Record: &api.Record{Value: []byte("anonymous")}})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = c.client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("fifth")}})
+	require.NoError(t, err)
+	require.Equal(t, []string{"first", "second", "fifth"}, logValues(t, a.log))
+}
+
+// セカンダリは書き込みを拒否し、トレーラーでプライマリのアドレスを返す
+func TestPrimaryRedirect(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, RedirectWrites)
+	a, b := nodes[0], nodes[1]
+	ctx := withToken(t, context.Background(), "producer")
+
+	stream, err := a.client.ProduceStream(ctx)
+	require.NoError(t, err)
+	res, err := produceOnStream(t, stream, "first")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+
+	// 切り替えた後のレコードは拒否され、ストリームが終了する
+	setPrimary(nodes, b.addr)
+	_, err = produceOnStream(t, stream, "second")
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, []string{b.addr}, stream.Trailer().Get(PrimaryMetadataKey))
+
+	// トレーラーのアドレスのノードに送り直す
+	var trailer metadata.MD
+	_, err = a.client.Produce(ctx, &api.ProduceRequest{Record: &api.Record{Value: []byte("second")}}, grpc.Trailer(&trailer))
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, []string{b.addr}, trailer.Get(PrimaryMetadataKey))
+
+	stream, err = b.client.ProduceStream(ctx)
+	require.NoError(t, err)
+	res, err = produceOnStream(t, stream, "second")
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), res.Offset)
+	require.NoError(t, stream.CloseSend())
+
+	require.Equal(t, []string{"first"}, logValues(t, a.log))
+	require.Equal(t, []string{"second"}, logValues(t, b.log))
+}
+
+// 切り替えの途中で互いをプライマリとみなしていても、転送を繰り返さずに拒否する
+func TestPrimaryForwardLoop(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	a, b := nodes[0], nodes[1]
+	a.primary.SetAddr(b.addr)
+
+	var trailer metadata.MD
+	_, err := b.client.Produce(
+		withToken(t, context.Background(), "producer"),
+		&api.ProduceRequest{Record: &api.Record{Value: []byte("lost")}},
+		grpc.Trailer(&trailer),
+	)
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, []string{a.addr}, trailer.Get(PrimaryMetadataKey))
+	require.Empty(t, logValues(t, a.log))
+	require.Empty(t, logValues(t, b.log))
+}
+
+// HTTPでの書き込みも、セカンダリはプライマリに転送するか拒否し、自身のログには書き込まない
+func TestPrimaryHTTP(t *testing.T) {
+	for _, mode := range []WriteMode{ForwardWrites, RedirectWrites} {
+		t.Run(mode.String(), func(t *testing.T) {
+			primary := setupPrimaryNodes(t, 1, mode)[0]
+
+			clog, err := log.NewLog(t.TempDir(), log.Config{})
+			require.NoError(t, err)
+			t.Cleanup(func() { clog.Close() })
+			authenticator, err := auth.New(auth.Config{KeyFile: writeSecret(t)})
+			require.NoError(t, err)
+			p := NewPrimary("127.0.0.1:0", primary.addr, mode, grpc.WithTransportCredentials(insecure.NewCredentials()))
+			t.Cleanup(func() { p.Close() })
+			srv, err := NewServer(&Config{CommitLog: clog, Authenticator: authenticator, Primary: p})
+			require.NoError(t, err)
+			h := NewHTTPServer("", &HTTPConfig{
+				CommitLog:     clog,
+				Authenticator: authenticator,
+				Producer:      srv.Producer(),
+			}).Handler
+
+			rec := produceHTTP(t, h, "hello")
+
+			if mode == ForwardWrites {
+				require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+				require.Equal(t, []string{"hello"}, logValues(t, primary.log))
+			} else {
+				require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+				require.Equal(t, primary.addr, rec.Header().Get(PrimaryHeader))
+				require.Empty(t, logValues(t, primary.log))
+			}
+			require.Empty(t, logValues(t, clog))
+		})
+	}
+}
@@ -2,31 +2,263 @@ package server
 
 import (
 	"context"
+	"sync"
+	"time"
 
 	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/auth"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	grpc_middleware "github.com/grpc-ecosystem/go-grpc-middleware"
+	grpc_auth "github.com/grpc-ecosystem/go-grpc-middleware/auth"
+	grpc_zap "github.com/grpc-ecosystem/go-grpc-middleware/logging/zap"
+	grpc_ctxtags "github.com/grpc-ecosystem/go-grpc-middleware/tags"
+	grpc_prometheus "github.com/grpc-ecosystem/go-grpc-prometheus"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 )
 
 type Config struct {
 	CommitLog CommitLog
+	// nilの場合は認証を行わない
+	Authenticator Authenticator
+	// RPCごとにメソッド、ピア、処理時間、ステータスコードを出力する nilの場合は出力しない
+	Logger *zap.Logger
+	// RPCごとのリクエスト数・エラー数・処理時間と、ConsumeStreamの購読者数の登録先 nilの場合は登録しない
+	Registerer prometheus.Registerer
+	// RPCごとのスパンの作成元 nilの場合はトレースしない
+	// 呼び出し元のトレースコンテキストはgRPCのメタデータ(traceparent)から引き継ぐ
+	TracerProvider trace.TracerProvider
+	// trueの場合はgRPCのリフレクションを有効にする(grpcurlなどでのデバッグ用)
+	EnableReflection bool
+	// 書き込みを受け付けるノード nilの場合はこのノードが書き込みを受け付ける
+	Primary *Primary
+	// GetServersが返すサーバーの一覧 nilの場合はこのサーバー自身だけを返す
+	Servers ServerSource
+	// ImportLogで移行元のノードに接続する時の接続オプション 受け取ったメタデータのauthorizationは引き継ぐ
+	DialOptions []grpc.DialOption
+	// trueの場合はAdminサービス(ログの移行)を登録する 移行元は書き込みを移行先に向けるので、必要なノードだけで有効にする
+	EnableAdmin bool
+	// Adminサービスを呼び出せるサブジェクト Authenticatorがnilの場合は確認しない
+	AdminSubjects []string
+	// ログを移行した後のプライマリのアドレスを保存するファイル 空の場合は保存しない
+	// 起動時にファイルがあれば、Primaryに設定したアドレスの代わりにそのアドレスに書き込みを向ける
+	HandoverFile string
 }
 
+// サービスが依存するログの実装 internal/logのLogに限らず、インターフェイスを満たせば差し替えられる
+type CommitLog interface {
+	Append(*api.Record) (uint64, error)
+	Read(uint64) (*api.Record, error)
+}
+
+// コンテキストを受け取れるCommitLogには、RPCのスパンを引き継いで読み書きさせる
+type contextCommitLog interface {
+	AppendContext(context.Context, *api.Record) (uint64, error)
+	ReadContext(context.Context, uint64) (*api.Record, error)
+}
+
+// トークンを検証し、認証されたサブジェクトを返す
+type Authenticator interface {
+	Authenticate(token string) (subject string, err error)
+}
+
+// gRPCサーバーを作成し、ログサービスを登録する
+// 停止時の後始末(ConsumeStreamの終了やログのクローズ)も必要な場合はNewServerを使う
+func NewGRPCServer(config *Config, opts ...grpc.ServerOption) (*grpc.Server, error) {
+	gsrv, _, _, err := newServer(config, opts...)
+
+	return gsrv, err
+}
+
+// gRPCサーバーと、停止時に操作するログサービス・ヘルスチェックの実装を作成する
+func newServer(config *Config, opts ...grpc.ServerOption) (
+	*grpc.Server,
+	*grpcServer,
+	*healthServer,
+	error,
+) {
+	var (
+		unary  []grpc.UnaryServerInterceptor
+		stream []grpc.StreamServerInterceptor
+	)
+
+	// ctxtagsは後続のインターセプターがタグ(ピアのアドレスや認証されたサブジェクト)を追加できるように先頭に置く
+	unary = append(unary, grpc_ctxtags.UnaryServerInterceptor())
+	stream = append(stream, grpc_ctxtags.StreamServerInterceptor())
+
+	// 後続のインターセプターやハンドラーがRPCのスパンを親にできるように、ログや認証より前に置く
+	if config.TracerProvider != nil {
+		otelOpts := []otelgrpc.Option{
+			otelgrpc.WithTracerProvider(config.TracerProvider),
+			otelgrpc.WithPropagators(propagation.TraceContext{}),
+		}
+		unary = append(unary, otelgrpc.UnaryServerInterceptor(otelOpts...))
+		stream = append(stream, otelgrpc.StreamServerInterceptor(otelOpts...))
+	}
+
+	// 認証に失敗したリクエストもログに残るように、認証より前に置く
+	if config.Logger != nil {
+		logger := config.Logger.Named("server")
+		zapOpts := []grpc_zap.Option{
+			grpc_zap.WithDurationField(func(duration time.Duration) zapcore.Field {
+				return zap.Int64("grpc.time_ns", duration.Nanoseconds())
+			}),
+		}
+		unary = append(unary, grpc_zap.UnaryServerInterceptor(logger, zapOpts...))
+		stream = append(stream, grpc_zap.StreamServerInterceptor(logger, zapOpts...))
+	}
+
+	var srvMetrics *grpc_prometheus.ServerMetrics
+	if config.Registerer != nil {
+		srvMetrics = grpc_prometheus.NewServerMetrics()
+		srvMetrics.EnableHandlingTimeHistogram()
+		if err := config.Registerer.Register(srvMetrics); err != nil {
+			return nil, nil, nil, err
+		}
+		unary = append(unary, srvMetrics.UnaryServerInterceptor())
+		stream = append(stream, srvMetrics.StreamServerInterceptor())
+	}
+
+	if config.Authenticator != nil {
+		unary = append(unary, grpc_auth.UnaryServerInterceptor(authenticate(config.Authenticator)))
+		stream = append(stream, grpc_auth.StreamServerInterceptor(authenticate(config.Authenticator)))
+	}
+
+	opts = append(opts,
+		grpc.UnaryInterceptor(grpc_middleware.ChainUnaryServer(unary...)),
+		grpc.StreamInterceptor(grpc_middleware.ChainStreamServer(stream...)),
+	)
+
+	gsrv := grpc.NewServer(opts...)
+	srv, err := newgrpcServer(config)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	api.RegisterLogServer(gsrv, srv)
+	if config.EnableAdmin {
+		api.RegisterAdminServer(gsrv, &adminServer{grpcServer: srv})
+	}
+	hsrv := newHealthServer(config.CommitLog)
+	healthpb.RegisterHealthServer(gsrv, hsrv)
+	if config.EnableReflection {
+		reflection.Register(gsrv)
+	}
+
+	if srvMetrics != nil {
+		// 一度も呼ばれていないRPCも0として公開する
+		srvMetrics.InitializeMetrics(gsrv)
+	}
+
+	return gsrv, srv, hsrv, nil
+}
+
+// メタデータの「authorization: Bearer <token>」を検証し、サブジェクトをコンテキストに保持する
+func authenticate(a Authenticator) grpc_auth.AuthFunc {
+	return func(ctx context.Context) (context.Context, error) {
+		token, err := grpc_auth.AuthFromMD(ctx, "bearer")
+		if err != nil {
+			return ctx, err
+		}
+
+		subject, err := a.Authenticate(token)
+		if err != nil {
+			return ctx, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		grpc_ctxtags.Extract(ctx).Set("auth.subject", subject)
+
+		return auth.NewContext(ctx, subject), nil
+	}
+}
+
+const tracerName = "github.com/KeisukeYamane/proglog/internal/server"
+
 var _ api.LogServer = (*grpcServer)(nil)
 
 type grpcServer struct {
 	api.UnimplementedLogServer
 	*Config
+
+	// 現在開いているConsumeStreamの数
+	subscribers prometheus.Gauge
+	tracer      trace.Tracer
+	// 停止を始めた時に閉じる ストリームを終了させるために使用する
+	closing chan struct{}
+
+	// Produceが読みロック、ログを移行するノードが書き込みを止める間だけ書き込みロックを取得する
+	writes sync.RWMutex
+	// ログを移行した先のアドレス プライマリの設定がない場合に、以降の書き込みを拒否して伝える
+	handedOverTo string
+	// ログを移行している間はtrue 移行先が書き込みを受け付けないようにする
+	importing bool
+	// 移行元か移行先として移行している場合は1
+	migrating int32
 }
 
+// 停止中にストリームを終了する際のステータス クライアントは別のサーバーに接続し直せる
+var errShuttingDown = status.Error(codes.Unavailable, "server is shutting down")
+
 func newgrpcServer(config *Config) (srv *grpcServer, err error) {
 	srv = &grpcServer{
 		Config: config,
+		subscribers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "proglog",
+			Subsystem: "server",
+			Name:      "consume_stream_subscribers",
+			Help:      "Number of open ConsumeStream subscriptions.",
+		}),
+		tracer:  trace.NewNoopTracerProvider().Tracer(tracerName),
+		closing: make(chan struct{}),
+	}
+	if config.TracerProvider != nil {
+		srv.tracer = config.TracerProvider.Tracer(tracerName)
+	}
+	if err := srv.loadHandover(); err != nil {
+		return nil, err
+	}
+
+	if config.Registerer != nil {
+		if err := config.Registerer.Register(srv.subscribers); err != nil {
+			return nil, err
+		}
 	}
 
 	return srv, nil
 }
 
 func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api.ProduceResponse, error) {
-	offset, err := s.CommitLog.Append(req.Record)
+	s.writes.RLock()
+	defer s.writes.RUnlock()
+
+	// セカンダリの場合はプライマリに転送するか拒否する
+	if s.Primary != nil {
+		if res, handled, err := s.Primary.produce(ctx, req); handled {
+			return res, err
+		}
+	}
+	if err := s.migrationError(ctx); err != nil {
+		return nil, err
+	}
+
+	var (
+		offset uint64
+		err    error
+	)
+	if cl, ok := s.CommitLog.(contextCommitLog); ok {
+		offset, err = cl.AppendContext(ctx, req.Record)
+	} else {
+		offset, err = s.CommitLog.Append(req.Record)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -35,11 +267,26 @@ func (s *grpcServer) Produce(ctx context.Context, req *api.ProduceRequest) (*api
 }
 
 func (s *grpcServer) Consume(ctx context.Context, req *api.ConsumeRequest) (*api.ConsumeResponse, error) {
-	record, err := s.CommitLog.Read(req.Offset)
+	var (
+		record *api.Record
+		err    error
+	)
+	if cl, ok := s.CommitLog.(contextCommitLog); ok {
+		record, err = cl.ReadContext(ctx, req.Offset)
+	} else {
+		record, err = s.CommitLog.Read(req.Offset)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	// 書き込み側のトレースを辿れるように、RPCのスパンにトレースIDを残す
+	if sc := log.SpanContextFromRecord(record); sc.IsValid() {
+		trace.SpanFromContext(ctx).SetAttributes(
+			attribute.String("proglog.producer.trace_id", sc.TraceID().String()),
+		)
+	}
+
 	return &api.ConsumeResponse{Record: record}, nil
 }
 
@@ -50,6 +297,13 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 			return err
 		}
 
+		// 停止中は新たなレコードを書き込まない 書き込まれていないことはクライアントに伝わるので、別のサーバーで再送できる
+		select {
+		case <-s.closing:
+			return errShuttingDown
+		default:
+		}
+
 		res, err := s.Produce(stream.Context(), req)
 		if err != nil {
 			return err
@@ -61,16 +315,72 @@ func (s *grpcServer) ProduceStream(stream api.Log_ProduceStreamServer) error {
 	}
 }
 
+func (s *grpcServer) GetServers(ctx context.Context, req *api.GetServersRequest) (*api.GetServersResponse, error) {
+	if req.Local || s.Servers == nil {
+		server, err := s.localServer()
+		if err != nil {
+			return nil, err
+		}
+		return &api.GetServersResponse{Servers: []*api.Server{server}}, nil
+	}
+
+	servers, err := s.Servers.GetServers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &api.GetServersResponse{Servers: servers}, nil
+}
+
+/*
+このサーバーの役割とログのオフセットの範囲 IDは知らないので空にする
+CommitLogがオフセットの範囲を返せない場合は、オフセットを0にする
+*/
+func (s *grpcServer) localServer() (*api.Server, error) {
+	server := &api.Server{Role: api.Role_ROLE_PRIMARY}
+	if s.Primary != nil {
+		server.RpcAddr = s.Primary.LocalAddr
+		if !s.Primary.IsLocal() {
+			server.Role = api.Role_ROLE_SECONDARY
+		}
+	}
+	s.writes.RLock()
+	if s.handedOverTo != "" || s.importing {
+		server.Role = api.Role_ROLE_SECONDARY
+	}
+	s.writes.RUnlock()
+
+	if r, ok := s.CommitLog.(offsetRange); ok {
+		var err error
+		if server.LowestOffset, err = r.LowestOffset(); err != nil {
+			return nil, err
+		}
+		if server.HighestOffset, err = r.HighestOffset(); err != nil {
+			return nil, err
+		}
+	}
+
+	return server, nil
+}
+
 func (s *grpcServer) ConsumeStream(
 	req *api.ConsumeRequest,
 	stream api.Log_ConsumeStreamServer,
 ) error {
+	s.subscribers.Inc()
+	defer s.subscribers.Dec()
+
+	// レコードが書き込まれるまで読み出しを繰り返すので、読み出しごとのスパンは作らない
+	pollCtx := trace.ContextWithSpanContext(stream.Context(), trace.SpanContext{})
+
 	for {
 		select {
 		case <-stream.Context().Done():
 			return nil
+		case <-s.closing:
+			return errShuttingDown
 		default:
-			res, err := s.Consume(stream.Context(), req)
+			res, err := s.Consume(pollCtx, req)
 			switch err.(type) {
 			case nil:
 			case api.ErrOffsetOutOfRange:
@@ -79,7 +389,16 @@ func (s *grpcServer) ConsumeStream(
 				return err
 			}
 
-			if err = stream.Send(res); err != nil {
+			// 送信したレコードごとにスパンを作り、書き込み側のスパンにリンクする
+			_, span := s.tracer.Start(
+				stream.Context(),
+				"ConsumeStream.Send",
+				trace.WithAttributes(attribute.Int64("proglog.offset", int64(res.Record.Offset))),
+				trace.WithLinks(trace.Link{SpanContext: log.SpanContextFromRecord(res.Record)}),
+			)
+			err = stream.Send(res)
+			span.End()
+			if err != nil {
 				return err
 			}
 
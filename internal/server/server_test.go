@@ -0,0 +1,438 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/KeisukeYamane/proglog/internal/auth"
+	"github.com/KeisukeYamane/proglog/internal/log"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	reflectionpb "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/grpc/status"
+)
+
+var secret = []byte("test-secret")
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(
+		t *testing.T,
+		client api.LogClient,
+		config *Config,
+	){
+		"produce/consume a message to/from the log succeeds": testProduceConsume,
+		"consume past log boundary fails":                    testConsumePastBoundary,
+		"unauthenticated request fails":                      testUnauthenticated,
+	} {
+		t.Run(scenario, func(t *testing.T) {
+			client, config, teardown := setupTest(t, nil)
+			defer teardown()
+			fn(t, client, config)
+		})
+	}
+}
+
+// テスト用のサーバーとクライアントを作成する fnで設定を上書きできる
+func setupTest(t *testing.T, fn func(*Config)) (
+	client api.LogClient,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+
+	cc, cfg, teardown := setupConn(t, fn)
+
+	return api.NewLogClient(cc), cfg, teardown
+}
+
+// ログサービス以外(ヘルスチェックなど)のクライアントも作れるように、コネクションを返す
+func setupConn(t *testing.T, fn func(*Config)) (
+	cc *grpc.ClientConn,
+	cfg *Config,
+	teardown func(),
+) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "server-test")
+	require.NoError(t, err)
+
+	clog, err := log.NewLog(dir, log.Config{})
+	require.NoError(t, err)
+
+	authenticator, err := auth.New(auth.Config{
+		KeyFile: writeSecret(t),
+	})
+	require.NoError(t, err)
+
+	cfg = &Config{
+		CommitLog:     clog,
+		Authenticator: authenticator,
+	}
+	if fn != nil {
+		fn(cfg)
+	}
+
+	server, err := NewGRPCServer(cfg)
+	require.NoError(t, err)
+
+	go func() {
+		server.Serve(l)
+	}()
+
+	cc, err = grpc.Dial(
+		l.Addr().String(),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+
+	return cc, cfg, func() {
+		cc.Close()
+		server.Stop()
+		l.Close()
+		clog.Remove()
+		// テストの中でログを閉じた場合はRemoveが失敗するので、ディレクトリを直接削除する
+		os.RemoveAll(dir)
+	}
+}
+
+func writeSecret(t *testing.T) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, secret, 0600))
+
+	return path
+}
+
+// サブジェクトを持つトークンをメタデータに付与したコンテキストを返す
+func withToken(t *testing.T, ctx context.Context, subject string) context.Context {
+	t.Helper()
+
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+newToken(t, subject))
+}
+
+// secretで署名した、サブジェクトを持つトークン
+func newToken(t *testing.T, subject string) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(
+		jwt.SigningMethodHS256,
+		jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	).SignedString(secret)
+	require.NoError(t, err)
+
+	return token
+}
+
+func testProduceConsume(t *testing.T, client api.LogClient, config *Config) {
+	ctx := withToken(t, context.Background(), "alice")
+
+	want := &api.Record{
+		Value: []byte("hello world"),
+	}
+
+	produce, err := client.Produce(
+		ctx,
+		&api.ProduceRequest{
+			Record: want,
+		},
+	)
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset,
+	})
+	require.NoError(t, err)
+	require.Equal(t, want.Value, consume.Record.Value)
+	require.Equal(t, want.Offset, consume.Record.Offset)
+}
+
+func testConsumePastBoundary(t *testing.T, client api.LogClient, config *Config) {
+	ctx := withToken(t, context.Background(), "alice")
+
+	produce, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{
+			Value: []byte("hello world"),
+		},
+	})
+	require.NoError(t, err)
+
+	consume, err := client.Consume(ctx, &api.ConsumeRequest{
+		Offset: produce.Offset + 1,
+	})
+	if consume != nil {
+		t.Fatal("consume not nil")
+	}
+
+	require.Equal(t, codes.OutOfRange, status.Code(err))
+}
+
+func testUnauthenticated(t *testing.T, client api.LogClient, config *Config) {
+	// トークンなし
+	_, err := client.Produce(context.Background(), &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	// 不正なトークン
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer malformed")
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServerLogging(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Logger = zap.New(core)
+	})
+	defer teardown()
+
+	ctx := withToken(t, context.Background(), "alice")
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(context.Background(), &api.ConsumeRequest{Offset: 0})
+	require.Error(t, err)
+
+	entries := logs.All()
+	require.Len(t, entries, 2)
+
+	fields := entries[0].ContextMap()
+	require.Equal(t, "Produce", fields["grpc.method"])
+	require.Equal(t, "OK", fields["grpc.code"])
+	require.Equal(t, "alice", fields["auth.subject"])
+	require.Contains(t, fields, "peer.address")
+	require.Contains(t, fields, "grpc.time_ns")
+
+	fields = entries[1].ContextMap()
+	require.Equal(t, "Consume", fields["grpc.method"])
+	require.Equal(t, "Unauthenticated", fields["grpc.code"])
+}
+
+func TestServerMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.Registerer = reg
+	})
+	defer teardown()
+
+	ctx, cancel := context.WithCancel(withToken(t, context.Background(), "alice"))
+	defer cancel()
+
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+	_, err = client.Consume(ctx, &api.ConsumeRequest{Offset: 1})
+	require.Error(t, err)
+
+	stream, err := client.ConsumeStream(ctx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.NoError(t, err)
+
+	err = testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP proglog_server_consume_stream_subscribers Number of open ConsumeStream subscriptions.
+# TYPE proglog_server_consume_stream_subscribers gauge
+proglog_server_consume_stream_subscribers 1
+`), "proglog_server_consume_stream_subscribers")
+	require.NoError(t, err)
+
+	mfs, err := reg.Gather()
+	require.NoError(t, err)
+	handled := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "grpc_server_handled_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			code := labels["grpc_code"]
+			if code != "OK" {
+				code = "error"
+			}
+			handled[labels["grpc_method"]+"/"+code] += m.GetCounter().GetValue()
+		}
+	}
+	require.Equal(t, float64(1), handled["Produce/OK"])
+	require.Equal(t, float64(1), handled["Consume/error"])
+
+	// /metricsで公開されている
+	srv := NewHTTPServer("", &HTTPConfig{Gatherer: reg})
+	rec := httptest.NewRecorder()
+	srv.Handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Contains(t, rec.Body.String(), "grpc_server_handled_total")
+}
+
+func TestServerTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	client, _, teardown := setupTest(t, func(c *Config) {
+		c.TracerProvider = tp
+		// ログの内部のスパンも記録する
+		clog, err := log.NewLog(t.TempDir(), log.Config{TracerProvider: tp})
+		require.NoError(t, err)
+		t.Cleanup(func() { clog.Close() })
+		c.CommitLog = clog
+	})
+	defer teardown()
+
+	// クライアントのトレースコンテキストをメタデータで渡す
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := metadata.AppendToOutgoingContext(
+		withToken(t, context.Background(), "alice"),
+		"traceparent", "00-"+traceID+"-00f067aa0ba902b7-01",
+	)
+	_, err := client.Produce(ctx, &api.ProduceRequest{
+		Record: &api.Record{Value: []byte("hello world")},
+	})
+	require.NoError(t, err)
+
+	var appendSpan tracetest.SpanStub
+	names := map[string]bool{}
+	for _, s := range exporter.GetSpans() {
+		names[s.Name] = true
+		require.Equal(t, traceID, s.SpanContext.TraceID().String())
+		if s.Name == "Log.Append" {
+			appendSpan = s
+		}
+	}
+	require.True(t, names["log.v1.Log/Produce"])
+	require.True(t, names["Log.Append"])
+	require.True(t, names["store.Append"])
+
+	// 読み出し側のスパンは書き込み側のスパンにリンクされる
+	exporter.Reset()
+	streamCtx, cancel := context.WithCancel(withToken(t, context.Background(), "bob"))
+	defer cancel()
+	stream, err := client.ConsumeStream(streamCtx, &api.ConsumeRequest{Offset: 0})
+	require.NoError(t, err)
+	res, err := stream.Recv()
+	require.NoError(t, err)
+	require.Equal(t, traceID, log.SpanContextFromRecord(res.Record).TraceID().String())
+
+	require.Eventually(t, func() bool {
+		for _, s := range exporter.GetSpans() {
+			if s.Name == "ConsumeStream.Send" {
+				return len(s.Links) == 1 &&
+					s.Links[0].SpanContext.SpanID() == appendSpan.SpanContext.SpanID()
+			}
+		}
+		return false
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestHealthCheck(t *testing.T) {
+	cc, config, teardown := setupConn(t, func(c *Config) {
+		c.EnableReflection = true
+	})
+	defer teardown()
+
+	// ヘルスチェックはトークンなしで問い合わせられる
+	client := healthpb.NewHealthClient(cc)
+	for _, service := range []string{"", "log.v1.Log"} {
+		res, err := client.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+	}
+
+	watch, err := client.Watch(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	res, err := watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, res.Status)
+
+	// ログを閉じると読み書きできないのでNOT_SERVINGになる
+	require.NoError(t, config.CommitLog.(*log.Log).Close())
+	res, err = watch.Recv()
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	res, err = client.Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, res.Status)
+
+	// リフレクションで登録されているサービスを確認できる
+	ctx := withToken(t, context.Background(), "alice")
+	stream, err := reflectionpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	require.NoError(t, stream.Send(&reflectionpb.ServerReflectionRequest{
+		MessageRequest: &reflectionpb.ServerReflectionRequest_ListServices{},
+	}))
+	info, err := stream.Recv()
+	require.NoError(t, err)
+	var services []string
+	for _, s := range info.GetListServicesResponse().GetService() {
+		services = append(services, s.Name)
+	}
+	require.Contains(t, services, "log.v1.Log")
+	require.Contains(t, services, "grpc.health.v1.Health")
+}
+
+func TestReflectionDisabled(t *testing.T) {
+	cc, _, teardown := setupConn(t, nil)
+	defer teardown()
+
+	ctx := withToken(t, context.Background(), "alice")
+	stream, err := reflectionpb.NewServerReflectionClient(cc).ServerReflectionInfo(ctx)
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	require.Equal(t, codes.Unimplemented, status.Code(err))
+}
+
+func TestHTTPAuthentication(t *testing.T) {
+	authenticator, err := auth.New(auth.Config{KeyFile: writeSecret(t)})
+	require.NoError(t, err)
+
+	var subject string
+	h := authenticateHTTP(authenticator, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subject = auth.Subject(r.Context())
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Equal(t, http.StatusUnauthorized, rec.Code)
+	require.Equal(t, "Bearer", rec.Header().Get("WWW-Authenticate"))
+
+	token := newToken(t, "alice")
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "bearer "+token)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "alice", subject)
+}
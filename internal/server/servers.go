@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// GetServersが返すサーバーの一覧の取得元 静的な設定のほか、Membershipなどで見つけたノードから作ることもできる
+type ServerSource interface {
+	GetServers(ctx context.Context) ([]*api.Server, error)
+}
+
+// ログのオフセットの範囲を返せるCommitLog internal/logのLogが実装している
+type offsetRange interface {
+	LowestOffset() (uint64, error)
+	HighestOffset() (uint64, error)
+}
+
+// 静的な設定に書いたサーバー
+type StaticServer struct {
+	ID      string
+	RPCAddr string
+}
+
+/*
+設定で決めたサーバーの一覧を返すServerSource
+役割とオフセットの範囲はそれぞれのサーバーにGetServers(local)で問い合わせ、そのサーバー自身の設定と状態を返す
+(自身も問い合わせる) 応答しなかったサーバーは、errorに理由を入れて他のサーバーと一緒に返す
+*/
+type StaticServers struct {
+	Servers []StaticServer
+	// 問い合わせる時の接続オプション 受け取ったメタデータのauthorizationは引き継ぐ
+	DialOptions []grpc.DialOption
+	// サーバーごとの問い合わせの最大時間 0の場合は1秒
+	Timeout time.Duration
+}
+
+var _ ServerSource = (*StaticServers)(nil)
+
+func (s *StaticServers) GetServers(ctx context.Context) ([]*api.Server, error) {
+	timeout := s.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if authz := md.Get("authorization"); len(authz) > 0 {
+			ctx = metadata.NewOutgoingContext(ctx, metadata.Pairs("authorization", authz[0]))
+		}
+	}
+
+	servers := make([]*api.Server, len(s.Servers))
+	var wg sync.WaitGroup
+	for i, server := range s.Servers {
+		wg.Add(1)
+		go func(i int, server StaticServer) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			servers[i] = &api.Server{Id: server.ID, RpcAddr: server.RPCAddr}
+			local, err := s.getLocal(ctx, server.RPCAddr)
+			if err != nil {
+				servers[i].Error = err.Error()
+				return
+			}
+			servers[i].Role = local.Role
+			servers[i].LowestOffset = local.LowestOffset
+			servers[i].HighestOffset = local.HighestOffset
+		}(i, server)
+	}
+	wg.Wait()
+
+	return servers, nil
+}
+
+func (s *StaticServers) getLocal(ctx context.Context, addr string) (*api.Server, error) {
+	cc, err := grpc.DialContext(ctx, addr, s.DialOptions...)
+	if err != nil {
+		return nil, err
+	}
+	defer cc.Close()
+
+	res, err := api.NewLogClient(cc).GetServers(ctx, &api.GetServersRequest{Local: true})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Servers) != 1 {
+		return nil, fmt.Errorf("%s returned %d servers", addr, len(res.Servers))
+	}
+
+	return res.Servers[0], nil
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	api "github.com/KeisukeYamane/proglog/api/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestGetServers(t *testing.T) {
+	nodes := setupPrimaryNodes(t, 2, ForwardWrites)
+	a, b := nodes[0], nodes[1]
+	ctx := withToken(t, context.Background(), "operator")
+
+	for i := 0; i < 3; i++ {
+		_, err := a.log.Append(&api.Record{Value: []byte("record")})
+		require.NoError(t, err)
+	}
+
+	// 停止しているサーバーも一覧には含め、応答しなかった理由を返す
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	down := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	a.servers.Servers = []StaticServer{
+		{ID: "a", RPCAddr: a.addr},
+		{ID: "b", RPCAddr: b.addr},
+		{ID: "down", RPCAddr: down},
+	}
+
+	res, err := b.client.GetServers(ctx, &api.GetServersRequest{})
+	require.NoError(t, err)
+	require.Len(t, res.Servers, 3)
+	require.Equal(t, &api.Server{
+		Id:            "a",
+		RpcAddr:       a.addr,
+		Role:          api.Role_ROLE_PRIMARY,
+		LowestOffset:  0,
+		HighestOffset: 2,
+	}, stripState(res.Servers[0]))
+	require.Equal(t, &api.Server{
+		Id:      "b",
+		RpcAddr: b.addr,
+		Role:    api.Role_ROLE_SECONDARY,
+	}, stripState(res.Servers[1]))
+	require.Equal(t, "down", res.Servers[2].Id)
+	require.Equal(t, api.Role_ROLE_UNKNOWN, res.Servers[2].Role)
+	require.NotEmpty(t, res.Servers[2].Error)
+
+	// localの場合は応答したサーバー自身だけを返す
+	res, err = a.client.GetServers(ctx, &api.GetServersRequest{Local: true})
+	require.NoError(t, err)
+	require.Equal(t, []*api.Server{{
+		RpcAddr:       a.addr,
+		Role:          api.Role_ROLE_PRIMARY,
+		HighestOffset: 2,
+	}}, stripStates(res.Servers))
+
+	_, err = a.client.GetServers(context.Background(), &api.GetServersRequest{})
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+// protoの内部状態を除き、フィールドだけを比較できるようにする
+func stripState(s *api.Server) *api.Server {
+	return &api.Server{
+		Id:            s.Id,
+		RpcAddr:       s.RpcAddr,
+		Role:          s.Role,
+		LowestOffset:  s.LowestOffset,
+		HighestOffset: s.HighestOffset,
+		Error:         s.Error,
+	}
+}
+
+func stripStates(servers []*api.Server) []*api.Server {
+	var stripped []*api.Server
+	for _, s := range servers {
+		stripped = append(stripped, stripState(s))
+	}
+	return stripped
+}